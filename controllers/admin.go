@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gocraft/web"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+// AdminContext stores the session info and access token per user.
+// All routes within AdminContext are only available to platform operators.
+type AdminContext struct {
+	*SecureContext // Required.
+	claims         *helpers.TokenClaims
+}
+
+// AdminRequired is a middleware that requires the user's token to have the
+// admin scope. It must run after the OAuth middleware.
+func (c *AdminContext) AdminRequired(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	claims, err := helpers.ParseTokenClaims(&c.Token)
+	if err != nil || !claims.HasScope(helpers.AdminScope) {
+		newAPIError(http.StatusForbidden, "you must be an admin.").writeTo(rw)
+		return
+	}
+	c.claims = claims
+	next(rw, req)
+}
+
+// MailTemplates lists the names of the mail templates that can be previewed.
+func (c *AdminContext) MailTemplates(rw web.ResponseWriter, req *web.Request) {
+	json.NewEncoder(rw).Encode(struct {
+		Templates []string `json:"templates"`
+	}{
+		Templates: helpers.MailTemplateNames(),
+	})
+}
+
+// getMailPreview renders the mail template named in the route, writing an
+// error to the response if it can't.
+func (c *AdminContext) getMailPreview(rw web.ResponseWriter, req *web.Request) *helpers.MailPreview {
+	preview, err := c.templates.GetMailPreview(req.PathParams["template"])
+	if err != nil {
+		if _, ok := err.(*helpers.ErrUnknownMailTemplate); ok {
+			newAPIError(http.StatusNotFound, err.Error()).writeTo(rw)
+		} else {
+			newAPIError(http.StatusInternalServerError, err.Error()).writeTo(rw)
+		}
+		return nil
+	}
+	return preview
+}
+
+// PreviewMailTemplate renders a mail template with sample data. By default the
+// subject, HTML and text variants are returned as JSON. Use ?format=html or
+// ?format=text to get just that variant, e.g. to view it in a browser.
+func (c *AdminContext) PreviewMailTemplate(rw web.ResponseWriter, req *web.Request) {
+	preview := c.getMailPreview(rw, req)
+	if preview == nil {
+		return
+	}
+	switch req.URL.Query().Get("format") {
+	case "html":
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Write([]byte(preview.HTML))
+	case "text":
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.Write([]byte(preview.Text))
+	default:
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(preview)
+	}
+}
+
+// SendMailPreview sends the rendered mail template to the e-mail address of
+// the logged in user through the configured mailer.
+func (c *AdminContext) SendMailPreview(rw web.ResponseWriter, req *web.Request) {
+	if c.claims.Email == "" {
+		newAPIError(http.StatusBadRequest, "no e-mail address found for the current user.").writeTo(rw)
+		return
+	}
+	preview := c.getMailPreview(rw, req)
+	if preview == nil {
+		return
+	}
+	err := c.mailer.SendEmail(c.claims.Email, "[Preview] "+preview.Subject, []byte(preview.HTML))
+	if err != nil {
+		helpers.Metrics.Emails.WithLabelValues("preview", "failure").Inc()
+		newAPIError(http.StatusInternalServerError, err.Error()).writeTo(rw)
+		return
+	}
+	helpers.Metrics.Emails.WithLabelValues("preview", "success").Inc()
+	json.NewEncoder(rw).Encode(struct {
+		Status string `json:"status"`
+		Email  string `json:"email"`
+	}{
+		Status: "success",
+		Email:  c.claims.Email,
+	})
+}
+
+// sessionIndex returns the session index, writing an error to the response if
+// the session backend doesn't have one.
+func (c *AdminContext) sessionIndex(rw web.ResponseWriter) helpers.SessionIndex {
+	if c.Settings.SessionIndex == nil {
+		newAPIError(http.StatusNotImplemented, "managing sessions requires the redis session backend.").writeTo(rw)
+	}
+	return c.Settings.SessionIndex
+}
+
+// ListUserSessions lists the active sessions of a user.
+func (c *AdminContext) ListUserSessions(rw web.ResponseWriter, req *web.Request) {
+	index := c.sessionIndex(rw)
+	if index == nil {
+		return
+	}
+	sessions, err := index.List(req.PathParams["user_id"])
+	if err != nil {
+		newAPIError(http.StatusInternalServerError, err.Error()).writeTo(rw)
+		return
+	}
+	json.NewEncoder(rw).Encode(struct {
+		Sessions []helpers.SessionInfo `json:"sessions"`
+	}{
+		Sessions: sessions,
+	})
+}
+
+// RevokeUserSession terminates one session of a user.
+func (c *AdminContext) RevokeUserSession(rw web.ResponseWriter, req *web.Request) {
+	index := c.sessionIndex(rw)
+	if index == nil {
+		return
+	}
+	err := index.Revoke(req.PathParams["user_id"], req.PathParams["session_id"])
+	if err == helpers.ErrSessionNotFound {
+		newAPIError(http.StatusNotFound, err.Error()).writeTo(rw)
+		return
+	}
+	if err != nil {
+		newAPIError(http.StatusInternalServerError, err.Error()).writeTo(rw)
+		return
+	}
+	json.NewEncoder(rw).Encode(struct {
+		Status  string `json:"status"`
+		Revoked int    `json:"revoked"`
+	}{
+		Status:  "success",
+		Revoked: 1,
+	})
+}
+
+// RevokeUserSessions terminates all the sessions of a user.
+func (c *AdminContext) RevokeUserSessions(rw web.ResponseWriter, req *web.Request) {
+	index := c.sessionIndex(rw)
+	if index == nil {
+		return
+	}
+	revoked, err := index.RevokeAll(req.PathParams["user_id"])
+	if err != nil {
+		newAPIError(http.StatusInternalServerError, err.Error()).writeTo(rw)
+		return
+	}
+	json.NewEncoder(rw).Encode(struct {
+		Status  string `json:"status"`
+		Revoked int    `json:"revoked"`
+	}{
+		Status:  "success",
+		Revoked: revoked,
+	})
+}
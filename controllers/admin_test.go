@@ -0,0 +1,159 @@
+package controllers_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/18F/cg-dashboard/helpers/testhelpers"
+)
+
+type adminTest struct {
+	BasicSecureTest
+	RequestMethod string
+	RequestPath   string
+}
+
+var mailPreviewTests = []adminTest{
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "List mail templates as non admin",
+				EnvVars:     GetMockCompleteEnvVars(),
+				SessionData: ValidTokenData,
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "forbidden", "message": "you must be an admin."}`),
+			ExpectedCode:     http.StatusForbidden,
+		},
+		RequestMethod: "GET",
+		RequestPath:   "/admin/mail",
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "List mail templates as admin",
+				EnvVars:     GetMockCompleteEnvVars(),
+				SessionData: AdminTokenData,
+			},
+			ExpectedResponse: NewJSONResponseContentTester(`{"templates": ["invite"]}`),
+			ExpectedCode:     http.StatusOK,
+		},
+		RequestMethod: "GET",
+		RequestPath:   "/admin/mail",
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "Preview unknown mail template",
+				EnvVars:     GetMockCompleteEnvVars(),
+				SessionData: AdminTokenData,
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "not_found", "message": "unknown mail template: blah"}`),
+			ExpectedCode:     http.StatusNotFound,
+		},
+		RequestMethod: "GET",
+		RequestPath:   "/admin/mail/blah",
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "Send mail template preview",
+				EnvVars:     GetMockCompleteEnvVars(),
+				SessionData: AdminTokenData,
+			},
+			ExpectedResponse: NewJSONResponseContentTester(`{"status": "success", "email": "admin@example.com"}`),
+			ExpectedCode:     http.StatusOK,
+		},
+		RequestMethod: "POST",
+		RequestPath:   "/admin/mail/invite/send",
+	},
+}
+
+func TestMailPreview(t *testing.T) {
+	for _, test := range mailPreviewTests {
+		response, request := NewTestRequest(test.RequestMethod, test.RequestPath, nil)
+		router, _ := CreateRouterWithMockSession(test.SessionData, test.EnvVars)
+		router.ServeHTTP(response, request)
+		if !test.ExpectedResponse.Check(t, response.Body.String()) {
+			t.Errorf("Test %s did not meet expected value. Expected %s. Found %s.\n", test.TestName, test.ExpectedResponse.Display(), response.Body.String())
+		}
+		if response.Code != test.ExpectedCode {
+			t.Errorf("Test %s did not meet expected code. Expected %d. Found %d.\n", test.TestName, test.ExpectedCode, response.Code)
+		}
+	}
+}
+
+func TestMailPreviewFormats(t *testing.T) {
+	router, _ := CreateRouterWithMockSession(AdminTokenData, GetMockCompleteEnvVars())
+
+	response, request := NewTestRequest("GET", "/admin/mail/invite?format=html", nil)
+	router.ServeHTTP(response, request)
+	if !strings.Contains(response.Body.String(), `href="https://login.example.com/invitations/accept?code=sample-code"`) {
+		t.Errorf("Expected the html preview to contain the sample invite url. Found %s", response.Body.String())
+	}
+
+	response, request = NewTestRequest("GET", "/admin/mail/invite?format=text", nil)
+	router.ServeHTTP(response, request)
+	if strings.Contains(response.Body.String(), "<") {
+		t.Errorf("Expected the text preview to not contain any html. Found %s", response.Body.String())
+	}
+	if !strings.Contains(response.Body.String(), "Accept your invitation") {
+		t.Errorf("Expected the text preview to contain the invite text. Found %s", response.Body.String())
+	}
+}
+
+var sessionAdminTests = []adminTest{
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "List sessions as non admin",
+				EnvVars:     GetMockCompleteEnvVars(),
+				SessionData: ValidTokenData,
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "forbidden", "message": "you must be an admin."}`),
+			ExpectedCode:     http.StatusForbidden,
+		},
+		RequestMethod: "GET",
+		RequestPath:   "/admin/users/user-guid/sessions",
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "List sessions without session index",
+				EnvVars:     GetMockCompleteEnvVars(),
+				SessionData: AdminTokenData,
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "not_implemented", "message": "managing sessions requires the redis session backend."}`),
+			ExpectedCode:     http.StatusNotImplemented,
+		},
+		RequestMethod: "GET",
+		RequestPath:   "/admin/users/user-guid/sessions",
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "Revoke sessions without session index",
+				EnvVars:     GetMockCompleteEnvVars(),
+				SessionData: AdminTokenData,
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "not_implemented", "message": "managing sessions requires the redis session backend."}`),
+			ExpectedCode:     http.StatusNotImplemented,
+		},
+		RequestMethod: "DELETE",
+		RequestPath:   "/admin/users/user-guid/sessions",
+	},
+}
+
+func TestSessionAdmin(t *testing.T) {
+	for _, test := range sessionAdminTests {
+		response, request := NewTestRequest(test.RequestMethod, test.RequestPath, nil)
+		router, _ := CreateRouterWithMockSession(test.SessionData, test.EnvVars)
+		router.ServeHTTP(response, request)
+		if !test.ExpectedResponse.Check(t, response.Body.String()) {
+			t.Errorf("Test %s did not meet expected value. Expected %s. Found %s.\n", test.TestName, test.ExpectedResponse.Display(), response.Body.String())
+		}
+		if response.Code != test.ExpectedCode {
+			t.Errorf("Test %s did not meet expected code. Expected %d. Found %d.\n", test.TestName, test.ExpectedCode, response.Code)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/gocraft/web"
 	"net/http"
+
+	"github.com/18F/cg-dashboard/helpers"
 )
 
 // APIContext stores the session info and access token per user.
@@ -13,8 +15,14 @@ type APIContext struct {
 }
 
 // APIProxy is a handler that serves as a proxy for all the CF API. Any route that comes in the /v2/* route
-// that has not been specified, will just come here.
+// that has not been specified, will just come here. Only the requests allowed
+// by the proxy policy are proxied.
 func (c *APIContext) APIProxy(rw web.ResponseWriter, req *web.Request) {
+	if !c.Settings.ProxyPolicy.Allowed(req.Method, req.URL.Path) {
+		c.logger().Warn("proxy request denied", helpers.Fields{"method": req.Method, "path": req.URL.Path})
+		newAPIError(http.StatusForbidden, "this request is not allowed through the dashboard.").writeTo(rw)
+		return
+	}
 	reqURL := fmt.Sprintf("%s%s", c.Settings.ConsoleAPI, req.URL)
 	c.Proxy(rw, req.Request, reqURL, c.GenericResponseHandler)
 }
@@ -1,6 +1,10 @@
 package controllers_test
 
 import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/18F/cg-dashboard/helpers"
 	. "github.com/18F/cg-dashboard/helpers/testhelpers"
 
 	"testing"
@@ -53,3 +57,42 @@ func TestProfile(t *testing.T) {
 		}
 	}
 }
+
+func TestAPIProxyPolicy(t *testing.T) {
+	cfServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer cfServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.APIURLEnvVar] = cfServer.URL
+	envVars[helpers.ProxyRulesEnvVar] = "allow GET /v2/buildpacks; deny DELETE /v2/apps/*"
+	router, _ := CreateRouterWithMockSession(ValidTokenData, envVars)
+
+	tests := []struct {
+		method       string
+		path         string
+		expectedCode int
+	}{
+		{"GET", "/v2/apps/app-guid/summary?inline-relations-depth=1", http.StatusOK},
+		{"PUT", "/v2/organizations/org-guid/managers/user-guid", http.StatusOK},
+		{"GET", "/v2/buildpacks", http.StatusOK},
+		{"GET", "/v2/config/feature_flags", http.StatusForbidden},
+		{"PUT", "/v2/security_groups/group-guid/spaces/space-guid", http.StatusForbidden},
+		{"DELETE", "/v2/apps/app-guid", http.StatusForbidden},
+		{"DELETE", "/v2/organizations/org-guid", http.StatusForbidden},
+		{"GET", "/v2/apps/../config/feature_flags", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		response, request := NewTestRequest(test.method, test.path, nil)
+		router.ServeHTTP(response, request)
+		if response.Code != test.expectedCode {
+			t.Errorf("%s %s: expected code %d. Found %d", test.method, test.path, test.expectedCode, response.Code)
+		}
+		if test.expectedCode == http.StatusForbidden {
+			expected := NewJSONErrorContentTester(`{"status": "failure", "code": "forbidden", "message": "this request is not allowed through the dashboard."}`)
+			if !expected.Check(t, response.Body.String()) {
+				t.Errorf("%s %s: expected a JSON error. Found %s", test.method, test.path, response.Body.String())
+			}
+		}
+	}
+}
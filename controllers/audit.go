@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+// auditBody keeps a copy of the request body as it is sent upstream, up to
+// helpers.AuditBodyMaxBytes.
+type auditBody struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *auditBody) Write(p []byte) (int, error) {
+	if b.truncated || b.buf.Len()+len(p) > helpers.AuditBodyMaxBytes {
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// auditEvent returns the audit event of a request proxied with the token of
+// the user, or "" for the requests which don't change anything.
+func auditEvent(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ""
+	}
+	return helpers.AuditProxiedRequest
+}
+
+// audit records a request proxied upstream. The status is 0 if the upstream
+// could not be reached.
+func (c *SecureContext) audit(event, method, rawURL string, body *auditBody, status int, err error) {
+	record := helpers.AuditRecord{
+		Event:          event,
+		RequestID:      c.requestID,
+		UserID:         c.userID,
+		ClientIP:       c.clientIP,
+		Method:         method,
+		Upstream:       c.Settings.Upstream(rawURL),
+		UpstreamStatus: status,
+		TargetGUID:     c.targetGUID,
+	}
+	if u, parseErr := url.Parse(rawURL); parseErr == nil {
+		record.Path = u.Path
+	}
+	if record.TargetGUID == "" {
+		record.TargetGUID = helpers.AuditTargetGUID(record.Path)
+	}
+	if body != nil && !body.truncated {
+		record.Body = helpers.RedactBody(body.buf.Bytes())
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	c.Settings.Audit(record)
+}
+
+// errRateLimited is the error of the audit records of the privileged calls
+// refused by the rate limit.
+var errRateLimited = errors.New("rate limit exceeded")
+
+// auditDenied records a privileged call which was not made because of the
+// rate limit.
+func (c *SecureContext) auditDenied(method, rawURL string) {
+	c.audit(helpers.AuditPrivilegedRequestDenied, method, rawURL, nil, 0, errRateLimited)
+}
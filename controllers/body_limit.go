@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gocraft/web"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+// errBodyTooLarge is returned when reading past the body limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody is a request body which can't be read past the limit of its
+// route group.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	b.exceeded = true
+	return int(b.remaining), errBodyTooLarge
+}
+
+// bodyTooLarge returns whether the body of the request was cut at its limit.
+func bodyTooLarge(req *http.Request) bool {
+	b, ok := req.Body.(*limitedBody)
+	return ok && b.exceeded
+}
+
+// LimitRequestBody is a middleware that limits the size of the request bodies
+// as configured for their route group, and only accepts the content types the
+// dashboard and its upstreams understand on PUT and POST.
+func (c *Context) LimitRequestBody(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if req.Body == nil || req.ContentLength == 0 {
+		next(rw, req)
+		return
+	}
+	if (req.Method == "PUT" || req.Method == "POST") && !helpers.AllowedContentType(req.URL.Path, req.Header.Get("Content-Type")) {
+		newAPIError(http.StatusUnsupportedMediaType, "unsupported content type. send application/json.").writeTo(rw)
+		return
+	}
+	limit := c.Settings.BodyLimit(req.URL.Path)
+	if limit == 0 {
+		next(rw, req)
+		return
+	}
+	if req.ContentLength > limit {
+		writeBodyTooLarge(rw)
+		return
+	}
+	req.Body = &limitedBody{ReadCloser: req.Body, remaining: limit}
+	next(rw, req)
+}
+
+// writeBodyTooLarge tells the client that the request body is over the limit,
+// unless the response has already started.
+func writeBodyTooLarge(rw http.ResponseWriter) {
+	if w, ok := rw.(web.ResponseWriter); ok && w.Written() {
+		return
+	}
+	newAPIError(http.StatusRequestEntityTooLarge, "the request body is too large.").writeTo(rw)
+}
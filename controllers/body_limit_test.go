@@ -0,0 +1,108 @@
+package controllers_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/18F/cg-dashboard/helpers"
+	. "github.com/18F/cg-dashboard/helpers/testhelpers"
+)
+
+func TestLimitRequestBody(t *testing.T) {
+	cfServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.Write([]byte("{}"))
+	}))
+	defer cfServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.APIURLEnvVar] = cfServer.URL
+	envVars[helpers.BodyLimitsEnvVar] = "api=1KB,uaa=32"
+	router, _ := CreateRouterWithMockSession(AdminTokenData, envVars)
+
+	large := []byte(`{"name": "` + strings.Repeat("a", 2048) + `"}`)
+	tests := []struct {
+		testName         string
+		method           string
+		path             string
+		contentType      string
+		body             []byte
+		chunked          bool
+		expectedCode     int
+		expectedResponse string
+	}{
+		{
+			testName:     "Body within the limit",
+			method:       "PUT",
+			path:         "/v2/apps/app-guid",
+			contentType:  "application/json; charset=utf-8",
+			body:         []byte(`{"instances": 2}`),
+			expectedCode: http.StatusOK,
+		},
+		{
+			testName:     "Request without body",
+			method:       "POST",
+			path:         "/v2/apps/app-guid/restage",
+			expectedCode: http.StatusOK,
+		},
+		{
+			testName:         "Unexpected content type",
+			method:           "PUT",
+			path:             "/v2/apps/app-guid",
+			contentType:      "application/x-www-form-urlencoded",
+			body:             []byte(`instances=2`),
+			expectedCode:     http.StatusUnsupportedMediaType,
+			expectedResponse: `{"status": "failure", "code": "unsupported_media_type", "message": "unsupported content type. send application/json."}`,
+		},
+		{
+			testName:         "Body over the limit",
+			method:           "PUT",
+			path:             "/v2/apps/app-guid",
+			contentType:      "application/json",
+			body:             large,
+			expectedCode:     http.StatusRequestEntityTooLarge,
+			expectedResponse: `{"status": "failure", "code": "body_too_large", "message": "the request body is too large."}`,
+		},
+		{
+			testName:         "Streamed body over the limit",
+			method:           "PUT",
+			path:             "/v2/apps/app-guid",
+			contentType:      "application/json",
+			body:             large,
+			chunked:          true,
+			expectedCode:     http.StatusRequestEntityTooLarge,
+			expectedResponse: `{"status": "failure", "code": "body_too_large", "message": "the request body is too large."}`,
+		},
+		{
+			testName:         "Streamed body over the limit of its route group",
+			method:           "POST",
+			path:             "/uaa/invite/users",
+			contentType:      "application/json",
+			body:             []byte(`{"email": "someone-with-a-long-address@example.com"}`),
+			chunked:          true,
+			expectedCode:     http.StatusRequestEntityTooLarge,
+			expectedResponse: `{"status": "failure", "code": "body_too_large", "message": "the request body is too large."}`,
+		},
+	}
+	for _, test := range tests {
+		response, request := NewTestRequest(test.method, test.path, test.body)
+		if test.chunked {
+			// The size is not known up front.
+			request.Body = ioutil.NopCloser(bytes.NewReader(test.body))
+			request.ContentLength = -1
+		}
+		if test.contentType != "" {
+			request.Header.Set("Content-Type", test.contentType)
+		}
+		router.ServeHTTP(response, request)
+		if response.Code != test.expectedCode {
+			t.Errorf("Test %s: expected code %d. Found %d", test.testName, test.expectedCode, response.Code)
+		}
+		if test.expectedResponse != "" && !NewJSONErrorContentTester(test.expectedResponse).Check(t, response.Body.String()) {
+			t.Errorf("Test %s: unexpected response %s", test.testName, response.Body.String())
+		}
+	}
+}
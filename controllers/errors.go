@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+// errorCodes are the codes of the errors by HTTP status, unless given.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusRequestEntityTooLarge: "body_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusNotImplemented:        "not_implemented",
+	http.StatusBadGateway:            "upstream_error",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "timeout",
+}
+
+// APIError is an error of the dashboard. Every controller writes its errors
+// in the same JSON envelope:
+//
+//	{"status": "failure", "code": "forbidden", "message": "...",
+//	 "request_id": "...", "upstream_status": 500, "upstream_body": ...}
+//
+// The upstream fields are only set when a call to UAA or the CF API failed.
+type APIError struct {
+	statusCode     int
+	code           string
+	message        string
+	upstreamStatus int
+	upstreamBody   []byte
+	// retryAfter is the Retry-After header, in seconds, of rate limited
+	// requests.
+	retryAfter string
+}
+
+// errorEnvelope is the JSON form of an APIError.
+type errorEnvelope struct {
+	Status         string          `json:"status"`
+	Code           string          `json:"code"`
+	Message        string          `json:"message"`
+	RequestID      string          `json:"request_id,omitempty"`
+	UpstreamStatus int             `json:"upstream_status,omitempty"`
+	UpstreamBody   json.RawMessage `json:"upstream_body,omitempty"`
+}
+
+// newAPIError creates an error with the code of its HTTP status.
+func newAPIError(statusCode int, message string) *APIError {
+	code, ok := errorCodes[statusCode]
+	if !ok {
+		code = "error"
+	}
+	return &APIError{statusCode: statusCode, code: code, message: message}
+}
+
+// newUpstreamError creates an error caused by the response of an upstream,
+// which is passed on to the client.
+func newUpstreamError(statusCode int, message string, upstreamStatus int, upstreamBody []byte) *APIError {
+	e := newAPIError(statusCode, message)
+	e.upstreamStatus = upstreamStatus
+	e.upstreamBody = upstreamBody
+	return e
+}
+
+// withCode replaces the code of the error, for the errors the frontend needs
+// to tell apart from others with the same HTTP status.
+func (e *APIError) withCode(code string) *APIError {
+	e.code = code
+	return e
+}
+
+func (e *APIError) Error() string {
+	return e.message
+}
+
+// writeTo writes the error to the response, with the ID the request got from
+// the RequestLogging middleware.
+func (e *APIError) writeTo(rw http.ResponseWriter) {
+	envelope := errorEnvelope{
+		Status:         "failure",
+		Code:           e.code,
+		Message:        e.message,
+		RequestID:      rw.Header().Get(helpers.RequestIDHeader),
+		UpstreamStatus: e.upstreamStatus,
+		UpstreamBody:   upstreamBody(e.upstreamBody),
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		// If we get here, we're having a really bad day
+		body = []byte(`{"status": "failure", "code": "internal_error", "message": "cannot marshal proper error"}`)
+	}
+	if e.retryAfter != "" {
+		rw.Header().Set("Retry-After", e.retryAfter)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(e.statusCode)
+	rw.Write(body)
+}
+
+// upstreamBody returns the body of an upstream response as JSON, as is if it
+// is JSON already or else as a string.
+func upstreamBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	var raw json.RawMessage
+	if err := json.Unmarshal(body, &raw); err == nil {
+		return raw
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
@@ -12,6 +12,8 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
+
+	"github.com/18F/cg-dashboard/helpers"
 )
 
 // LogContext stores the session info and access token per user.
@@ -31,7 +33,8 @@ func (c *LogContext) RecentLogs(rw web.ResponseWriter, req *web.Request) {
 func (c *LogContext) logMessageResponseHandler(rw http.ResponseWriter, response *http.Response) {
 	messages, err := c.ParseLogMessages(&(response.Body), response.Header.Get("Content-Type"))
 	if err != nil {
-		rw.Write([]byte(err.Error()))
+		// The status is already sent, the client gets an empty body.
+		c.logger().Error("unable to parse log messages", helpers.Fields{"error": err})
 		return
 	}
 	rw.Write([]byte(messages.String()))
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gocraft/web"
+	"github.com/gorilla/context"
+	"golang.org/x/oauth2"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+// RequestLogging is a middleware that assigns an ID to the request and logs
+// it once served, with the route, user, status and latency.
+func (c *Context) RequestLogging(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	start := time.Now()
+	c.requestID = helpers.RequestID(req.Request)
+	rw.Header().Set(helpers.RequestIDHeader, c.requestID)
+	c.requestLogger = helpers.Log.With(helpers.Fields{"request_id": c.requestID})
+	req.Request = helpers.WithLogger(req.Request, c.requestLogger)
+	// The sessions are registered in gorilla/context by request, and
+	// context.ClearHandler only clears the original one.
+	defer context.Clear(req.Request)
+
+	next(rw, req)
+
+	status := rw.StatusCode()
+	if status == 0 {
+		status = 200
+	}
+	fields := helpers.Fields{
+		"method":     req.Method,
+		"path":       req.URL.Path,
+		"route":      req.RoutePath(),
+		"status":     status,
+		"latency_ms": time.Since(start).Seconds() * 1000,
+	}
+	if c.userID != "" {
+		fields["user_id"] = c.userID
+	}
+	c.logger().Info("request", fields)
+
+	route := req.RoutePath()
+	if route == "" {
+		// Static files.
+		route = "other"
+	}
+	helpers.Metrics.HTTPRequests.WithLabelValues(route, req.Method, strconv.Itoa(status)).Inc()
+	helpers.Metrics.HTTPRequestDuration.WithLabelValues(route, req.Method).Observe(time.Since(start).Seconds())
+}
+
+// logger returns the logger of the request.
+func (c *Context) logger() *helpers.Logger {
+	if c.requestLogger == nil {
+		return helpers.Log
+	}
+	return c.requestLogger
+}
+
+// identifyUser adds the ID of the user the token belongs to, if any, to the
+// logs of the request.
+func (c *Context) identifyUser(token *oauth2.Token) {
+	claims, err := helpers.ParseTokenClaims(token)
+	if err != nil || claims.UserID == "" || claims.UserID == c.userID {
+		return
+	}
+	c.userID = claims.UserID
+	c.requestLogger = c.logger().With(helpers.Fields{"user_id": c.userID})
+}
+
+// upstreamURL strips the query string from a URL before logging it, as it
+// may contain personal information such as e-mail addresses.
+func upstreamURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,109 @@
+package controllers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/gorilla/context"
+
+	"github.com/18F/cg-dashboard/controllers"
+	"github.com/18F/cg-dashboard/helpers"
+	. "github.com/18F/cg-dashboard/helpers/testhelpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers/mocks"
+)
+
+func TestRequestLogging(t *testing.T) {
+	var upstreamRequestID string
+	uaaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestID = r.Header.Get(helpers.RequestIDHeader)
+		w.Write([]byte("{}"))
+	}))
+	defer uaaServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.UAAURLEnvVar] = uaaServer.URL
+
+	var logs bytes.Buffer
+	helpers.Log.SetOutput(&logs)
+	defer helpers.Log.SetOutput(os.Stdout)
+
+	response, request := NewTestRequest("GET", "/uaa/userinfo?secret=1", nil)
+	request.Header.Set(helpers.RequestIDHeader, "abc-123")
+	router, _ := CreateRouterWithMockSession(AdminTokenData, envVars)
+	router.ServeHTTP(response, request)
+
+	if response.Header().Get(helpers.RequestIDHeader) != "abc-123" {
+		t.Errorf("Expected the request id in the response. Found %s", response.Header().Get(helpers.RequestIDHeader))
+	}
+	if upstreamRequestID != "abc-123" {
+		t.Errorf("Expected the request id to be forwarded to UAA. Found %s", upstreamRequestID)
+	}
+
+	entries := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected JSON logs. Found %s", line)
+		}
+		entries[entry["msg"].(string)] = entry
+	}
+	expected := map[string]map[string]interface{}{
+		"upstream request": {
+			"request_id":      "abc-123",
+			"user_id":         "admin-user-guid",
+			"upstream_url":    uaaServer.URL + "/userinfo",
+			"upstream_status": float64(200),
+		},
+		"request": {
+			"request_id": "abc-123",
+			"user_id":    "admin-user-guid",
+			"route":      "/uaa/userinfo",
+			"path":       "/uaa/userinfo",
+			"status":     float64(200),
+		},
+	}
+	for msg, fields := range expected {
+		entry, ok := entries[msg]
+		if !ok {
+			t.Errorf("Expected a %q log entry. Found %s", msg, logs.String())
+			continue
+		}
+		for k, v := range fields {
+			if entry[k] != v {
+				t.Errorf("Expected %s of %q entry to be %v. Found %v", k, msg, v, entry[k])
+			}
+		}
+		if _, ok := entry["latency_ms"]; !ok {
+			t.Errorf("Expected the latency in the %q entry", msg)
+		}
+	}
+}
+
+func TestRequestContextCleared(t *testing.T) {
+	env, _ := cfenv.Current()
+	settings := helpers.Settings{}
+	if err := settings.InitSettings(helpers.NewEnvVarsFromPath(NewEnvLookupFromMap(GetMockCompleteEnvVars())), env); err != nil {
+		t.Fatal(err)
+	}
+	templates, _ := helpers.InitTemplates(settings.BasePath)
+	// The app is served as in the server, with the real session store.
+	app := context.ClearHandler(controllers.InitRouter(&settings, templates, new(mocks.Mailer)))
+
+	// The middlewares hand copies of the request down the chain, which get
+	// their own session registry. Nothing must be left in gorilla/context
+	// for any of them.
+	context.Purge(0)
+	response, request := NewTestRequest("GET", "/v2/authstatus", nil)
+	app.ServeHTTP(response, request)
+	if len(context.GetAll(request)) != 0 {
+		t.Error("Expected the request to be cleared from gorilla/context")
+	}
+	if leaked := context.Purge(0); leaked != 0 {
+		t.Errorf("Expected nothing to be left in gorilla/context. Found %d requests", leaked)
+	}
+}
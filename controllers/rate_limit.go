@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gocraft/web"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+// RateLimit is a middleware that limits the requests of each user, or of each
+// client IP when the user is unknown. Invites, which send e-mails, have a
+// budget of their own.
+func (c *SecureContext) RateLimit(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	c.clientIP, _ = GetClientIP(req.Request)
+	budget := helpers.RateLimitAPI
+	if req.Method == "POST" && req.RoutePath() == "/uaa/invite/users" {
+		budget = helpers.RateLimitInvite
+	}
+	if !c.allowRequest(rw, budget, 1) {
+		return
+	}
+	next(rw, req)
+}
+
+// allowRequest counts the cost of the request, in requests, against the budget
+// and sets the RateLimit headers. If the budget is exhausted, it responds with
+// Too Many Requests and returns false.
+func (c *SecureContext) allowRequest(rw http.ResponseWriter, budget string, cost int) bool {
+	result, limited := c.Settings.AllowRequest(budget, c.userID, c.clientIP, cost)
+	if !limited {
+		return true
+	}
+	reset := strconv.Itoa(int(math.Ceil(result.Reset.Seconds())))
+	rw.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	rw.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	rw.Header().Set("RateLimit-Reset", reset)
+	if result.Allowed {
+		return true
+	}
+	c.logger().Warn("rate limit exceeded", helpers.Fields{"budget": budget, "client_ip": c.clientIP, "retry_after_s": reset})
+	helpers.Metrics.RateLimited.WithLabelValues(budget).Inc()
+	rw.Header().Set("Retry-After", reset)
+	newAPIError(http.StatusTooManyRequests, "too many requests. try again in "+reset+" seconds.").writeTo(rw)
+	return false
+}
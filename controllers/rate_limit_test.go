@@ -0,0 +1,91 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/18F/cg-dashboard/helpers"
+	. "github.com/18F/cg-dashboard/helpers/testhelpers"
+)
+
+func TestRateLimit(t *testing.T) {
+	uaaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer uaaServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.UAAURLEnvVar] = uaaServer.URL
+	envVars[helpers.RateLimitsEnvVar] = "api=2/1m,invite=1/1h"
+	router, _ := CreateRouterWithMockSession(AdminTokenData, envVars)
+
+	for i, expectedCode := range []int{200, 200, 429} {
+		response, request := NewTestRequest("GET", "/uaa/userinfo", nil)
+		request.RemoteAddr = "203.0.113.1:1234"
+		router.ServeHTTP(response, request)
+		if response.Code != expectedCode {
+			t.Errorf("Request %d: expected code %d. Found %d", i, expectedCode, response.Code)
+		}
+		if response.Header().Get("RateLimit-Limit") != "2" || response.Header().Get("RateLimit-Reset") == "" {
+			t.Errorf("Request %d: expected the RateLimit headers. Found %v", i, response.Header())
+		}
+		if expectedCode == 429 {
+			if response.Header().Get("Retry-After") == "" || response.Header().Get("RateLimit-Remaining") != "0" {
+				t.Errorf("Expected when to retry. Found %v", response.Header())
+			}
+			if !strings.Contains(response.Body.String(), "too many requests") {
+				t.Errorf("Expected a rate limit error. Found %s", response.Body.String())
+			}
+		}
+	}
+
+	// Invites have a budget of their own. The first one fails on its invalid
+	// body, but still counts.
+	for i, expectedCode := range []int{400, 429} {
+		response, request := NewTestRequest("POST", "/uaa/invite/users", []byte("{"))
+		request.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(response, request)
+		if response.Code != expectedCode {
+			t.Errorf("Invite %d: expected code %d. Found %d", i, expectedCode, response.Code)
+		}
+	}
+}
+
+func TestRateLimitPrivilegedInvite(t *testing.T) {
+	upstreamRequests := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"privileged","token_type":"bearer","expires_in":3600}`))
+			return
+		}
+		upstreamRequests++
+		w.Write([]byte(`{"resources":[{"id":"user-guid","verified":true}]}`))
+	}))
+	defer testServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.UAAURLEnvVar] = testServer.URL
+	envVars[helpers.APIURLEnvVar] = testServer.URL
+	envVars[helpers.RateLimitsEnvVar] = "privileged=4/1h"
+	router, _ := CreateRouterWithMockSession(AdminTokenData, envVars)
+
+	// Each invite counts its 3 privileged calls, and gives back the 2 it
+	// doesn't make as the user exists. The third one doesn't fit in what is
+	// left and must be stopped before its first call.
+	body := []byte(`{"email":"user@example.com","orgGuid":"7f1bf4ec-6d2b-4c94-9e0c-a2a3b1dfa2f1"}`)
+	for i, expected := range []struct {
+		code     int
+		requests int
+	}{{200, 1}, {200, 2}, {429, 2}} {
+		response, request := NewTestRequest("POST", "/uaa/invite/users", body)
+		request.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(response, request)
+		if response.Code != expected.code {
+			t.Errorf("Invite %d: expected code %d. Found %d: %s", i, expected.code, response.Code, response.Body.String())
+		}
+		if upstreamRequests != expected.requests {
+			t.Errorf("Invite %d: expected %d upstream requests. Found %d", i, expected.requests, upstreamRequests)
+		}
+	}
+}
@@ -1,16 +1,20 @@
 package controllers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/18F/cg-dashboard/helpers"
 	"github.com/18F/cg-dashboard/mailer"
 	"github.com/gocraft/web"
 	"github.com/gorilla/csrf"
+	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 )
 
@@ -19,6 +23,16 @@ type Context struct {
 	Settings  *helpers.Settings
 	templates *helpers.Templates
 	mailer    mailer.Mailer
+	// requestID identifies the request in the logs and upstream.
+	requestID     string
+	requestLogger *helpers.Logger
+	// userID is the ID of the logged in user, once known.
+	userID string
+	// clientIP is the IP address of the client, once known.
+	clientIP string
+	// cspNonce allows the inline scripts of the response under the
+	// Content-Security-Policy.
+	cspNonce string
 }
 
 // StaticMiddleware provides simple caching middleware for static assets.
@@ -37,24 +51,30 @@ func StaticMiddleware(path string) func(web.ResponseWriter, *web.Request, web.Ne
 func (c *Context) Index(w web.ResponseWriter, r *web.Request) {
 	c.templates.GetIndex(w,
 		csrf.Token(r.Request),
+		c.cspNonce,
 		os.Getenv("GA_TRACKING_ID"),
 		os.Getenv("NEW_RELIC_ID"),
 		os.Getenv("NEW_RELIC_BROWSER_LICENSE_KEY"))
 }
 
 type pingData struct {
-	Status             string             `json:"status"`
-	BuildInfo          string             `json:"build-info"`
-	SessionStoreHealth sessionStoreHealth `json:"session-store-health"`
+	Status             string                              `json:"status"`
+	BuildInfo          string                              `json:"build-info"`
+	SessionStoreHealth sessionStoreHealth                  `json:"session-store-health"`
+	Dependencies       map[string]helpers.DependencyHealth `json:"dependencies,omitempty"`
 }
 
 const (
-	pingDataStatusAlive  = "alive"
-	pingDataStatusOutage = "outage"
+	pingDataStatusAlive = "alive"
+	// Some features don't work, such as logs or invites.
+	pingDataStatusDegraded = "degraded"
+	pingDataStatusOutage   = "outage"
+	// The dashboard is shutting down and finishing the requests in flight.
+	pingDataStatusDraining = "draining"
 )
 
 func (p pingData) isSystemHealthy() bool {
-	return p.Status == pingDataStatusAlive
+	return p.Status != pingDataStatusOutage && p.Status != pingDataStatusDraining
 }
 
 // toJSON returns a json representation of the pingData.
@@ -73,100 +93,259 @@ func (p pingData) toJSON() ([]byte, bool) {
 }
 
 type sessionStoreHealth struct {
-	StoreType string `json:"store-type"`
-	StoreUp   bool   `json:"store-up"`
+	StoreType   string `json:"store-type"`
+	StoreUp     bool   `json:"store-up"`
+	StoreMaster string `json:"store-master,omitempty"`
 }
 
 func createPingData(c *Context) pingData {
-	storeUp := c.Settings.SessionBackendHealthCheck()
+	storeUp, storeMaster := c.Settings.SessionBackendHealthCheck()
 	overallStatus := pingDataStatusAlive
 	// if the session storage is out, we have an outage.
 	if !storeUp {
 		overallStatus = pingDataStatusOutage
 	}
+	var dependencies map[string]helpers.DependencyHealth
+	if c.Settings.HealthChecker != nil {
+		dependencies = c.Settings.HealthChecker.Check()
+	}
+	for _, dependency := range dependencies {
+		switch {
+		case dependency.Up:
+		case dependency.Critical:
+			overallStatus = pingDataStatusOutage
+		case overallStatus == pingDataStatusAlive:
+			overallStatus = pingDataStatusDegraded
+		}
+	}
+	if c.Settings.Draining() {
+		overallStatus = pingDataStatusDraining
+	}
 	return pingData{Status: overallStatus,
 		BuildInfo: c.Settings.BuildInfo,
 		SessionStoreHealth: sessionStoreHealth{
-			StoreType: c.Settings.SessionBackend,
-			StoreUp:   storeUp,
+			StoreType:   c.Settings.SessionBackend,
+			StoreUp:     storeUp,
+			StoreMaster: storeMaster,
 		},
+		Dependencies: dependencies,
 	}
 }
 
-// Ping is just a test endpoint to show that indeed the service is alive.
+// Ping tells whether the dashboard is alive, reporting the health of its
+// dependencies. It only fails if the dashboard itself can't answer or is
+// shutting down, as restarting it won't bring its dependencies back.
 func (c *Context) Ping(rw web.ResponseWriter, req *web.Request) {
 	data := createPingData(c)
 	dataJSON, conversionSuccess := data.toJSON()
-	if !data.isSystemHealthy() || !conversionSuccess {
+	if data.Status == pingDataStatusDraining {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	} else if !conversionSuccess {
 		rw.WriteHeader(http.StatusInternalServerError)
+		c.logger().Error("ping failed", helpers.Fields{"ping": string(dataJSON)})
+	}
+	rw.Write(dataJSON)
+}
+
+// Ready tells whether the dashboard can serve users, failing when a critical
+// dependency such as the session store, UAA or the CF API is down. It still
+// succeeds when the dashboard is only degraded.
+func (c *Context) Ready(rw web.ResponseWriter, req *web.Request) {
+	data := createPingData(c)
+	dataJSON, conversionSuccess := data.toJSON()
+	if !data.isSystemHealthy() || !conversionSuccess {
+		rw.WriteHeader(http.StatusServiceUnavailable)
 		// Also, should log out the data in the case of error so we can look at logs
 		// later to see what's wrong.
-		log.Println(string(dataJSON))
+		c.logger().Error("not ready", helpers.Fields{"ping": string(dataJSON)})
 	}
 	rw.Write(dataJSON)
 }
 
+// Metrics exposes the application metrics in the Prometheus exposition format.
+// The metrics token, if set, must be given as a bearer token.
+func (c *Context) Metrics(rw web.ResponseWriter, req *web.Request) {
+	if c.Settings.MetricsToken != "" {
+		expected := "Bearer " + c.Settings.MetricsToken
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte(expected)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			newAPIError(http.StatusUnauthorized, "a valid metrics token is required.").writeTo(rw)
+			return
+		}
+	}
+	c.Settings.MetricsHandler().ServeHTTP(rw, req.Request)
+}
+
 // LoginHandshake is the handler where we authenticate the user and the user authorizes this application access to information.
+// The optional next query parameter is the local path to go to once logged in.
 func (c *Context) LoginHandshake(rw web.ResponseWriter, req *web.Request) {
-	if token := helpers.GetValidToken(req.Request, c.Settings); token != nil {
-		// We should just go to dashboard if the user already has a valid token.
-		dashboardURL := fmt.Sprintf("%s%s", c.Settings.AppURL, "/#/dashboard")
-		http.Redirect(rw, req.Request, dashboardURL, http.StatusFound)
+	returnTo, ok := returnPath(req.URL.Query().Get("next"))
+	if !ok {
+		if next := req.URL.Query().Get("next"); next != "" {
+			c.logger().Warn("ignoring invalid return path", helpers.Fields{"next": next})
+		}
+		returnTo = dashboardPath
+	}
+	if token := helpers.GetValidToken(rw, req.Request, c.Settings); token != nil {
+		// We should just go to where the user wants to be if the user already has a valid token.
+		http.Redirect(rw, req.Request, c.Settings.AppURL+returnTo, http.StatusFound)
 
 	} else {
 		// Redirect to the Cloud Foundry Login place.
-		err := c.redirect(rw, req)
+		err := c.redirect(rw, req, returnTo)
 		if err != nil {
-			fmt.Println("Error on oauth redirect: ", err.Error())
+			c.logger().Error("unable to redirect to login", helpers.Fields{"error": err})
 		}
 	}
 }
 
+// authorizationErrors are the errors UAA can send back instead of a code. Any
+// other value is reported as a server_error.
+// https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+var authorizationErrors = map[string]bool{
+	"invalid_request":           true,
+	"unauthorized_client":       true,
+	"access_denied":             true,
+	"unsupported_response_type": true,
+	"invalid_scope":             true,
+	"server_error":              true,
+	"temporarily_unavailable":   true,
+}
+
 // OAuthCallback is the function that is called when the UAA provider uses the "redirect_uri" field to call back to this backend.
 // This function will extract the code, get the access token and refresh token and save it into 1) the session and redirect to the
-// frontend dashboard.
+// route the user originally asked for, or the frontend dashboard.
+// If anything goes wrong, the user gets an error page offering to log in again.
 func (c *Context) OAuthCallback(rw web.ResponseWriter, req *web.Request) {
-	code := req.URL.Query().Get("code")
-	state := req.URL.Query().Get("state")
-
-	if len(code) < 1 {
-		// TODO: error.
-	}
+	query := req.URL.Query()
+	code := query.Get("code")
+	state := query.Get("state")
 
 	// Ignore error, Get will return a session, existing or new.
 	session, _ := c.Settings.Sessions.Get(req.Request, "session")
 
-	if state == "" || state != session.Values["state"] {
-		rw.WriteHeader(http.StatusUnauthorized)
+	returnTo, ok := returnPath(session.Values["return_to"])
+	if !ok {
+		returnTo = dashboardPath
+	}
+
+	// The callback must answer the login started in this session, whether it
+	// carries a code or an error.
+	verifier, _ := session.Values["code_verifier"].(string)
+	nonce, _ := session.Values["nonce"].(string)
+	if state == "" || state != session.Values["state"] || verifier == "" {
+		c.logger().Warn("login failed: state does not match the session")
+		c.loginError(rw, req, http.StatusUnauthorized, returnTo, helpers.LoginError{
+			Title:   "Login expired",
+			Message: "Your login took too long or was started in another window.",
+			Reason:  "invalid_state",
+		})
+		return
+	}
+
+	// UAA sends the user back with an error instead of a code when it can't
+	// authorize the app, e.g. when the user declined.
+	if uaaError := query.Get("error"); uaaError != "" {
+		c.logger().Warn("login failed: uaa error", helpers.Fields{"uaa_error": uaaError, "uaa_error_description": query.Get("error_description")})
+		if !authorizationErrors[uaaError] {
+			uaaError = "server_error"
+		}
+		if uaaError == "access_denied" {
+			c.loginError(rw, req, http.StatusForbidden, returnTo, helpers.LoginError{
+				Title:   "Login canceled",
+				Message: "The dashboard was not given access to your cloud.gov account.",
+				Reason:  uaaError,
+			})
+			return
+		}
+		c.loginError(rw, req, http.StatusBadGateway, returnTo, helpers.LoginError{
+			Title:   "Login failed",
+			Message: "cloud.gov login could not complete your request.",
+			Reason:  uaaError,
+		})
+		return
+	}
+	if code == "" {
+		c.logger().Warn("login failed: no code in the callback")
+		c.loginError(rw, req, http.StatusBadRequest, returnTo, helpers.LoginError{
+			Title:   "Login failed",
+			Message: "The login response is missing information.",
+			Reason:  "missing_code",
+		})
 		return
 	}
 
 	// Exchange the code for a token.
-	token, err := c.Settings.OAuthConfig.Exchange(c.Settings.CreateContext(), code)
+	token, err := c.Settings.ExchangeCode(req.Context(), code, verifier)
 	if err != nil {
-		fmt.Println("Unable to get access token from code " + code + " error " + err.Error())
+		c.logger().Error("login failed: unable to get access token", helpers.Fields{"error": err})
+		c.loginError(rw, req, http.StatusBadGateway, returnTo, helpers.LoginError{
+			Title:   "Login failed",
+			Message: "The dashboard could not get access to your cloud.gov account.",
+			Reason:  "token_exchange_failed",
+		})
 		return
-		// TODO: Handle. Return 500.
 	}
 
+	// Verify who the user is.
+	rawIDToken, _ := token.Extra("id_token").(string)
+	identity, err := c.Settings.IDTokenVerifier.Verify(req.Context(), rawIDToken, nonce)
+	if err != nil {
+		c.logger().Error("login failed: unable to verify id token", helpers.Fields{"error": err})
+		c.loginError(rw, req, http.StatusUnauthorized, returnTo, helpers.LoginError{
+			Title:   "Login failed",
+			Message: "The dashboard could not verify who you are.",
+			Reason:  "invalid_id_token",
+		})
+		return
+	}
+
+	c.renewSessionID(rw, req.Request, session)
 	session.Values["token"] = *token
+	session.Values["user"] = *identity
 	delete(session.Values, "state")
+	delete(session.Values, "code_verifier")
+	delete(session.Values, "nonce")
+	delete(session.Values, "return_to")
+	helpers.StartSessionLifetime(session, time.Now())
 
 	// Save session.
 	err = session.Save(req.Request, rw)
 	if err != nil {
-		fmt.Println("callback error: " + err.Error())
+		c.logger().Error("login failed: unable to save session", helpers.Fields{"error": err})
+		c.loginError(rw, req, http.StatusInternalServerError, returnTo, helpers.LoginError{
+			Title:   "Login failed",
+			Message: "The dashboard could not save your session.",
+			Reason:  "session_error",
+		})
+		return
 	}
+	c.indexSession(req.Request, session, token)
 
-	// Redirect to the dashboard.
-	dashboardURL := fmt.Sprintf("%s%s", c.Settings.AppURL, "/#/dashboard")
-	http.Redirect(rw, req.Request, dashboardURL, http.StatusFound)
-	// TODO. Redirect to the original route.
+	// Redirect to the original route.
+	http.Redirect(rw, req.Request, c.Settings.AppURL+returnTo, http.StatusFound)
+}
+
+// loginError renders the login error page, with a link to log in again and
+// come back to the route the user originally asked for.
+func (c *Context) loginError(rw web.ResponseWriter, req *web.Request, status int, returnTo string, loginError helpers.LoginError) {
+	loginError.RetryURL = "/handshake"
+	if returnTo != dashboardPath {
+		loginError.RetryURL += "?next=" + url.QueryEscape(returnTo)
+	}
+	// Don't let the browser cache the failure.
+	rw.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, private")
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(status)
+	if err := c.templates.GetLoginError(rw, loginError); err != nil {
+		c.logger().Error("unable to render login error", helpers.Fields{"error": err})
+	}
 }
 
 // Logout is a handler that will attempt to clear the session information for the current user.
 func (c *Context) Logout(rw web.ResponseWriter, req *web.Request) {
 	session, _ := c.Settings.Sessions.Get(req.Request, "session")
+	c.unindexSession(session)
 	// Clear the token
 	session.Values["token"] = nil
 	// Force the session to expire
@@ -176,20 +355,110 @@ func (c *Context) Logout(rw web.ResponseWriter, req *web.Request) {
 	http.Redirect(rw, req.Request, logoutURL, http.StatusFound)
 }
 
-func (c *Context) redirect(rw web.ResponseWriter, req *web.Request) error {
+func (c *Context) redirect(rw web.ResponseWriter, req *web.Request, returnTo string) error {
 	session, _ := c.Settings.Sessions.Get(req.Request, "session")
 	state, err := c.Settings.StateGenerator()
 	if err != nil {
 		return err
 	}
+	verifier, err := helpers.NewPKCEVerifier()
+	if err != nil {
+		return err
+	}
+	nonce, err := helpers.GenerateRandomString(32)
+	if err != nil {
+		return err
+	}
 
 	session.Values["state"] = state
+	session.Values["code_verifier"] = verifier
+	session.Values["nonce"] = nonce
+	session.Values["return_to"] = returnTo
 	err = session.Save(req.Request, rw)
 	if err != nil {
 		return err
 	}
 
-	http.Redirect(rw, req.Request, c.Settings.OAuthConfig.AuthCodeURL(state, oauth2.AccessTypeOnline), http.StatusFound)
+	http.Redirect(rw, req.Request, c.Settings.AuthCodeURL(state, verifier, nonce), http.StatusFound)
 
 	return nil
 }
+
+// dashboardPath is where users go after logging in if they didn't ask for a
+// specific route.
+const dashboardPath = "/#/dashboard"
+
+// returnPath validates a path to go to after logging in. Only paths on this
+// host are allowed, to prevent the login flow from being used as an open
+// redirect.
+func returnPath(value interface{}) (string, bool) {
+	path, ok := value.(string)
+	if !ok || !strings.HasPrefix(path, "/") {
+		return "", false
+	}
+	// Browsers treat "//host" and "/\host" as a different host.
+	if strings.HasPrefix(path, "//") || strings.ContainsAny(path, "\\\r\n\t") {
+		return "", false
+	}
+	u, err := url.Parse(path)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "", false
+	}
+	return path, true
+}
+
+// renewSessionID discards the session saved before logging in, and has the
+// session saved under a new ID, so that a session ID planted in the browser
+// before logging in can't be used, nor indexed, once logged in.
+func (c *Context) renewSessionID(rw http.ResponseWriter, req *http.Request, session *sessions.Session) {
+	if session.ID == "" {
+		// The store keeps no session on the server.
+		return
+	}
+	options := *session.Options
+	discarded := options
+	discarded.MaxAge = -1
+	session.Options = &discarded
+	if err := session.Save(req, rw); err != nil {
+		c.logger().Error("unable to discard the session from before login", helpers.Fields{"error": err})
+	}
+	session.Options = &options
+	session.ID = ""
+	session.IsNew = true
+}
+
+// indexSession records a new session of the user in the session index, if the
+// session backend has one.
+func (c *Context) indexSession(req *http.Request, session *sessions.Session, token *oauth2.Token) {
+	if c.Settings.SessionIndex == nil {
+		return
+	}
+	claims, err := helpers.ParseTokenClaims(token)
+	if err != nil {
+		c.logger().Error("unable to index session", helpers.Fields{"error": err})
+		return
+	}
+	clientIP, _ := GetClientIP(req)
+	if err := c.Settings.SessionIndex.Add(claims.UserID, session.ID, clientIP); err != nil {
+		c.logger().Error("unable to index session", helpers.Fields{"error": err})
+	}
+}
+
+// unindexSession removes the session from the session index, if the session
+// backend has one.
+func (c *Context) unindexSession(session *sessions.Session) {
+	if c.Settings.SessionIndex == nil {
+		return
+	}
+	token, ok := session.Values["token"].(oauth2.Token)
+	if !ok {
+		return
+	}
+	claims, err := helpers.ParseTokenClaims(&token)
+	if err != nil {
+		return
+	}
+	if err := c.Settings.SessionIndex.Remove(claims.UserID, session.ID); err != nil {
+		c.logger().Error("unable to remove session from index", helpers.Fields{"error": err})
+	}
+}
@@ -1,6 +1,15 @@
 package controllers_test
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -13,34 +22,174 @@ import (
 	. "github.com/18F/cg-dashboard/helpers/testhelpers/docker"
 )
 
+// createTestDependencies starts servers standing for the CF API, UAA, login
+// server, loggregator and SMTP relay and points the env vars at them.
+func createTestDependencies(t *testing.T, envVars map[string]string) func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	smtpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := smtpListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	smtpHost, smtpPort, _ := net.SplitHostPort(smtpListener.Addr().String())
+	envVars[helpers.APIURLEnvVar] = server.URL
+	envVars[helpers.UAAURLEnvVar] = server.URL
+	envVars[helpers.LoginURLEnvVar] = server.URL
+	envVars[helpers.LogURLEnvVar] = server.URL
+	envVars[helpers.SMTPHostEnvVar] = smtpHost
+	envVars[helpers.SMTPPortEnvVar] = smtpPort
+	return func() {
+		server.Close()
+		smtpListener.Close()
+	}
+}
+
+type pingResponse struct {
+	Status             string `json:"status"`
+	BuildInfo          string `json:"build-info"`
+	SessionStoreHealth struct {
+		StoreType string `json:"store-type"`
+		StoreUp   bool   `json:"store-up"`
+	} `json:"session-store-health"`
+	Dependencies map[string]struct {
+		Up       bool `json:"up"`
+		Critical bool `json:"critical"`
+	} `json:"dependencies"`
+}
+
+// checkPing requests the health endpoint and checks the status and the
+// session store health it reports.
+func checkPing(t *testing.T, router http.Handler, path string, code int, status, storeType string, storeUp bool) pingResponse {
+	response, request := NewTestRequest("GET", path, nil)
+	router.ServeHTTP(response, request)
+	if response.Code != code {
+		t.Errorf("%s: expected code %d. Found %d", path, code, response.Code)
+	}
+	var data pingResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &data); err != nil {
+		t.Fatalf("%s: expected JSON. Found %s", path, response.Body.String())
+	}
+	if data.Status != status || data.BuildInfo != "developer-build" ||
+		data.SessionStoreHealth.StoreType != storeType || data.SessionStoreHealth.StoreUp != storeUp {
+		t.Errorf("%s: unexpected response %s", path, response.Body.String())
+	}
+	return data
+}
+
 func TestPing(t *testing.T) {
-	response, request := NewTestRequest("GET", "/ping", nil)
+	envVars := GetMockCompleteEnvVars()
+	defer createTestDependencies(t, envVars)()
 	env, _ := cfenv.Current()
-	router, _, err := controllers.InitApp(helpers.NewEnvVarsFromPath(NewEnvLookupFromMap(GetMockCompleteEnvVars())), env)
+	router, _, err := controllers.InitApp(helpers.NewEnvVarsFromPath(NewEnvLookupFromMap(envVars)), env)
 	if err != nil {
 		t.Fatal(err)
 	}
-	router.ServeHTTP(response, request)
-	expectedResponse := `{"status":"alive","build-info":"developer-build","session-store-health":{"store-type":"file","store-up":true}}`
-	if response.Body.String() != expectedResponse {
-		t.Errorf("Expected %s. Found %s\n", expectedResponse, response.Body.String())
+	data := checkPing(t, router, "/ping", 200, "alive", "file", true)
+	for _, name := range []string{"cf-api", "uaa", "login", "loggregator", "smtp"} {
+		if dependency, ok := data.Dependencies[name]; !ok || !dependency.Up {
+			t.Errorf("Expected %s to be up. Found %+v", name, data.Dependencies)
+		}
 	}
-	if response.Code != 200 {
-		t.Errorf("Expected code %d. Found %d", 200, response.Code)
+	checkPing(t, router, "/ready", 200, "alive", "file", true)
+}
+
+func TestPingWithCookieBackend(t *testing.T) {
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.SessionBackendEnvVar] = "cookie"
+	defer createTestDependencies(t, envVars)()
+	env, _ := cfenv.Current()
+	router, _, err := controllers.InitApp(helpers.NewEnvVarsFromPath(NewEnvLookupFromMap(envVars)), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPing(t, router, "/ping", 200, "alive", "cookie", true)
+}
+
+func TestPingWhileDraining(t *testing.T) {
+	envVars := GetMockCompleteEnvVars()
+	defer createTestDependencies(t, envVars)()
+	env, _ := cfenv.Current()
+	router, settings, err := controllers.InitApp(helpers.NewEnvVarsFromPath(NewEnvLookupFromMap(envVars)), env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.StartDraining()
+	checkPing(t, router, "/ping", 503, "draining", "file", true)
+	checkPing(t, router, "/ready", 503, "draining", "file", true)
+}
+
+func TestPingWithDependencyDown(t *testing.T) {
+	tests := []struct {
+		testName string
+		down     string
+		status   string
+		code     int
+	}{
+		{testName: "Loggregator down", down: helpers.LogURLEnvVar, status: "degraded", code: 200},
+		{testName: "UAA down", down: helpers.UAAURLEnvVar, status: "outage", code: 503},
+	}
+	var logs bytes.Buffer
+	helpers.Log.SetOutput(&logs)
+	defer helpers.Log.SetOutput(os.Stdout)
+	for _, test := range tests {
+		logs.Reset()
+		envVars := GetMockCompleteEnvVars()
+		cleanup := createTestDependencies(t, envVars)
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		envVars[test.down] = failing.URL
+		env, _ := cfenv.Current()
+		router, _, err := controllers.InitApp(helpers.NewEnvVarsFromPath(NewEnvLookupFromMap(envVars)), env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Liveness doesn't depend on the dependencies, readiness does.
+		checkPing(t, router, "/ping", 200, test.status, "file", true)
+		data := checkPing(t, router, "/ready", test.code, test.status, "file", true)
+		down := 0
+		for _, dependency := range data.Dependencies {
+			if !dependency.Up {
+				down++
+			}
+		}
+		if down != 1 {
+			t.Errorf("Test %s: expected one dependency down. Found %+v", test.testName, data.Dependencies)
+		}
+		// The errors are logged, not reported.
+		if !strings.Contains(logs.String(), `"error":"unexpected status: 503 Service Unavailable"`) {
+			t.Errorf("Test %s: expected the error to be logged. Found %s", test.testName, logs.String())
+		}
+		response, request := NewTestRequest("GET", "/ping", nil)
+		router.ServeHTTP(response, request)
+		if strings.Contains(response.Body.String(), "Service Unavailable") || strings.Contains(response.Body.String(), `"error"`) {
+			t.Errorf("Test %s: expected no error to be reported. Found %s", test.testName, response.Body.String())
+		}
+		failing.Close()
+		cleanup()
 	}
 }
 
 func TestPingWithRedis(t *testing.T) {
-	// Create a request
-	response, request := NewTestRequest("GET", "/ping", nil)
 	// Start up redis.
 	redisURI, cleanUpRedis, pauseRedis, unapuaseRedis := CreateTestRedis()
-	os.Setenv("REDIS_URI", redisURI)
 	// Remove redis when finished.
 	defer cleanUpRedis()
 	// Override the mock env vars to use redis for session backend.
 	envVars := GetMockCompleteEnvVars()
 	envVars[helpers.SessionBackendEnvVar] = "redis"
+	envVars[helpers.RedisURIEnvVar] = redisURI
+	defer createTestDependencies(t, envVars)()
 	env, _ := cfenv.Current()
 
 	// Setup router.
@@ -50,42 +199,21 @@ func TestPingWithRedis(t *testing.T) {
 	}
 
 	// Submit PING with healthy Redis instance.
-	router.ServeHTTP(response, request)
-	expectedResponse := `{"status":"alive","build-info":"developer-build","session-store-health":{"store-type":"redis","store-up":true}}`
-	if response.Body.String() != expectedResponse {
-		t.Errorf("Expected %s. Found %s\n", expectedResponse, response.Body.String())
-	}
-	if response.Code != 200 {
-		t.Errorf("Expected code %d. Found %d", 200, response.Code)
-	}
+	checkPing(t, router, "/ping", 200, "alive", "redis", true)
 
 	// pause the instance from responding.
 	pauseRedis()
 
-	// Try ping again with unhealthy Redis instance.
-	response, request = NewTestRequest("GET", "/ping", nil)
-	router.ServeHTTP(response, request)
-	expectedResponse = `{"status":"outage","build-info":"developer-build","session-store-health":{"store-type":"redis","store-up":false}}`
-	if response.Body.String() != expectedResponse {
-		t.Errorf("Expected %s. Found %s\n", expectedResponse, response.Body.String())
-	}
-	if response.Code != 500 {
-		t.Errorf("Expected code %d. Found %d", 500, response.Code)
-	}
+	// Try ping again with unhealthy Redis instance. The dashboard is alive
+	// but not ready.
+	checkPing(t, router, "/ping", 200, "outage", "redis", false)
+	checkPing(t, router, "/ready", 503, "outage", "redis", false)
 
 	// we unpause the instance.
 	unapuaseRedis()
 
 	// Retry to ping with a new healthy Redis instance.
-	response, request = NewTestRequest("GET", "/ping", nil)
-	router.ServeHTTP(response, request)
-	expectedResponse = `{"status":"alive","build-info":"developer-build","session-store-health":{"store-type":"redis","store-up":true}}`
-	if response.Body.String() != expectedResponse {
-		t.Errorf("Expected %s. Found %s\n", expectedResponse, response.Body.String())
-	}
-	if response.Code != 200 {
-		t.Errorf("Expected code %d. Found %d", 200, response.Code)
-	}
+	checkPing(t, router, "/ready", 200, "alive", "redis", true)
 }
 
 var loginHandshakeTests = []BasicConsoleUnitTest{
@@ -121,6 +249,288 @@ func TestLoginHandshake(t *testing.T) {
 
 }
 
+var loginReturnPathTests = []struct {
+	testName         string
+	next             string
+	sessionData      map[string]interface{}
+	expectedLocation string
+	expectedReturnTo string
+}{
+	{
+		testName:         "Authenticated user with return path",
+		next:             "/%23/org/org-guid",
+		sessionData:      ValidTokenData,
+		expectedLocation: "https://hostname/#/org/org-guid",
+	},
+	{
+		testName:         "Non authenticated user with return path",
+		next:             "/%23/org/org-guid",
+		expectedLocation: "https://loginurl/oauth/authorize",
+		expectedReturnTo: "/#/org/org-guid",
+	},
+	{
+		testName:         "Non authenticated user with protocol relative return path",
+		next:             "//evil.example.com/",
+		expectedLocation: "https://loginurl/oauth/authorize",
+		expectedReturnTo: "/#/dashboard",
+	},
+	{
+		testName:         "Non authenticated user with backslash return path",
+		next:             "/%5Cevil.example.com/",
+		expectedLocation: "https://loginurl/oauth/authorize",
+		expectedReturnTo: "/#/dashboard",
+	},
+	{
+		testName:         "Authenticated user with absolute return url",
+		next:             "https://evil.example.com/",
+		sessionData:      ValidTokenData,
+		expectedLocation: "https://hostname/#/dashboard",
+	},
+}
+
+func TestLoginReturnPath(t *testing.T) {
+	for _, test := range loginReturnPathTests {
+		response, request := NewTestRequest("GET", "/handshake?next="+test.next, nil)
+		router, store := CreateRouterWithMockSession(test.sessionData, GetMockCompleteEnvVars())
+		router.ServeHTTP(response, request)
+		if !strings.HasPrefix(response.Header().Get("Location"), test.expectedLocation) {
+			t.Errorf("Test %s: expected location %s. Found %s", test.testName, test.expectedLocation, response.Header().Get("Location"))
+		}
+		if test.expectedReturnTo != "" && store.Session.Values["return_to"] != test.expectedReturnTo {
+			t.Errorf("Test %s: expected return path %s. Found %v", test.testName, test.expectedReturnTo, store.Session.Values["return_to"])
+		}
+	}
+}
+
+func TestOAuthCallbackReturnPath(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	uaaServer := CreateTestUAAServer(key, map[string]interface{}{"nonce": "nonce", "user_id": "user-guid"})
+	defer uaaServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.UAAURLEnvVar] = uaaServer.URL
+
+	tests := []struct {
+		returnTo         interface{}
+		expectedLocation string
+	}{
+		{returnTo: "/#/org/org-guid", expectedLocation: "https://hostname/#/org/org-guid"},
+		{returnTo: nil, expectedLocation: "https://hostname/#/dashboard"},
+		{returnTo: "//evil.example.com", expectedLocation: "https://hostname/#/dashboard"},
+	}
+	for _, test := range tests {
+		sessionData := map[string]interface{}{"state": "state", "code_verifier": "verifier", "nonce": "nonce"}
+		if test.returnTo != nil {
+			sessionData["return_to"] = test.returnTo
+		}
+		response, request := NewTestRequest("GET", "/oauth2callback?code=code&state=state", nil)
+		router, store := CreateRouterWithMockSession(sessionData, envVars)
+		router.ServeHTTP(response, request)
+		if location := response.Header().Get("Location"); location != test.expectedLocation {
+			t.Errorf("Expected location %s. Found %s", test.expectedLocation, location)
+		}
+		if _, ok := store.Session.Values["return_to"]; ok {
+			t.Errorf("Expected the return path to be removed from the session")
+		}
+	}
+}
+
+func TestOAuthCallback(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	uaaServer := CreateTestUAAServer(key, map[string]interface{}{
+		"nonce":     "nonce",
+		"user_id":   "user-guid",
+		"user_name": "user",
+		"email":     "user@example.com",
+		"origin":    "uaa",
+	})
+	defer uaaServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.UAAURLEnvVar] = uaaServer.URL
+
+	validSession := map[string]interface{}{"state": "state", "code_verifier": "verifier", "nonce": "nonce"}
+	tests := []struct {
+		testName         string
+		query            string
+		sessionData      map[string]interface{}
+		expectedCode     int
+		expectedResponse string
+	}{
+		{
+			testName:     "Valid login",
+			query:        "code=code&state=state",
+			sessionData:  validSession,
+			expectedCode: http.StatusFound,
+		},
+		{
+			testName:         "Wrong state",
+			query:            "code=code&state=state",
+			sessionData:      map[string]interface{}{"state": "otherstate", "code_verifier": "verifier", "nonce": "nonce"},
+			expectedCode:     http.StatusUnauthorized,
+			expectedResponse: "Login expired",
+		},
+		{
+			testName:         "No code verifier",
+			query:            "code=code&state=state",
+			sessionData:      map[string]interface{}{"state": "state", "nonce": "nonce"},
+			expectedCode:     http.StatusUnauthorized,
+			expectedResponse: "invalid_state",
+		},
+		{
+			testName:         "Wrong nonce",
+			query:            "code=code&state=state",
+			sessionData:      map[string]interface{}{"state": "state", "code_verifier": "verifier", "nonce": "othernonce"},
+			expectedCode:     http.StatusUnauthorized,
+			expectedResponse: "invalid_id_token",
+		},
+		{
+			testName:         "User declined",
+			query:            "error=access_denied&error_description=User+denied+access&state=state",
+			sessionData:      validSession,
+			expectedCode:     http.StatusForbidden,
+			expectedResponse: "Login canceled",
+		},
+		{
+			testName:         "UAA error",
+			query:            "error=invalid_scope&state=state",
+			sessionData:      validSession,
+			expectedCode:     http.StatusBadGateway,
+			expectedResponse: "invalid_scope",
+		},
+		{
+			testName:         "Unknown UAA error",
+			query:            "error=%3Cscript%3Ealert(1)%3C%2Fscript%3E&state=state",
+			sessionData:      validSession,
+			expectedCode:     http.StatusBadGateway,
+			expectedResponse: "server_error",
+		},
+		{
+			testName:         "UAA error without the state",
+			query:            "error=access_denied",
+			sessionData:      validSession,
+			expectedCode:     http.StatusUnauthorized,
+			expectedResponse: "invalid_state",
+		},
+		{
+			testName:         "UAA error with the wrong state",
+			query:            "error=invalid_scope&state=otherstate",
+			sessionData:      validSession,
+			expectedCode:     http.StatusUnauthorized,
+			expectedResponse: "invalid_state",
+		},
+		{
+			testName:         "No code",
+			query:            "state=state",
+			sessionData:      validSession,
+			expectedCode:     http.StatusBadRequest,
+			expectedResponse: "missing_code",
+		},
+		{
+			testName:         "Retry link keeps the return path",
+			query:            "error=access_denied&state=state",
+			sessionData:      map[string]interface{}{"state": "state", "code_verifier": "verifier", "nonce": "nonce", "return_to": "/#/org/org-guid"},
+			expectedCode:     http.StatusForbidden,
+			expectedResponse: `href="/handshake?next=%2F%23%2Forg%2Forg-guid"`,
+		},
+	}
+	for _, test := range tests {
+		response, request := NewTestRequest("GET", "/oauth2callback?"+test.query, nil)
+		router, store := CreateRouterWithMockSession(test.sessionData, envVars)
+		router.ServeHTTP(response, request)
+		if response.Code != test.expectedCode {
+			t.Errorf("Test %s: expected code %d. Found %d", test.testName, test.expectedCode, response.Code)
+		}
+		if !strings.Contains(response.Body.String(), test.expectedResponse) {
+			t.Errorf("Test %s: expected response to contain %s. Found %s", test.testName, test.expectedResponse, response.Body.String())
+		}
+		if strings.Contains(response.Body.String(), "alert(1)") {
+			t.Errorf("Test %s: expected the error from the query to not be rendered", test.testName)
+		}
+		_, hasToken := store.Session.Values["token"]
+		if hasToken != (test.expectedCode == http.StatusFound) {
+			t.Errorf("Test %s: unexpected token in session: %t", test.testName, hasToken)
+		}
+		if test.expectedCode != http.StatusFound {
+			if !strings.Contains(response.Body.String(), `href="/handshake`) {
+				t.Errorf("Test %s: expected a link to log in again. Found %s", test.testName, response.Body.String())
+			}
+			continue
+		}
+		expectedUser := helpers.UserIdentity{UserID: "user-guid", UserName: "user", Email: "user@example.com", Origin: "uaa"}
+		if user := store.Session.Values["user"]; user != expectedUser {
+			t.Errorf("Test %s: expected user %+v in session. Found %+v", test.testName, expectedUser, user)
+		}
+		if _, ok := store.Session.Values["code_verifier"]; ok {
+			t.Errorf("Test %s: expected the code verifier to be removed from the session", test.testName)
+		}
+	}
+}
+
+func TestOAuthCallbackRenewsSessionID(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	uaaServer := CreateTestUAAServer(key, map[string]interface{}{"nonce": "nonce", "user_id": "user-guid"})
+	defer uaaServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.UAAURLEnvVar] = uaaServer.URL
+
+	// A session ID planted in the browser before logging in.
+	router, store := CreateRouterWithMockSession(map[string]interface{}{"state": "state", "code_verifier": "verifier", "nonce": "nonce"}, envVars)
+	store.Session.ID = "planted-session-id"
+	response, request := NewTestRequest("GET", "/oauth2callback?code=code&state=state", nil)
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusFound {
+		t.Fatalf("Expected the login to succeed. Found %d", response.Code)
+	}
+	if store.Session.ID == "planted-session-id" {
+		t.Error("Expected the session to get a new ID at login")
+	}
+}
+
+func TestOAuthCallbackExchangeFailure(t *testing.T) {
+	uaaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Invalid authorization code: secretcode"}`)
+	}))
+	defer uaaServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.UAAURLEnvVar] = uaaServer.URL
+
+	var logs bytes.Buffer
+	helpers.Log.SetOutput(&logs)
+	defer helpers.Log.SetOutput(os.Stdout)
+
+	response, request := NewTestRequest("GET", "/oauth2callback?code=secretcode&state=state", nil)
+	router, _ := CreateRouterWithMockSession(map[string]interface{}{"state": "state", "code_verifier": "verifier", "nonce": "nonce"}, envVars)
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusBadGateway {
+		t.Errorf("Expected code %d. Found %d", http.StatusBadGateway, response.Code)
+	}
+	if strings.Contains(logs.String(), "secretcode") || strings.Contains(response.Body.String(), "secretcode") {
+		t.Errorf("Expected the code not to be leaked. Found log %s", logs.String())
+	}
+}
+
+func TestLoginHandshakePKCE(t *testing.T) {
+	response, request := NewTestRequest("GET", "/handshake", nil)
+	router, store := CreateRouterWithMockSession(nil, GetMockCompleteEnvVars())
+	router.ServeHTTP(response, request)
+	location, err := url.Parse(response.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, _ := store.Session.Values["code_verifier"].(string)
+	if verifier == "" {
+		t.Fatal("Expected a code verifier to be saved in the session")
+	}
+	query := location.Query()
+	if query.Get("code_challenge") != helpers.PKCEChallenge(verifier) || query.Get("code_challenge_method") != "S256" {
+		t.Errorf("Expected the S256 code challenge of the verifier. Found %s", location)
+	}
+	if nonce := store.Session.Values["nonce"]; nonce == nil || query.Get("nonce") != nonce {
+		t.Errorf("Expected the nonce of the session. Found %s", location)
+	}
+}
+
 var logoutTests = []BasicSecureTest{
 	{
 		BasicConsoleUnitTest: BasicConsoleUnitTest{
@@ -158,3 +568,43 @@ func TestLogout(t *testing.T) {
 		}
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	router, _ := CreateRouterWithMockSession(nil, GetMockCompleteEnvVars())
+
+	response, request := NewTestRequest("GET", "/ping", nil)
+	router.ServeHTTP(response, request)
+
+	response, request = NewTestRequest("GET", "/metrics", nil)
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("Expected metrics to require the token. Found code %d", response.Code)
+	}
+
+	response, request = NewTestRequest("GET", "/metrics", nil)
+	request.Header.Set("Authorization", "Bearer metricstoken")
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Errorf("Expected code %d. Found %d", http.StatusOK, response.Code)
+	}
+	for _, expected := range []string{
+		`dashboard_http_requests_total{method="GET",route="/ping",status="200"} `,
+		`dashboard_http_request_duration_seconds_bucket{method="GET",route="/ping",le="+Inf"} `,
+		`dashboard_session_store_up{store_type="file"} 1`,
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(response.Body.String(), expected) {
+			t.Errorf("Expected metrics to contain %s. Found %s", expected, response.Body.String())
+		}
+	}
+
+	// Without a token, the metrics are open.
+	envVars := GetMockCompleteEnvVars()
+	delete(envVars, helpers.MetricsTokenEnvVar)
+	router, _ = CreateRouterWithMockSession(nil, envVars)
+	response, request = NewTestRequest("GET", "/metrics", nil)
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Errorf("Expected the metrics to be open without a token. Found code %d", response.Code)
+	}
+}
@@ -23,15 +23,23 @@ func InitRouter(settings *helpers.Settings, templates *helpers.Templates, mailer
 		c.mailer = mailer
 		next(resp, req)
 	})
+	router.Middleware((*Context).RequestLogging)
+	router.Middleware((*Context).RequestTracing)
+	router.Middleware((*Context).SecurityHeaders)
+	router.Middleware((*Context).RequestTimeout)
+	router.Middleware((*Context).LimitRequestBody)
 
 	router.Get("/", (*Context).Index)
 
 	// Backend Route Initialization
 	// Initialize the Gocraft Router with the basic context and routes
 	router.Get("/ping", (*Context).Ping)
+	router.Get("/ready", (*Context).Ready)
+	router.Get("/metrics", (*Context).Metrics)
 	router.Get("/handshake", (*Context).LoginHandshake)
 	router.Get("/oauth2callback", (*Context).OAuthCallback)
 	router.Get("/logout", (*Context).Logout)
+	router.Post(helpers.CSPReportPath, (*Context).CSPReport)
 
 	// Secure all the other routes
 	secureRouter := router.Subrouter(SecureContext{}, "/")
@@ -39,6 +47,7 @@ func InitRouter(settings *helpers.Settings, templates *helpers.Templates, mailer
 	// Setup the /api subrouter.
 	apiRouter := secureRouter.Subrouter(APIContext{}, "/v2")
 	apiRouter.Middleware((*APIContext).OAuth)
+	apiRouter.Middleware((*APIContext).RateLimit)
 	// All routes accepted
 	apiRouter.Get("/authstatus", (*APIContext).AuthStatus)
 	apiRouter.Get("/profile", (*APIContext).UserProfile)
@@ -50,15 +59,29 @@ func InitRouter(settings *helpers.Settings, templates *helpers.Templates, mailer
 	// Setup the /uaa subrouter.
 	uaaRouter := secureRouter.Subrouter(UAAContext{}, "/uaa")
 	uaaRouter.Middleware((*UAAContext).OAuth)
+	uaaRouter.Middleware((*UAAContext).RateLimit)
 	uaaRouter.Get("/userinfo", (*UAAContext).UserInfo)
+	uaaRouter.Get("/me", (*UAAContext).Me)
 	uaaRouter.Get("/uaainfo", (*UAAContext).UaaInfo)
 	uaaRouter.Post("/invite/users", (*UAAContext).InviteUserToOrg)
 
 	// Setup the /log subrouter.
 	logRouter := secureRouter.Subrouter(LogContext{}, "/log")
 	logRouter.Middleware((*LogContext).OAuth)
+	logRouter.Middleware((*LogContext).RateLimit)
 	logRouter.Get("/recent", (*LogContext).RecentLogs)
 
+	// Setup the /admin subrouter.
+	adminRouter := secureRouter.Subrouter(AdminContext{}, "/admin")
+	adminRouter.Middleware((*AdminContext).OAuth)
+	adminRouter.Middleware((*AdminContext).AdminRequired)
+	adminRouter.Get("/mail", (*AdminContext).MailTemplates)
+	adminRouter.Get("/mail/:template", (*AdminContext).PreviewMailTemplate)
+	adminRouter.Post("/mail/:template/send", (*AdminContext).SendMailPreview)
+	adminRouter.Get("/users/:user_id/sessions", (*AdminContext).ListUserSessions)
+	adminRouter.Delete("/users/:user_id/sessions", (*AdminContext).RevokeUserSessions)
+	adminRouter.Delete("/users/:user_id/sessions/:session_id", (*AdminContext).RevokeUserSession)
+
 	// Add auth middleware
 	secureRouter.Middleware((*SecureContext).LoginRequired)
 
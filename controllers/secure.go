@@ -1,15 +1,17 @@
 package controllers
 
 import (
+	"context"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/18F/cg-dashboard/helpers"
 	"github.com/gocraft/web"
+	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 )
 
@@ -17,6 +19,12 @@ import (
 type SecureContext struct {
 	*Context // Required.
 	Token    oauth2.Token
+	// targetGUID is the org or space the privileged calls of the request act
+	// on, once authorized, for the audit records.
+	targetGUID string
+	// privilegedReserved is the number of privileged calls of the request
+	// already counted against the privileged budget.
+	privilegedReserved int
 }
 
 // ResponseHandler is a type declaration for the function that will handle the response for the given request.
@@ -26,12 +34,16 @@ type ResponseHandler func(http.ResponseWriter, *http.Response)
 // If the token is present and still valid, it just passes it on.
 // If the token is 1) present and expired or 2) not present, it will return unauthorized.
 func (c *SecureContext) OAuth(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if c.sessionExpired(rw, req.Request) {
+		return
+	}
 	// Get valid token if it exists from session store.
-	if token := helpers.GetValidToken(req.Request, c.Settings); token != nil {
+	if token := helpers.GetValidToken(rw, req.Request, c.Settings); token != nil {
 		c.Token = *token
+		c.identifyUser(token)
 	} else {
 		// If no token, return unauthorized.
-		http.Error(rw, "{\"status\": \"unauthorized\"}", http.StatusUnauthorized)
+		newAPIError(http.StatusUnauthorized, "you must log in.").writeTo(rw)
 		return
 	}
 	// Proceed to the next middleware or to the handler if last middleware.
@@ -53,48 +65,151 @@ func (c *SecureContext) LoginRequired(rw web.ResponseWriter, r *web.Request, nex
 	rw.Header().Set("pragma", "no-cache")
 	rw.Header().Set("expires", "-1")
 
-	token := helpers.GetValidToken(r.Request, c.Settings)
+	if c.sessionExpired(rw, r.Request) {
+		return
+	}
+
+	token := helpers.GetValidToken(rw, r.Request, c.Settings)
 	if token != nil {
+		c.identifyUser(token)
+		c.touchSession(rw, r.Request, token)
 		next(rw, r)
 	} else {
 		// Respond with Unauthorized, the client should detect this,
 		// show appropriate messaging or redirect to login
-		rw.WriteHeader(http.StatusUnauthorized)
+		newAPIError(http.StatusUnauthorized, "you must log in.").writeTo(rw)
+	}
+}
+
+// sessionExpired enforces the session idle timeout and maximum lifetime, and
+// the revocation of sessions. If the session has expired, it is cleared and an
+// unauthorized response giving the reason is sent back, so that the frontend
+// can tell the user.
+func (c *SecureContext) sessionExpired(rw http.ResponseWriter, req *http.Request) bool {
+	session, _ := c.Settings.Sessions.Get(req, "session")
+	if session == nil {
+		return false
+	}
+	err := c.Settings.CheckSessionLifetime(session, time.Now())
+	if err == nil && c.sessionRevoked(session) {
+		err = helpers.ErrSessionRevoked
+	}
+	if err == nil {
+		return false
+	}
+	c.unindexSession(session)
+	helpers.EndSession(session)
+	if saveErr := session.Save(req, rw); saveErr != nil {
+		c.logger().Error("unable to save expired session", helpers.Fields{"error": saveErr})
+	}
+	newAPIError(http.StatusUnauthorized, "your session has expired. log in again.").
+		withCode("session_" + err.Error()).writeTo(rw)
+	return true
+}
+
+// sessionRevoked returns whether the logged in session was revoked by an
+// administrator. The revocations are kept with the sessions, so a session that
+// could just be loaded is not ended because they can't be checked.
+func (c *SecureContext) sessionRevoked(session *sessions.Session) bool {
+	if c.Settings.SessionIndex == nil || session.ID == "" || session.Values["token"] == nil {
+		return false
+	}
+	revoked, err := c.Settings.SessionIndex.Revoked(session.ID)
+	if err != nil {
+		c.logger().Error("unable to check session revocation", helpers.Fields{"error": err})
+	}
+	return revoked
+}
+
+// touchSession records the activity of the session, for the idle timeout and
+// in the session index if the session backend has one. Sessions created
+// before the index existed are added to it. Nothing is written until the
+// resolution of the last activity has passed.
+func (c *SecureContext) touchSession(rw http.ResponseWriter, req *http.Request, token *oauth2.Token) {
+	session, _ := c.Settings.Sessions.Get(req, "session")
+	if session == nil {
+		return
+	}
+	if !helpers.TouchSessionLifetime(session, time.Now()) {
+		return
+	}
+	if err := session.Save(req, rw); err != nil {
+		c.logger().Error("unable to save session activity", helpers.Fields{"error": err})
+	}
+	if c.Settings.SessionIndex == nil {
+		return
+	}
+	claims, err := helpers.ParseTokenClaims(token)
+	if err != nil {
+		return
+	}
+	clientIP, _ := GetClientIP(req)
+	err = c.Settings.SessionIndex.Touch(claims.UserID, session.ID, clientIP)
+	if err == helpers.ErrSessionNotFound {
+		err = c.Settings.SessionIndex.Add(claims.UserID, session.ID, clientIP)
+	}
+	if err != nil {
+		c.logger().Error("unable to update session index", helpers.Fields{"error": err})
 	}
 }
 
 // PrivilegedProxy is an internal function that will construct the client using
 // the credentials of the web app itself (not of the user) with the token in the headers and
-// then sends a request.
+// then sends a request. These calls are rate limited per user, and all
+// audited.
 func (c *SecureContext) PrivilegedProxy(rw http.ResponseWriter, req *http.Request, url string, responseHandler ResponseHandler) {
+	if c.privilegedReserved > 0 {
+		// Already counted with the others of the same operation.
+		c.privilegedReserved--
+	} else if !c.allowRequest(rw, helpers.RateLimitPrivileged, 1) {
+		c.auditDenied(req.Method, url)
+		return
+	}
 	// Acquire the http client and the refresh token if needed
 	// https://godoc.org/golang.org/x/oauth2#Config.Client
-	client := c.Settings.HighPrivilegedOauthConfig.Client(c.Settings.CreateContext())
-	c.submitRequest(rw, req, url, client, responseHandler)
+	client := c.Settings.HighPrivilegedOauthConfig.Client(c.Settings.CreateContext(req.Context()))
+	c.submitRequest(rw, req, url, client, helpers.AuditPrivilegedRequest, responseHandler)
+}
+
+// refundPrivileged gives back the privileged calls reserved by the request
+// that it didn't make.
+func (c *SecureContext) refundPrivileged() {
+	c.Settings.RefundRequest(helpers.RateLimitPrivileged, c.userID, c.clientIP, c.privilegedReserved)
+	c.privilegedReserved = 0
 }
 
 // Proxy is an internal function that will construct the client with the token in the headers and
-// then send a request.
+// then send a request. The requests which may change something are audited.
 func (c *SecureContext) Proxy(rw http.ResponseWriter, req *http.Request, url string, responseHandler ResponseHandler) {
 	// Acquire the http client and the refresh token if needed
 	// https://godoc.org/golang.org/x/oauth2#Config.Client
-	client := c.Settings.OAuthConfig.Client(c.Settings.CreateContext(), &c.Token)
-	c.submitRequest(rw, req, url, client, responseHandler)
+	client := c.Settings.OAuthConfig.Client(c.Settings.CreateContext(req.Context()), &c.Token)
+	c.submitRequest(rw, req, url, client, auditEvent(req.Method), responseHandler)
 }
 
 // submitRequest uses a given client and submits the specified request and
-// closes the request and response bodies.
-func (c *SecureContext) submitRequest(rw http.ResponseWriter, req *http.Request, url string, client *http.Client, responseHandler ResponseHandler) {
-	// Prevents lingering goroutines from living forever.
-	// http://stackoverflow.com/questions/16895294/how-to-set-timeout-for-http-get-requests-in-golang/25344458#25344458
-	client.Timeout = 20 * time.Second
+// closes the request and response bodies. The upstream request is cancelled
+// with the incoming request, when it times out or the client goes away. It is
+// audited as the event, unless empty.
+func (c *SecureContext) submitRequest(rw http.ResponseWriter, req *http.Request, url string, client *http.Client, auditedAs string, responseHandler ResponseHandler) {
 	// In case the body is not of io.Closer.
 	if req.Body != nil {
 		defer req.Body.Close()
 	}
 	req.Close = true
+	var body io.Reader = req.Body
+	var status int
+	var upstreamErr error
+	if auditedAs != "" {
+		copied := &auditBody{}
+		if req.Body != nil {
+			body = io.TeeReader(req.Body, copied)
+		}
+		defer func() { c.audit(auditedAs, req.Method, url, copied, status, upstreamErr) }()
+	}
 	// Make a new request.
-	request, _ := http.NewRequest(req.Method, url, req.Body)
+	request, _ := http.NewRequest(req.Method, url, body)
+	request = request.WithContext(req.Context())
 	// In case the body is not of io.Closer.
 	if request.Body != nil {
 		defer request.Body.Close()
@@ -110,9 +225,9 @@ func (c *SecureContext) submitRequest(rw http.ResponseWriter, req *http.Request,
 	if c.Settings.TICSecret != "" {
 		clientIP, err := GetClientIP(req)
 		if err != nil {
-			log.Println(err)
-			rw.WriteHeader(http.StatusInternalServerError)
-			rw.Write([]byte("error parsing client ip"))
+			c.logger().Error("unable to parse client ip", helpers.Fields{"error": err})
+			newAPIError(http.StatusInternalServerError, "unable to parse the client ip.").writeTo(rw)
+			return
 		}
 		if clientIP != "" {
 			// Set headers for requests to CF API proxy
@@ -121,18 +236,58 @@ func (c *SecureContext) submitRequest(rw http.ResponseWriter, req *http.Request,
 		}
 	}
 
+	// Let CF and UAA tie their logs to ours.
+	if c.requestID != "" {
+		request.Header.Set(helpers.RequestIDHeader, c.requestID)
+	}
+
+	upstream := c.Settings.Upstream(url)
+	span := c.Settings.Tracer.StartChildSpan(req, request.Method+" "+upstream, helpers.SpanKindClient)
+	span.SetAttribute("http.method", request.Method)
+	span.SetAttribute("http.url", upstreamURL(url))
+	span.SetAttribute("upstream", upstream)
+	span.Inject(request.Header)
+	defer span.Finish()
+
 	request.Close = true
 	// Send the request.
+	start := time.Now()
 	res, err := client.Do(request)
 	if res != nil {
 		defer res.Body.Close()
 	}
+	latency := time.Since(start)
+	helpers.Metrics.UpstreamRequestDuration.WithLabelValues(upstream).Observe(latency.Seconds())
+	fields := helpers.Fields{
+		"upstream_method": request.Method,
+		"upstream_url":    upstreamURL(url),
+		"latency_ms":      latency.Seconds() * 1000,
+	}
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("unknown error. try again"))
+		upstreamErr = err
+		span.SetError(err.Error())
+		helpers.Metrics.ProxyErrors.WithLabelValues(upstream).Inc()
+		fields["error"] = err
+		c.logger().Error("upstream request failed", fields)
+		if req.Context().Err() == context.DeadlineExceeded {
+			writeTimeoutError(rw)
+			return
+		}
+		if bodyTooLarge(req) {
+			writeBodyTooLarge(rw)
+			return
+		}
+		newAPIError(http.StatusInternalServerError, "unknown error. try again.").writeTo(rw)
 		return
 	}
+	status = res.StatusCode
+	helpers.Metrics.UpstreamRequests.WithLabelValues(upstream, request.Method, strconv.Itoa(res.StatusCode)).Inc()
+	fields["upstream_status"] = res.StatusCode
+	span.SetAttribute("http.status_code", res.StatusCode)
+	if res.StatusCode >= 500 {
+		span.SetError(res.Status)
+	}
+	c.logger().Info("upstream request", fields)
 	// Should return the same status.
 	rw.WriteHeader(res.StatusCode)
 	responseHandler(rw, res)
@@ -143,10 +298,8 @@ func (c *SecureContext) GenericResponseHandler(rw http.ResponseWriter, response
 	// Write the body into response that is going back to the frontend.
 	_, err := io.Copy(rw, response.Body)
 	if err != nil {
-		log.Println(err)
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("unknown error. try again"))
-		return
+		// The status is already sent, the client gets a truncated body.
+		c.logger().Error("unable to copy upstream response", helpers.Fields{"error": err})
 	}
 }
 
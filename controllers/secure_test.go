@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/18F/cg-dashboard/controllers"
 	"github.com/18F/cg-dashboard/helpers"
 	. "github.com/18F/cg-dashboard/helpers/testhelpers"
 	"github.com/18F/cg-dashboard/helpers/testhelpers/mocks"
+	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/gocraft/web"
 	"golang.org/x/oauth2"
 )
@@ -29,7 +32,7 @@ var oauthTests = []BasicSecureTest{
 			TestName:    "Basic Invalid OAuth Session",
 			SessionData: InvalidTokenData,
 		},
-		ExpectedResponse: NewJSONResponseContentTester(`{"status": "unauthorized"}`),
+		ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "unauthorized", "message": "you must log in."}`),
 		ExpectedCode:     401,
 	},
 }
@@ -77,6 +80,150 @@ func TestOAuth(t *testing.T) {
 	}
 }
 
+func TestSessionLifetime(t *testing.T) {
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.SessionIdleTimeoutEnvVar] = "15m"
+	envVars[helpers.SessionMaxLifetimeEnvVar] = "12h"
+	tests := []struct {
+		testName         string
+		issuedAt         time.Time
+		lastActivity     time.Time
+		expectedCode     int
+		expectedResponse ResponseContentTester
+	}{
+		{
+			testName:         "Active session",
+			issuedAt:         time.Now().Add(-time.Hour),
+			lastActivity:     time.Now().Add(-time.Minute),
+			expectedCode:     http.StatusOK,
+			expectedResponse: NewJSONResponseContentTester(`{"status": "authorized"}`),
+		},
+		{
+			testName:         "Idle session",
+			issuedAt:         time.Now().Add(-time.Hour),
+			lastActivity:     time.Now().Add(-20 * time.Minute),
+			expectedCode:     http.StatusUnauthorized,
+			expectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "session_idle_timeout", "message": "your session has expired. log in again."}`),
+		},
+		{
+			testName:         "Session past its lifetime",
+			issuedAt:         time.Now().Add(-13 * time.Hour),
+			lastActivity:     time.Now().Add(-time.Minute),
+			expectedCode:     http.StatusUnauthorized,
+			expectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "session_max_lifetime", "message": "your session has expired. log in again."}`),
+		},
+	}
+	for _, test := range tests {
+		sessionData := map[string]interface{}{
+			"token":         ValidTokenData["token"],
+			"issued_at":     test.issuedAt.Unix(),
+			"last_activity": test.lastActivity.Unix(),
+		}
+		response, request := NewTestRequest("GET", "/v2/authstatus", nil)
+		router, store := CreateRouterWithMockSession(sessionData, envVars)
+		router.ServeHTTP(response, request)
+		if !test.expectedResponse.Check(t, response.Body.String()) {
+			t.Errorf("Test %s did not meet expected value. Expected %s. Found %s.\n", test.testName, test.expectedResponse.Display(), response.Body.String())
+		}
+		if response.Code != test.expectedCode {
+			t.Errorf("Test %s did not meet expected code. Expected %d. Found %d.\n", test.testName, test.expectedCode, response.Code)
+		}
+		if test.expectedCode == http.StatusUnauthorized && store.Session.Values["token"] != nil {
+			t.Errorf("Test %s expected the token to be cleared from the session", test.testName)
+		}
+	}
+}
+
+// countingSessionIndex is a SessionIndex counting the writes to the index.
+type countingSessionIndex struct {
+	helpers.SessionIndex
+	writes int
+	// revoked are the revoked session IDs.
+	revoked map[string]bool
+}
+
+func (i *countingSessionIndex) Add(userID, sessionID, clientIP string) error {
+	i.writes++
+	return nil
+}
+
+func (i *countingSessionIndex) Touch(userID, sessionID, clientIP string) error {
+	i.writes++
+	return nil
+}
+
+func (i *countingSessionIndex) Revoked(sessionID string) (bool, error) {
+	return i.revoked[sessionID], nil
+}
+
+func TestTouchSession(t *testing.T) {
+	settings := helpers.Settings{}
+	env, _ := cfenv.Current()
+	if err := settings.InitSettings(helpers.NewEnvVarsFromPath(NewEnvLookupFromMap(GetMockCompleteEnvVars())), env); err != nil {
+		t.Fatal(err)
+	}
+	store := MockSessionStore{}
+	store.ResetSessionData(map[string]interface{}{
+		"token":         AdminTokenData["token"],
+		"issued_at":     time.Now().Add(-time.Hour).Unix(),
+		"last_activity": time.Now().Add(-time.Minute).Unix(),
+	}, "")
+	settings.Sessions = store
+	index := &countingSessionIndex{}
+	settings.SessionIndex = index
+	templates, _ := helpers.InitTemplates(settings.BasePath)
+	router := controllers.InitRouter(&settings, templates, new(mocks.Mailer))
+
+	// Only the first request is long enough after the last activity to be
+	// recorded.
+	for i := 0; i < 3; i++ {
+		response, request := NewTestRequest("GET", "/v2/authstatus", nil)
+		router.ServeHTTP(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf("Expected the request to be authorized. Found %d", response.Code)
+		}
+	}
+	if index.writes != 1 {
+		t.Errorf("Expected the session index to be written once. Found %d writes", index.writes)
+	}
+	lastActivity, _ := store.Session.Values["last_activity"].(int64)
+	if time.Since(time.Unix(lastActivity, 0)) > 30*time.Second {
+		t.Error("Expected the last activity of the session to be updated")
+	}
+}
+
+func TestRevokedSession(t *testing.T) {
+	settings := helpers.Settings{}
+	env, _ := cfenv.Current()
+	if err := settings.InitSettings(helpers.NewEnvVarsFromPath(NewEnvLookupFromMap(GetMockCompleteEnvVars())), env); err != nil {
+		t.Fatal(err)
+	}
+	store := MockSessionStore{}
+	store.ResetSessionData(map[string]interface{}{
+		"token":         AdminTokenData["token"],
+		"issued_at":     time.Now().Add(-time.Hour).Unix(),
+		"last_activity": time.Now().Unix(),
+	}, "")
+	// The session was saved back by a request in flight when it was revoked.
+	store.Session.ID = "revoked-session-id"
+	settings.Sessions = store
+	settings.SessionIndex = &countingSessionIndex{revoked: map[string]bool{"revoked-session-id": true}}
+	templates, _ := helpers.InitTemplates(settings.BasePath)
+	router := controllers.InitRouter(&settings, templates, new(mocks.Mailer))
+
+	response, request := NewTestRequest("GET", "/v2/authstatus", nil)
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked session to be unauthorized. Found %d", response.Code)
+	}
+	if !strings.Contains(response.Body.String(), `"session_revoked"`) {
+		t.Errorf("Expected the session to be reported as revoked. Found %s", response.Body.String())
+	}
+	if store.Session.Values["token"] != nil {
+		t.Error("Expected the token to be cleared from the revoked session")
+	}
+}
+
 func TestPrivilegedProxy(t *testing.T) {
 	for _, test := range proxyTests {
 		// We can only get this after the server has started.
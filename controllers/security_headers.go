@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gocraft/web"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+// SecurityHeaders is a middleware that sets the security headers of every
+// response, with a new nonce for the inline scripts of the index page.
+func (c *Context) SecurityHeaders(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	if c.Settings.SecurityHeaders == nil {
+		next(rw, req)
+		return
+	}
+	nonce, err := helpers.NewCSPNonce()
+	if err != nil {
+		c.logger().Error("unable to generate the CSP nonce", helpers.Fields{"error": err})
+		newAPIError(http.StatusInternalServerError, "unknown error. try again.").writeTo(rw)
+		return
+	}
+	c.cspNonce = nonce
+	c.Settings.SecurityHeaders.Write(rw.Header(), nonce)
+	next(rw, req)
+}
+
+// CSPReport collects the violations of the Content-Security-Policy reported
+// by browsers, to the logs and the metrics. Reports are rate limited per
+// client IP, as anyone can send them, with a budget of their own so that they
+// don't use up that of the API.
+func (c *Context) CSPReport(rw web.ResponseWriter, req *web.Request) {
+	clientIP, _ := GetClientIP(req.Request)
+	if result, limited := c.Settings.AllowRequest(helpers.RateLimitCSPReport, "", clientIP, 1); limited && !result.Allowed {
+		helpers.Metrics.RateLimited.WithLabelValues(helpers.RateLimitCSPReport).Inc()
+		newAPIError(http.StatusTooManyRequests, "too many requests.").writeTo(rw)
+		return
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err == errBodyTooLarge {
+		writeBodyTooLarge(rw)
+		return
+	}
+	violations, parseErr := helpers.ParseCSPReports(req.Header.Get("Content-Type"), body)
+	if err != nil || parseErr != nil {
+		newAPIError(http.StatusBadRequest, "invalid CSP report.").writeTo(rw)
+		return
+	}
+	for _, v := range violations {
+		helpers.Metrics.CSPViolations.WithLabelValues(helpers.CSPDirectiveLabel(v.Directive)).Inc()
+		c.logger().Warn("csp violation", helpers.Fields{
+			"document_uri": v.DocumentURI,
+			"directive":    v.Directive,
+			"blocked_uri":  v.BlockedURI,
+			"source_file":  v.SourceFile,
+			"line_number":  v.LineNumber,
+		})
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,143 @@
+package controllers_test
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/18F/cg-dashboard/helpers"
+	. "github.com/18F/cg-dashboard/helpers/testhelpers"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	router, _ := CreateRouterWithMockSession(nil, GetMockCompleteEnvVars())
+
+	nonces := map[string]bool{}
+	noncePattern := regexp.MustCompile(`'nonce-([^']+)'`)
+	for i := 0; i < 2; i++ {
+		response, request := NewTestRequest("GET", "/", nil)
+		router.ServeHTTP(response, request)
+		policy := response.Header().Get("Content-Security-Policy")
+		match := noncePattern.FindStringSubmatch(policy)
+		if match == nil {
+			t.Fatalf("Expected a nonce in the policy. Found %q", policy)
+		}
+		nonces[match[1]] = true
+		if !strings.Contains(response.Body.String(), `nonce="`+match[1]+`"`) {
+			t.Errorf("Expected the inline scripts to carry the nonce %s", match[1])
+		}
+		if response.Header().Get("X-Frame-Options") != "DENY" || response.Header().Get("Referrer-Policy") == "" ||
+			response.Header().Get("Permissions-Policy") == "" || response.Header().Get("Strict-Transport-Security") == "" {
+			t.Errorf("Expected the security headers. Found %v", response.Header())
+		}
+	}
+	if len(nonces) != 2 {
+		t.Error("Expected a new nonce for each request")
+	}
+
+	// API responses are protected too.
+	response, request := NewTestRequest("GET", "/v2/authstatus", nil)
+	router.ServeHTTP(response, request)
+	if response.Header().Get("Content-Security-Policy") == "" || response.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected the security headers. Found %v", response.Header())
+	}
+
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.CSPModeEnvVar] = helpers.CSPModeReportOnly
+	router, _ = CreateRouterWithMockSession(nil, envVars)
+	response, request = NewTestRequest("GET", "/ping", nil)
+	router.ServeHTTP(response, request)
+	if response.Header().Get("Content-Security-Policy") != "" || response.Header().Get("Content-Security-Policy-Report-Only") == "" {
+		t.Errorf("Expected a report only policy. Found %v", response.Header())
+	}
+}
+
+func TestCSPReport(t *testing.T) {
+	router, _ := CreateRouterWithMockSession(nil, GetMockCompleteEnvVars())
+	var logs bytes.Buffer
+	helpers.Log.SetOutput(&logs)
+	defer helpers.Log.SetOutput(os.Stdout)
+
+	tests := []struct {
+		testName     string
+		contentType  string
+		body         string
+		expectedCode int
+	}{
+		{
+			testName:     "Report",
+			contentType:  "application/csp-report",
+			body:         `{"csp-report": {"document-uri": "https://dashboard/", "violated-directive": "script-src-elem", "blocked-uri": "inline"}}`,
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			testName:     "Reporting API report",
+			contentType:  "application/reports+json",
+			body:         `[{"type": "csp-violation", "body": {"effectiveDirective": "img-src", "blockedURL": "https://example.com/a.png"}}]`,
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			testName:     "Report of an unknown directive",
+			contentType:  "application/csp-report",
+			body:         `{"csp-report": {"violated-directive": "made-up-src-1234"}}`,
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			testName:     "Invalid report",
+			contentType:  "application/csp-report",
+			body:         `{`,
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			testName:     "Not a report",
+			contentType:  "application/json",
+			body:         `{}`,
+			expectedCode: http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, test := range tests {
+		response, request := NewTestRequest("POST", "/csp-report", []byte(test.body))
+		request.Header.Set("Content-Type", test.contentType)
+		router.ServeHTTP(response, request)
+		if response.Code != test.expectedCode {
+			t.Errorf("Test %s: expected code %d. Found %d", test.testName, test.expectedCode, response.Code)
+		}
+	}
+	if !strings.Contains(logs.String(), `"blocked_uri":"inline"`) || !strings.Contains(logs.String(), `"directive":"img-src"`) {
+		t.Errorf("Expected the violations to be logged. Found %s", logs.String())
+	}
+
+	response, request := NewTestRequest("GET", "/metrics", nil)
+	request.Header.Set("Authorization", "Bearer metricstoken")
+	router.ServeHTTP(response, request)
+	if !strings.Contains(response.Body.String(), `dashboard_csp_violations_total{directive="script-src-elem"}`) ||
+		!strings.Contains(response.Body.String(), `dashboard_csp_violations_total{directive="other"}`) {
+		t.Error("Expected the violations to be counted by directive")
+	}
+}
+
+func TestCSPReportRateLimit(t *testing.T) {
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.RateLimitsEnvVar] = "api=1/1m,csp_report=1/1m"
+	router, _ := CreateRouterWithMockSession(AdminTokenData, envVars)
+
+	// Reports have a budget of their own, and don't use up that of the API.
+	for i, expectedCode := range []int{http.StatusNoContent, http.StatusTooManyRequests} {
+		response, request := NewTestRequest("POST", "/csp-report", []byte(`{"csp-report": {"violated-directive": "img-src"}}`))
+		request.Header.Set("Content-Type", "application/csp-report")
+		request.RemoteAddr = "203.0.113.1:1234"
+		router.ServeHTTP(response, request)
+		if response.Code != expectedCode {
+			t.Errorf("Report %d: expected code %d. Found %d", i, expectedCode, response.Code)
+		}
+	}
+	response, request := NewTestRequest("GET", "/uaa/userinfo", nil)
+	request.RemoteAddr = "203.0.113.1:1234"
+	router.ServeHTTP(response, request)
+	if response.Code == http.StatusTooManyRequests {
+		t.Error("Expected the reports not to count against the API budget")
+	}
+}
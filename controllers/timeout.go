@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gocraft/web"
+	gcontext "github.com/gorilla/context"
+)
+
+// RequestTimeout is a middleware that gives the request the deadline of its
+// route group. The calls to the upstreams are cancelled once it is reached,
+// or when the client goes away.
+func (c *Context) RequestTimeout(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	timeout := c.Settings.RouteTimeout(req.URL.Path)
+	if timeout == 0 {
+		// Streaming routes are exempt.
+		next(rw, req)
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	req.Request = req.WithContext(ctx)
+	// Clear what gorilla/context holds for the request, as in RequestLogging.
+	defer gcontext.Clear(req.Request)
+	next(rw, req)
+}
+
+// writeTimeoutError tells the client that the request took too long, unless
+// the response has already started.
+func writeTimeoutError(rw http.ResponseWriter) {
+	if w, ok := rw.(web.ResponseWriter); ok && w.Written() {
+		return
+	}
+	newAPIError(http.StatusGatewayTimeout, "the request timed out. try again.").writeTo(rw)
+}
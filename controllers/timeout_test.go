@@ -0,0 +1,73 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/18F/cg-dashboard/helpers"
+	. "github.com/18F/cg-dashboard/helpers/testhelpers"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	uaaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer uaaServer.Close()
+
+	tests := []struct {
+		testName         string
+		path             string
+		routeTimeouts    string
+		expectedCode     int
+		expectedResponse ResponseContentTester
+	}{
+		{
+			testName:         "UAA route timing out",
+			path:             "/uaa/userinfo",
+			routeTimeouts:    "uaa=50ms",
+			expectedCode:     http.StatusGatewayTimeout,
+			expectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "timeout", "message": "the request timed out. try again."}`),
+		},
+		{
+			testName:         "Other route group timing out",
+			path:             "/uaa/userinfo",
+			routeTimeouts:    "api=50ms",
+			expectedCode:     http.StatusOK,
+			expectedResponse: NewJSONResponseContentTester(`{}`),
+		},
+		{
+			testName:         "UAA route exempt from timeouts",
+			path:             "/uaa/userinfo",
+			routeTimeouts:    "uaa=0",
+			expectedCode:     http.StatusOK,
+			expectedResponse: NewJSONResponseContentTester(`{}`),
+		},
+		{
+			testName:         "User info of /uaa/me timing out",
+			path:             "/uaa/me",
+			routeTimeouts:    "uaa=50ms",
+			expectedCode:     http.StatusGatewayTimeout,
+			expectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "timeout", "message": "the request timed out. try again."}`),
+		},
+	}
+	for _, test := range tests {
+		envVars := GetMockCompleteEnvVars()
+		envVars[helpers.UAAURLEnvVar] = uaaServer.URL
+		envVars[helpers.RouteTimeoutsEnvVar] = test.routeTimeouts
+		router, _ := CreateRouterWithMockSession(AdminTokenData, envVars)
+		response, request := NewTestRequest("GET", test.path, nil)
+		router.ServeHTTP(response, request)
+		if response.Code != test.expectedCode {
+			t.Errorf("Test %s: expected code %d. Found %d", test.testName, test.expectedCode, response.Code)
+		}
+		if !test.expectedResponse.Check(t, response.Body.String()) {
+			t.Errorf("Test %s: unexpected response %s", test.testName, response.Body.String())
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gocraft/web"
+	"github.com/gorilla/context"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+// RequestTracing is a middleware that starts a span for the request, joining
+// the trace of the caller if the request has a traceparent header.
+func (c *Context) RequestTracing(rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
+	span := c.Settings.Tracer.StartSpan(req.Request, req.Method)
+	if span == nil {
+		next(rw, req)
+		return
+	}
+	req.Request = helpers.WithSpan(req.Request, span)
+	// Tie the logs of the request to its trace.
+	c.requestLogger = c.logger().With(helpers.Fields{"trace_id": span.TraceID})
+	req.Request = helpers.WithLogger(req.Request, c.requestLogger)
+	// Clear what gorilla/context holds for the request, as in RequestLogging.
+	defer context.Clear(req.Request)
+
+	next(rw, req)
+
+	status := rw.StatusCode()
+	if status == 0 {
+		status = 200
+	}
+	if route := req.RoutePath(); route != "" {
+		span.Name = req.Method + " " + route
+		span.SetAttribute("http.route", route)
+	}
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.Path)
+	span.SetAttribute("http.status_code", status)
+	span.SetAttribute("request_id", c.requestID)
+	if c.userID != "" {
+		span.SetAttribute("user_id", c.userID)
+	}
+	if status >= 500 {
+		span.SetError(http.StatusText(status))
+	}
+	span.Finish()
+}
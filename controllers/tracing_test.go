@@ -0,0 +1,66 @@
+package controllers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/18F/cg-dashboard/helpers"
+	. "github.com/18F/cg-dashboard/helpers/testhelpers"
+)
+
+func TestRequestTracing(t *testing.T) {
+	var upstreamTraceparent string
+	uaaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get(helpers.TraceparentHeader)
+		w.Write([]byte("{}"))
+	}))
+	defer uaaServer.Close()
+	envVars := GetMockCompleteEnvVars()
+	envVars[helpers.UAAURLEnvVar] = uaaServer.URL
+	envVars[helpers.TracingExporterEnvVar] = "stdout"
+	envVars[helpers.TracingTrustParentEnvVar] = "true"
+	router, _ := CreateRouterWithMockSession(AdminTokenData, envVars)
+
+	// The trace of a trusted caller is continued.
+	response, request := NewTestRequest("GET", "/uaa/userinfo", nil)
+	request.Header.Set(helpers.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(response, request)
+	parts := strings.Split(upstreamTraceparent, "-")
+	if len(parts) != 4 || parts[1] != "4bf92f3577b34da6a3ce929d0e0e4736" || parts[3] != "01" {
+		t.Errorf("Expected the trace to be propagated to UAA. Found %q", upstreamTraceparent)
+	} else if parts[2] == "00f067aa0ba902b7" {
+		t.Error("Expected UAA to get the span of the upstream call as parent")
+	}
+
+	// So is the trace of the calls the dashboard makes on its own behalf.
+	upstreamTraceparent = ""
+	response, request = NewTestRequest("GET", "/uaa/me", nil)
+	request.Header.Set(helpers.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(response, request)
+	parts = strings.Split(upstreamTraceparent, "-")
+	if len(parts) != 4 || parts[1] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected the trace of /uaa/me to be propagated to UAA. Found %q", upstreamTraceparent)
+	}
+
+	// Without a valid traceparent header, a new trace is started.
+	response, request = NewTestRequest("GET", "/uaa/userinfo", nil)
+	request.Header.Set(helpers.TraceparentHeader, "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	router.ServeHTTP(response, request)
+	parts = strings.Split(upstreamTraceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || parts[1] == "00000000000000000000000000000000" {
+		t.Errorf("Expected a new trace to be propagated to UAA. Found %q", upstreamTraceparent)
+	}
+
+	// The traces of untrusted callers, such as browsers, are not continued.
+	delete(envVars, helpers.TracingTrustParentEnvVar)
+	router, _ = CreateRouterWithMockSession(AdminTokenData, envVars)
+	response, request = NewTestRequest("GET", "/uaa/userinfo", nil)
+	request.Header.Set(helpers.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(response, request)
+	parts = strings.Split(upstreamTraceparent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || parts[1] == "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected a new trace to be propagated to UAA. Found %q", upstreamTraceparent)
+	}
+}
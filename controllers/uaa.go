@@ -11,9 +11,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 
 	"github.com/gocraft/web"
 
+	"github.com/18F/cg-dashboard/helpers"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -48,60 +50,117 @@ func (c *UAAContext) UserInfo(rw web.ResponseWriter, req *web.Request) {
 	c.uaaProxy(rw, req.Request, "/userinfo", false)
 }
 
-func readBodyToStruct(rawBody io.ReadCloser, obj interface{}) *UaaError {
+// meResponse describes the logged in user: who they are and what they are
+// allowed to do, along with their UAA user info.
+type meResponse struct {
+	UserID    string          `json:"user_id"`
+	UserName  string          `json:"user_name"`
+	Email     string          `json:"email"`
+	Scopes    []string        `json:"scopes"`
+	Origin    string          `json:"origin"`
+	ExpiresAt int64           `json:"expires_at"`
+	Admin     bool            `json:"admin"`
+	UserInfo  json.RawMessage `json:"userinfo"`
+}
+
+// Me returns the identity of the logged in user, decoded from their access
+// token, merged with the UAA_API/userinfo information.
+func (c *UAAContext) Me(rw web.ResponseWriter, req *web.Request) {
+	claims, err := helpers.ParseTokenClaims(&c.Token)
+	if err != nil {
+		newAPIError(http.StatusInternalServerError, err.Error()).writeTo(rw)
+		return
+	}
+	reqUserInfo, _ := http.NewRequest("GET", "/userinfo", nil)
+	reqUserInfo = reqUserInfo.WithContext(req.Context())
+	w := httptest.NewRecorder()
+	c.uaaProxy(w, reqUserInfo, "/userinfo", false)
+	if w.Code == http.StatusGatewayTimeout {
+		writeTimeoutError(rw)
+		return
+	}
+	if w.Code != http.StatusOK {
+		newUpstreamError(w.Code, "unable to get user info.", w.Code, w.Body.Bytes()).writeTo(rw)
+		return
+	}
+	// The user info is passed on as is, so it must be a JSON object.
+	var userInfo map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &userInfo); err != nil || userInfo == nil {
+		newUpstreamError(http.StatusBadGateway, "invalid user info.", w.Code, w.Body.Bytes()).writeTo(rw)
+		return
+	}
+	scopes := claims.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(meResponse{
+		UserID:    claims.UserID,
+		UserName:  claims.UserName,
+		Email:     claims.Email,
+		Scopes:    scopes,
+		Origin:    claims.Origin,
+		ExpiresAt: claims.Expiry,
+		Admin:     claims.HasScope(helpers.AdminScope),
+		UserInfo:  json.RawMessage(w.Body.Bytes()),
+	})
+}
+
+// readBodyMaxBytes is the size of the largest body readBodyToStruct and
+// readUpstreamBody read.
+const readBodyMaxBytes = 1 << 20
+
+// readBodyToStruct decodes the JSON body of a request from the client, up to
+// readBodyMaxBytes.
+func readBodyToStruct(rawBody io.ReadCloser, obj interface{}) *APIError {
 	if rawBody == nil {
-		return newUaaError(http.StatusBadRequest, "no body in request.")
+		return newAPIError(http.StatusBadRequest, "no body in request.")
 	}
 	defer rawBody.Close()
-	body, readErr := ioutil.ReadAll(rawBody)
+	body, readErr := ioutil.ReadAll(io.LimitReader(rawBody, readBodyMaxBytes+1))
+	if readErr == errBodyTooLarge || len(body) > readBodyMaxBytes {
+		return newAPIError(http.StatusRequestEntityTooLarge, "the request body is too large.")
+	}
 	if readErr != nil {
-		return newUaaError(http.StatusBadRequest, readErr.Error())
+		return newAPIError(http.StatusBadRequest, readErr.Error())
 	}
-
-	// Read the response from inviting the user.
-	jsonErr := json.Unmarshal(body, obj)
-	if jsonErr != nil {
-		return newUaaError(http.StatusInternalServerError, jsonErr.Error())
+	if jsonErr := json.Unmarshal(body, obj); jsonErr != nil {
+		return newAPIError(http.StatusBadRequest, "the request body is not valid JSON.").withCode("invalid_body")
 	}
 	return nil
 }
 
-// UaaError contains metadata for a particular UAA error.
-type UaaError struct {
-	statusCode int
-	err        []byte
-}
-
-func newUaaError(statusCode int, data string) *UaaError {
-	return newUaaErrorWithProxyData(statusCode, data, "")
-}
-
-func newUaaErrorWithProxyData(statusCode int, data, proxyData string) *UaaError {
-	jb, err := json.Marshal(struct {
-		Status    string `json:"status"`
-		Data      string `json:"data"`
-		ProxyData string `json:"proxy-data,omitempty"`
-	}{
-		Status:    "failure",
-		Data:      data,
-		ProxyData: proxyData,
-	})
-	if err != nil {
-		// If we get here, we're having a really bad day
-		return &UaaError{
-			statusCode: statusCode,
-			err:        []byte("cannot marshal proper error"),
-		}
+// readUpstreamBody decodes the JSON body of a response from UAA or the CF API,
+// up to readBodyMaxBytes. The upstream is at fault if it can't, so the error
+// is a Bad Gateway with the given message.
+func readUpstreamBody(w *httptest.ResponseRecorder, obj interface{}, message string) *APIError {
+	body := w.Body.Bytes()
+	if len(body) > readBodyMaxBytes {
+		return newUpstreamError(http.StatusBadGateway, message, w.Code, nil)
 	}
-	return &UaaError{
-		statusCode: statusCode,
-		err:        jb,
+	if jsonErr := json.Unmarshal(body, obj); jsonErr != nil {
+		return newUpstreamError(http.StatusBadGateway, message, w.Code, body)
 	}
+	return nil
 }
 
-func (e *UaaError) writeTo(rw http.ResponseWriter) {
-	rw.WriteHeader(e.statusCode)
-	rw.Write(e.err)
+// privilegedProxyError is the error of a privileged call that failed. If the
+// call was rate limited, the client is told so and when to retry. If it timed
+// out, the client is told so.
+func privilegedProxyError(w *httptest.ResponseRecorder, data string) *APIError {
+	var body []byte
+	if resp := w.Result(); resp.Body != nil {
+		body, _ = ioutil.ReadAll(resp.Body)
+	}
+	if w.Code == http.StatusGatewayTimeout {
+		return newAPIError(http.StatusGatewayTimeout, "the request timed out. try again.")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		return newUpstreamError(http.StatusInternalServerError, data, w.Code, body)
+	}
+	err := newUpstreamError(http.StatusTooManyRequests, data, w.Code, body)
+	err.retryAfter = w.Header().Get("Retry-After")
+	return err
 }
 
 type inviteUAAUserRequest struct {
@@ -132,10 +191,10 @@ type NewInvite struct {
 }
 
 // InviteUAAuser tries to invite the user e-mail which will create the user in
-// the UAA database.
-func (c *UAAContext) InviteUAAuser(
+// the UAA database. The call is cancelled with the request.
+func (c *UAAContext) InviteUAAuser(req *http.Request,
 	inviteUserToOrgRequest InviteUserToOrgRequest) (
-	inviteResponse InviteUAAUserResponse, err *UaaError) {
+	inviteResponse InviteUAAUserResponse, err *APIError) {
 	// Make request to UAA to invite user (which will create the user in the
 	// UAA database)
 	reqURL := fmt.Sprintf("/invite_users?%s", url.Values{
@@ -144,24 +203,21 @@ func (c *UAAContext) InviteUAAuser(
 	requestObj := inviteUAAUserRequest{[]string{inviteUserToOrgRequest.Email}}
 	inviteUAAUserBody, jsonErr := json.Marshal(requestObj)
 	if jsonErr != nil {
-		err = newUaaError(http.StatusInternalServerError, jsonErr.Error())
+		err = newAPIError(http.StatusInternalServerError, jsonErr.Error())
 		return
 	}
-	req, _ := http.NewRequest("POST", reqURL,
+	inviteReq, _ := http.NewRequest("POST", reqURL,
 		bytes.NewBuffer(inviteUAAUserBody))
-	req.Header.Set("Content-Type", "application/json")
+	inviteReq = inviteReq.WithContext(req.Context())
+	inviteReq.Header.Set("Content-Type", "application/json")
 	// TODO should look into using reverseproxy in httputil.
 	w := httptest.NewRecorder()
-	c.uaaProxy(w, req, reqURL, true)
+	c.uaaProxy(w, inviteReq, reqURL, true)
 	if w.Code != http.StatusOK {
-		resp := w.Result()
-		body, _ := ioutil.ReadAll(resp.Body)
-		err = newUaaErrorWithProxyData(http.StatusInternalServerError, "unable to create user in UAA database.", string(body))
+		err = privilegedProxyError(w, "unable to create user in UAA database.")
 		return
 	}
-	resp := w.Result()
-
-	err = readBodyToStruct(resp.Body, &inviteResponse)
+	err = readUpstreamBody(w, &inviteResponse, "invalid response creating the user in UAA.")
 	return
 }
 
@@ -170,30 +226,26 @@ type createCFUser struct {
 }
 
 // CreateCFuser will use the UAA user guid and create the user in the
-// CF database.
-func (c *UAAContext) CreateCFuser(userInvite NewInvite) (
-	err *UaaError) {
+// CF database. The call is cancelled with the request.
+func (c *UAAContext) CreateCFuser(req *http.Request, userInvite NewInvite) (
+	err *APIError) {
 	// Creating the JSON for the CF API request which will create the user in
 	// CF database.
 	cfCreateUserBody, jsonErr := json.Marshal(
 		createCFUser{GUID: userInvite.UserID})
 	if jsonErr != nil {
-		err = newUaaError(http.StatusInternalServerError, jsonErr.Error())
+		err = newAPIError(http.StatusInternalServerError, jsonErr.Error())
 		return
 	}
 
 	// Send the request to the CF API to create the user in the CF database.
 	cfReq, _ := http.NewRequest("POST", "/v2/users",
 		bytes.NewBuffer(cfCreateUserBody))
+	cfReq = cfReq.WithContext(req.Context())
 	w := httptest.NewRecorder()
 	c.cfProxy(w, cfReq, "/v2/users")
 	if w.Code != http.StatusCreated && w.Code != http.StatusBadRequest {
-		resp := w.Result()
-		var body []byte
-		if resp.Body != nil {
-			body, _ = ioutil.ReadAll(resp.Body)
-		}
-		err = newUaaErrorWithProxyData(http.StatusInternalServerError, "unable to create user in CF database.", string(body))
+		err = privilegedProxyError(w, "unable to create user in CF database.")
 	}
 	return
 }
@@ -202,18 +254,28 @@ func (c *UAAContext) CreateCFuser(userInvite NewInvite) (
 // request data.
 type InviteUserToOrgRequest struct {
 	Email string `json:"email"`
+	// OrgGUID is the org the user is invited to. The caller must manage it.
+	OrgGUID string `json:"orgGuid"`
 }
 
 // ParseInviteUserToOrgReq will return InviteUserToOrgRequest based on the data
 // in the request body.
 func (c *UAAContext) ParseInviteUserToOrgReq(req *http.Request) (
-	inviteUserToOrgRequest InviteUserToOrgRequest, err *UaaError) {
+	inviteUserToOrgRequest InviteUserToOrgRequest, err *APIError) {
 	err = readBodyToStruct(req.Body, &inviteUserToOrgRequest)
 	return
 }
 
+// inviteEscalatedCalls is the number of privileged calls made by an invite:
+// the user lookup, the UAA invite and the creation of the CF user.
+const inviteEscalatedCalls = 3
+
 // InviteUserToOrg will invite user in both UAA and CF, send an e-mail.
 func (c *UAAContext) InviteUserToOrg(rw web.ResponseWriter, req *web.Request) {
+	// outcome is the step at which the invite stopped, for the metrics.
+	outcome := "invalid_request"
+	defer func() { helpers.Metrics.Invites.WithLabelValues(outcome).Inc() }()
+
 	// parse the request
 	inviteUserToOrgRequest, err := c.ParseInviteUserToOrgReq(req.Request)
 	if err != nil {
@@ -221,15 +283,39 @@ func (c *UAAContext) InviteUserToOrg(rw web.ResponseWriter, req *web.Request) {
 		return
 	}
 
+	// Check that the user may invite to the org before using the
+	// credentials of the dashboard.
+	outcome = "forbidden"
+	err = c.authorizeInvite(req.Request, inviteUserToOrgRequest.OrgGUID)
+	if err != nil {
+		err.writeTo(rw)
+		return
+	}
+	c.targetGUID = inviteUserToOrgRequest.OrgGUID
+
+	// Count all the privileged calls of the invite at once so that it is not
+	// stopped by the rate limit half way through.
+	outcome = "rate_limited"
+	if !c.allowRequest(rw, helpers.RateLimitPrivileged, inviteEscalatedCalls) {
+		// The user lookup is the first call that is not made.
+		c.auditDenied("GET", c.Settings.UaaURL+"/Users")
+		return
+	}
+	c.privilegedReserved = inviteEscalatedCalls
+	// Existing users and failed invites don't make all the calls.
+	defer c.refundPrivileged()
+
+	outcome = "user_lookup_failed"
 	var getUserResp GetUAAUserResponse
-	getUserResp, err = c.GetUAAUserByEmail(inviteUserToOrgRequest.Email)
+	getUserResp, err = c.GetUAAUserByEmail(req.Request, inviteUserToOrgRequest.Email)
 	if err != nil {
 		err.writeTo(rw)
 		return
 	}
 	if !getUserResp.Verified {
 		// Try to invite the user to UAA.
-		inviteResponse, err := c.InviteUAAuser(inviteUserToOrgRequest)
+		outcome = "uaa_invite_failed"
+		inviteResponse, err := c.InviteUAAuser(req.Request, inviteUserToOrgRequest)
 		if err != nil {
 			err.writeTo(rw)
 			return
@@ -237,19 +323,21 @@ func (c *UAAContext) InviteUserToOrg(rw web.ResponseWriter, req *web.Request) {
 
 		// If we don't have a successful invite, we return an error.
 		if len(inviteResponse.NewInvites) < 1 {
-			newUaaError(http.StatusInternalServerError, "no successful invites created.").writeTo(rw)
+			newAPIError(http.StatusInternalServerError, "no successful invites created.").writeTo(rw)
 			return
 		}
 		userInvite := inviteResponse.NewInvites[0]
 
 		// Next try to create the user in CF
-		err = c.CreateCFuser(userInvite)
+		outcome = "cf_user_failed"
+		err = c.CreateCFuser(req.Request, userInvite)
 		if err != nil {
 			err.writeTo(rw)
 			return
 		}
 
 		// Trigger the e-mail invite.
+		outcome = "email_failed"
 		err = c.TriggerInvite(inviteEmailRequest{
 			Email:     userInvite.Email,
 			InviteURL: userInvite.InviteLink,
@@ -260,6 +348,9 @@ func (c *UAAContext) InviteUserToOrg(rw web.ResponseWriter, req *web.Request) {
 		}
 		// Set the user info that get from the newly invited user.
 		getUserResp.ID = userInvite.UserID
+		outcome = "invited"
+	} else {
+		outcome = "existing_user"
 	}
 
 	rw.WriteHeader(http.StatusOK)
@@ -274,6 +365,59 @@ func (c *UAAContext) InviteUserToOrg(rw web.ResponseWriter, req *web.Request) {
 	})
 }
 
+// managedOrgsMaxPages bounds the pages of managed orgs read to authorize an
+// invite.
+const managedOrgsMaxPages = 50
+
+// managedOrgsResponse is a page of the orgs managed by a user.
+// https://apidocs.cloudfoundry.org/272/users/list_all_managed_organizations_for_the_user.html
+type managedOrgsResponse struct {
+	NextURL   string `json:"next_url"`
+	Resources []struct {
+		Metadata struct {
+			GUID string `json:"guid"`
+		} `json:"metadata"`
+	} `json:"resources"`
+}
+
+// authorizeInvite checks that the user may invite users to the org, either as
+// a platform admin or as a manager of the org. The managed orgs are listed
+// with the token of the user, so the CF API decides what the user can see.
+func (c *UAAContext) authorizeInvite(req *http.Request, orgGUID string) *APIError {
+	if _, uuidErr := uuid.FromString(orgGUID); uuidErr != nil {
+		return newAPIError(http.StatusBadRequest, "missing valid org guid.")
+	}
+	claims, claimsErr := helpers.ParseTokenClaims(&c.Token)
+	if claimsErr != nil || claims.UserID == "" {
+		return newAPIError(http.StatusUnauthorized, "unable to identify the user.")
+	}
+	if claims.HasScope(helpers.AdminScope) {
+		return nil
+	}
+	nextURL := fmt.Sprintf("/v2/users/%s/managed_organizations?results-per-page=100", url.PathEscape(claims.UserID))
+	for page := 0; nextURL != "" && page < managedOrgsMaxPages; page++ {
+		orgsReq, _ := http.NewRequest("GET", nextURL, nil)
+		orgsReq = orgsReq.WithContext(req.Context())
+		w := httptest.NewRecorder()
+		c.Proxy(w, orgsReq, c.Settings.ConsoleAPI+nextURL, c.GenericResponseHandler)
+		if w.Code != http.StatusOK {
+			return newUpstreamError(http.StatusInternalServerError, "unable to check the org roles of the user.", w.Code, w.Body.Bytes())
+		}
+		var orgs managedOrgsResponse
+		if err := readUpstreamBody(w, &orgs, "invalid org roles of the user."); err != nil {
+			return err
+		}
+		for _, org := range orgs.Resources {
+			if strings.EqualFold(org.Metadata.GUID, orgGUID) {
+				return nil
+			}
+		}
+		nextURL = orgs.NextURL
+	}
+	c.logger().Warn("invite forbidden", helpers.Fields{"org_guid": orgGUID})
+	return newAPIError(http.StatusForbidden, "you must be a manager of the org to invite users to it.")
+}
+
 // ListUAAUserResponse is the response representation of the User list query.
 // https://docs.cloudfoundry.org/api/uaa/#list63
 type ListUAAUserResponse struct {
@@ -286,28 +430,33 @@ type ListUAAUserResponse struct {
 // If multiple are found, an empty response is returned.
 // If none are found, an empty response is returned.
 // Both special cases return no error.
-func (c *UAAContext) GetUAAUserByEmail(email string) (
-	userResponse GetUAAUserResponse, err *UaaError) {
+// The query is cancelled with the request.
+func (c *UAAContext) GetUAAUserByEmail(req *http.Request, email string) (
+	userResponse GetUAAUserResponse, err *APIError) {
 	// Per https://tools.ietf.org/html/rfc7644#section-3.4.2.2, the value format in a SCIM query is JSON format
 	emailJSONBytes, mErr := json.Marshal(email)
 	if mErr != nil {
-		err = newUaaError(http.StatusBadRequest, mErr.Error())
+		err = newAPIError(http.StatusBadRequest, mErr.Error())
 		return
 	}
 	reqURL := fmt.Sprintf("/Users?%s", url.Values{
 		"filter": {fmt.Sprintf("email eq %s", emailJSONBytes)},
 	}.Encode())
 	reqVerify, _ := http.NewRequest("GET", reqURL, nil)
+	reqVerify = reqVerify.WithContext(req.Context())
 	w := httptest.NewRecorder()
 	c.uaaProxy(w, reqVerify, reqURL, true)
 	// It will always return StatusOK even if it returns an empty resources list.
+	if w.Code == http.StatusTooManyRequests || w.Code == http.StatusGatewayTimeout {
+		err = privilegedProxyError(w, "unable to find user.")
+		return
+	}
 	if w.Code != http.StatusOK {
-		err = newUaaError(http.StatusInternalServerError, "unable to find user.")
+		err = newAPIError(http.StatusInternalServerError, "unable to find user.")
 		return
 	}
-	resp := w.Result()
 	var listUsersResponse ListUAAUserResponse
-	err = readBodyToStruct(resp.Body, &listUsersResponse)
+	err = readUpstreamBody(w, &listUsersResponse, "invalid response finding the user.")
 	if err != nil {
 		return
 	}
@@ -327,19 +476,21 @@ type inviteEmailRequest struct {
 }
 
 // TriggerInvite trigger the email.
-func (c *UAAContext) TriggerInvite(inviteReq inviteEmailRequest) *UaaError {
+func (c *UAAContext) TriggerInvite(inviteReq inviteEmailRequest) *APIError {
 	if inviteReq.Email == "" || inviteReq.InviteURL == "" {
-		return newUaaError(http.StatusBadRequest, "Missing correct params.")
+		return newAPIError(http.StatusBadRequest, "Missing correct params.")
 	}
 	emailHTML := new(bytes.Buffer)
 	tplErr := c.templates.GetInviteEmail(emailHTML, inviteReq.InviteURL)
 	if tplErr != nil {
-		return newUaaError(http.StatusInternalServerError, tplErr.Error())
+		return newAPIError(http.StatusInternalServerError, tplErr.Error())
 	}
-	emailErr := c.mailer.SendEmail(inviteReq.Email, "Invitation to join cloud.gov", emailHTML.Bytes())
+	emailErr := c.mailer.SendEmail(inviteReq.Email, helpers.InviteEmailSubject, emailHTML.Bytes())
 	if emailErr != nil {
-		return newUaaError(http.StatusInternalServerError, emailErr.Error())
+		helpers.Metrics.Emails.WithLabelValues("invite", "failure").Inc()
+		return newAPIError(http.StatusInternalServerError, emailErr.Error())
 	}
+	helpers.Metrics.Emails.WithLabelValues("invite", "success").Inc()
 	return nil
 }
 
@@ -348,14 +499,7 @@ func (c *UAAContext) UaaInfo(rw web.ResponseWriter, req *web.Request) {
 	// Parse and validate the UUID
 	guid, err := uuid.FromString(req.URL.Query().Get("uaa_guid"))
 	if err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(rw).Encode(struct {
-			Status      string `json:"status"`
-			Description string `json:"error_description"`
-		}{
-			Status:      "Bad request",
-			Description: "Missing valid guid.",
-		})
+		newAPIError(http.StatusBadRequest, "missing valid guid.").writeTo(rw)
 		return
 	}
 
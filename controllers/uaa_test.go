@@ -2,6 +2,9 @@ package controllers_test
 
 import (
 	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
 
 	"github.com/18F/cg-dashboard/controllers"
 	. "github.com/18F/cg-dashboard/helpers/testhelpers"
@@ -13,8 +16,20 @@ import (
 
 const (
 	testUserGUID = "3CE6B080-2C27-4ADF-B73E-ED93E6478CFE"
+	testOrgGUID  = "6C1B2B4E-4CA1-4D2A-9C39-2D4B8C0E7A51"
 )
 
+// orgManagerTokenData is the session of a user who is not a platform admin,
+// whose managed orgs are looked up on invites.
+var orgManagerTokenData = map[string]interface{}{
+	"token": oauth2.Token{Expiry: time.Time{}, AccessToken: NewTestJWT(map[string]interface{}{
+		"user_id": "manager-user-guid",
+		"scope":   []string{"openid", "cloud_controller.read"},
+	})},
+	"issued_at":     time.Now().Unix(),
+	"last_activity": time.Now().Unix(),
+}
+
 var userinfoTests = []BasicProxyTest{
 	{
 		BasicSecureTest: BasicSecureTest{
@@ -54,6 +69,99 @@ func TestUserinfo(t *testing.T) {
 	}
 }
 
+var meTests = []BasicProxyTest{
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "Me as admin",
+				SessionData: AdminTokenData,
+				EnvVars:     GetMockCompleteEnvVars(),
+			},
+			ExpectedResponse: NewJSONResponseContentTester(`{"user_id": "admin-user-guid", "user_name": "admin", "email": "admin@example.com", "scopes": ["openid", "cloud_controller.admin"], "origin": "", "expires_at": 0, "admin": true, "userinfo": {"user_id": "admin-user-guid", "given_name": "Admin"}}`),
+			ExpectedCode:     http.StatusOK,
+		},
+		RequestMethod: "GET",
+		RequestPath:   "/uaa/me",
+		Handlers: []Handler{
+			{
+				RequestMethod: "GET",
+				ExpectedPath:  "/userinfo",
+				Response:      `{"user_id": "admin-user-guid", "given_name": "Admin"}`,
+				ResponseCode:  http.StatusOK,
+			},
+		},
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "Me with failing UAA",
+				SessionData: AdminTokenData,
+				EnvVars:     GetMockCompleteEnvVars(),
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "unavailable", "message": "unable to get user info.", "upstream_status": 503, "upstream_body": "unavailable\n"}`),
+			ExpectedCode:     http.StatusServiceUnavailable,
+		},
+		RequestMethod: "GET",
+		RequestPath:   "/uaa/me",
+		Handlers: []Handler{
+			{
+				RequestMethod: "GET",
+				ExpectedPath:  "/userinfo",
+				Response:      "unavailable",
+				ResponseCode:  http.StatusServiceUnavailable,
+			},
+		},
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "Me with invalid user info",
+				SessionData: AdminTokenData,
+				EnvVars:     GetMockCompleteEnvVars(),
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "upstream_error", "message": "invalid user info.", "upstream_status": 200, "upstream_body": "<html>maintenance</html>\n"}`),
+			ExpectedCode:     http.StatusBadGateway,
+		},
+		RequestMethod: "GET",
+		RequestPath:   "/uaa/me",
+		Handlers: []Handler{
+			{
+				RequestMethod: "GET",
+				ExpectedPath:  "/userinfo",
+				Response:      "<html>maintenance</html>",
+				ResponseCode:  http.StatusOK,
+			},
+		},
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "Me with opaque token",
+				SessionData: ValidTokenData,
+				EnvVars:     GetMockCompleteEnvVars(),
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "internal_error", "message": "access token is not a JWT"}`),
+			ExpectedCode:     http.StatusInternalServerError,
+		},
+		RequestMethod: "GET",
+		RequestPath:   "/uaa/me",
+	},
+}
+
+func TestMe(t *testing.T) {
+	for _, test := range meTests {
+		// Create the external server that the proxy will send the request to.
+		testServer := CreateExternalServer(t, &test)
+		// Construct full url for the proxy.
+		fullURL := fmt.Sprintf("%s%s", testServer.URL, test.RequestPath)
+		c := &controllers.UAAContext{SecureContext: &controllers.SecureContext{Context: &controllers.Context{}}}
+		response, request, router := PrepareExternalServerCall(t, c.SecureContext, testServer, fullURL, test)
+		router.ServeHTTP(response, request)
+		VerifyExternalCallResponse(t, response, &test)
+		testServer.Close()
+	}
+}
+
 var inviteUsersTest = []BasicProxyTest{
 	{
 		BasicSecureTest: BasicSecureTest{
@@ -62,26 +170,62 @@ var inviteUsersTest = []BasicProxyTest{
 				SessionData: ValidTokenData,
 				EnvVars:     GetMockCompleteEnvVars(),
 			},
-			ExpectedResponse: NewJSONResponseContentTester("{\"status\": \"failure\", \"data\": \"no body in request.\"}"),
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "bad_request", "message": "no body in request."}`),
 			ExpectedCode:     http.StatusBadRequest,
 		},
 		// What the "external" server will send back to the proxy.
 		RequestMethod: "POST",
 		RequestPath:   "/uaa/invite/users",
 	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "UAA Invite User malformed body",
+				SessionData: AdminTokenData,
+				EnvVars:     GetMockCompleteEnvVars(),
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "invalid_body", "message": "the request body is not valid JSON."}`),
+			ExpectedCode:     http.StatusBadRequest,
+		},
+		RequestMethod: "POST",
+		RequestPath:   "/uaa/invite/users",
+		RequestBody:   []byte(`{"email": "test@example.com",`),
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "UAA Invite User with an invalid user list from UAA",
+				SessionData: AdminTokenData,
+				EnvVars:     GetMockCompleteEnvVars(),
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "upstream_error", "message": "invalid response finding the user.", "upstream_status": 200, "upstream_body": "<html>maintenance</html>\n"}`),
+			ExpectedCode:     http.StatusBadGateway,
+		},
+		RequestMethod: "POST",
+		RequestPath:   "/uaa/invite/users",
+		RequestBody:   []byte(fmt.Sprintf("{\"email\": \"test@example.com\", \"orgGuid\": \"%s\"}", testOrgGUID)),
+		Handlers: []Handler{
+			{
+				RequestMethod: "GET",
+				ExpectedPath:  "/Users?filter=email+eq+%22test%40example.com%22",
+				ResponseCode:  http.StatusOK,
+				Response:      "<html>maintenance</html>",
+			},
+		},
+	},
 	{
 		BasicSecureTest: BasicSecureTest{
 			BasicConsoleUnitTest: BasicConsoleUnitTest{
 				TestName:    "UAA Invite User with e-mail in body but missing invite url",
-				SessionData: ValidTokenData,
+				SessionData: AdminTokenData,
 				EnvVars:     GetMockCompleteEnvVars(),
 			},
-			ExpectedResponse: NewJSONResponseContentTester("{\"status\": \"failure\", \"data\": \"Missing correct params.\"}"),
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "bad_request", "message": "Missing correct params."}`),
 			ExpectedCode:     http.StatusBadRequest,
 		},
 		RequestMethod: "POST",
 		RequestPath:   "/uaa/invite/users",
-		RequestBody:   []byte("{\"email\": \"test@example.com\"}"),
+		RequestBody:   []byte(fmt.Sprintf("{\"email\": \"test@example.com\", \"orgGuid\": \"%s\"}", testOrgGUID)),
 		Handlers: []Handler{
 			{
 				RequestMethod: "POST",
@@ -106,15 +250,15 @@ var inviteUsersTest = []BasicProxyTest{
 		BasicSecureTest: BasicSecureTest{
 			BasicConsoleUnitTest: BasicConsoleUnitTest{
 				TestName:    "UAA Invite User with e-mail in body but missing e-mail",
-				SessionData: ValidTokenData,
+				SessionData: AdminTokenData,
 				EnvVars:     GetMockCompleteEnvVars(),
 			},
-			ExpectedResponse: NewJSONResponseContentTester("{\"status\": \"failure\", \"data\": \"Missing correct params.\"}"),
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "bad_request", "message": "Missing correct params."}`),
 			ExpectedCode:     http.StatusBadRequest,
 		},
 		RequestMethod: "POST",
 		RequestPath:   "/uaa/invite/users",
-		RequestBody:   []byte("{\"email\": \"test@example.com\"}"),
+		RequestBody:   []byte(fmt.Sprintf("{\"email\": \"test@example.com\", \"orgGuid\": \"%s\"}", testOrgGUID)),
 		Handlers: []Handler{
 			{
 				RequestMethod: "POST",
@@ -139,7 +283,7 @@ var inviteUsersTest = []BasicProxyTest{
 		BasicSecureTest: BasicSecureTest{
 			BasicConsoleUnitTest: BasicConsoleUnitTest{
 				TestName:    "UAA Invite User with e-mail in body (new user)",
-				SessionData: ValidTokenData,
+				SessionData: AdminTokenData,
 				EnvVars:     GetMockCompleteEnvVars(),
 			},
 			ExpectedResponse: NewJSONResponseContentTester(fmt.Sprintf("{\"status\": \"success\", \"userGuid\": \"%s\", \"verified\": false}", testUserGUID)),
@@ -147,7 +291,7 @@ var inviteUsersTest = []BasicProxyTest{
 		},
 		RequestMethod: "POST",
 		RequestPath:   "/uaa/invite/users",
-		RequestBody:   []byte("{\"email\": \"test@example.com\"}"),
+		RequestBody:   []byte(fmt.Sprintf("{\"email\": \"test@example.com\", \"orgGuid\": \"%s\"}", testOrgGUID)),
 		Handlers: []Handler{
 			{
 				RequestMethod: "POST",
@@ -172,7 +316,7 @@ var inviteUsersTest = []BasicProxyTest{
 		BasicSecureTest: BasicSecureTest{
 			BasicConsoleUnitTest: BasicConsoleUnitTest{
 				TestName:    "UAA Invite User with already verified user",
-				SessionData: ValidTokenData,
+				SessionData: AdminTokenData,
 				EnvVars:     GetMockCompleteEnvVars(),
 			},
 			ExpectedResponse: NewJSONResponseContentTester(fmt.Sprintf("{\"status\": \"success\", \"userGuid\": \"%s\", \"verified\": true}", testUserGUID)),
@@ -180,7 +324,7 @@ var inviteUsersTest = []BasicProxyTest{
 		},
 		RequestMethod: "POST",
 		RequestPath:   "/uaa/invite/users",
-		RequestBody:   []byte("{\"email\": \"test@example.com\"}"),
+		RequestBody:   []byte(fmt.Sprintf("{\"email\": \"test@example.com\", \"orgGuid\": \"%s\"}", testOrgGUID)),
 		Handlers: []Handler{
 			{
 				RequestMethod: "POST",
@@ -196,6 +340,76 @@ var inviteUsersTest = []BasicProxyTest{
 			},
 		},
 	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "UAA Invite User without org",
+				SessionData: orgManagerTokenData,
+				EnvVars:     GetMockCompleteEnvVars(),
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "bad_request", "message": "missing valid org guid."}`),
+			ExpectedCode:     http.StatusBadRequest,
+		},
+		RequestMethod: "POST",
+		RequestPath:   "/uaa/invite/users",
+		RequestBody:   []byte("{\"email\": \"test@example.com\"}"),
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "UAA Invite User by a user who doesn't manage the org",
+				SessionData: orgManagerTokenData,
+				EnvVars:     GetMockCompleteEnvVars(),
+			},
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "forbidden", "message": "you must be a manager of the org to invite users to it."}`),
+			ExpectedCode:     http.StatusForbidden,
+		},
+		RequestMethod: "POST",
+		RequestPath:   "/uaa/invite/users",
+		RequestBody:   []byte(fmt.Sprintf("{\"email\": \"test@example.com\", \"orgGuid\": \"%s\"}", testOrgGUID)),
+		Handlers: []Handler{
+			{
+				RequestMethod: "GET",
+				ExpectedPath:  "/v2/users/manager-user-guid/managed_organizations?results-per-page=100",
+				ResponseCode:  http.StatusOK,
+				Response:      "{\"next_url\": null, \"resources\": [{\"metadata\": {\"guid\": \"other-org-guid\"}}]}",
+			},
+		},
+	},
+	{
+		BasicSecureTest: BasicSecureTest{
+			BasicConsoleUnitTest: BasicConsoleUnitTest{
+				TestName:    "UAA Invite User by a manager of the org",
+				SessionData: orgManagerTokenData,
+				EnvVars:     GetMockCompleteEnvVars(),
+			},
+			ExpectedResponse: NewJSONResponseContentTester(fmt.Sprintf("{\"status\": \"success\", \"userGuid\": \"%s\", \"verified\": true}", testUserGUID)),
+			ExpectedCode:     http.StatusOK,
+		},
+		RequestMethod: "POST",
+		RequestPath:   "/uaa/invite/users",
+		RequestBody:   []byte(fmt.Sprintf("{\"email\": \"test@example.com\", \"orgGuid\": \"%s\"}", testOrgGUID)),
+		Handlers: []Handler{
+			{
+				RequestMethod: "GET",
+				ExpectedPath:  "/v2/users/manager-user-guid/managed_organizations?results-per-page=100",
+				ResponseCode:  http.StatusOK,
+				Response:      "{\"next_url\": \"/v2/users/manager-user-guid/managed_organizations?page=2&results-per-page=100\", \"resources\": [{\"metadata\": {\"guid\": \"other-org-guid\"}}]}",
+			},
+			{
+				RequestMethod: "GET",
+				ExpectedPath:  "/v2/users/manager-user-guid/managed_organizations?page=2&results-per-page=100",
+				ResponseCode:  http.StatusOK,
+				Response:      fmt.Sprintf("{\"next_url\": null, \"resources\": [{\"metadata\": {\"guid\": \"%s\"}}]}", strings.ToLower(testOrgGUID)),
+			},
+			{
+				RequestMethod: "GET",
+				ExpectedPath:  "/Users?filter=email+eq+%22test%40example.com%22",
+				ResponseCode:  http.StatusOK,
+				Response:      fmt.Sprintf("{\"resources\": [{\"active\": true, \"verified\": true, \"id\": \"%s\", \"externalId\": \"user-guid@domain.com\" }]}", testUserGUID),
+			},
+		},
+	},
 }
 
 func TestInviteUsers(t *testing.T) {
@@ -220,7 +434,7 @@ var uaainfoTests = []BasicProxyTest{
 				SessionData: ValidTokenData,
 				EnvVars:     GetMockCompleteEnvVars(),
 			},
-			ExpectedResponse: NewJSONResponseContentTester(fmt.Sprintf(`{"status": "Bad request", "error_description": "Missing valid guid."}`)),
+			ExpectedResponse: NewJSONErrorContentTester(`{"status": "failure", "code": "bad_request", "message": "missing valid guid."}`),
 			ExpectedCode:     http.StatusBadRequest,
 		},
 		// What the "external" server will send back to the proxy.
@@ -0,0 +1,229 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit events.
+const (
+	// AuditProxiedRequest is a request changing something, proxied with the
+	// token of the user.
+	AuditProxiedRequest = "proxied_request"
+	// AuditPrivilegedRequest is a call made with the credentials of the
+	// dashboard on behalf of the user.
+	AuditPrivilegedRequest = "privileged_request"
+	// AuditPrivilegedRequestDenied is a call with the credentials of the
+	// dashboard which was not made because the user or client IP was over the
+	// privileged rate limit.
+	AuditPrivilegedRequestDenied = "privileged_request_denied"
+)
+
+// AuditBodyMaxBytes is the size above which request bodies are left out of
+// the audit records.
+const AuditBodyMaxBytes = 64 << 10
+
+// AuditRedacted replaces the values of the sensitive fields in the audit
+// records.
+const AuditRedacted = "[REDACTED]"
+
+// auditSensitiveFields are the parts of field names whose values are left out
+// of the audit records.
+var auditSensitiveFields = []string{"password", "passwd", "secret", "token", "credential", "private_key", "authorization"}
+
+// auditSensitiveObjects are the fields of the CF API whose values are left out
+// of the audit records as a whole, whatever the names of the fields they hold:
+// the environment variables of apps and the credentials of service instances
+// and docker images.
+var auditSensitiveObjects = map[string]bool{
+	"environment_json":   true,
+	"credentials":        true,
+	"docker_credentials": true,
+}
+
+// guidPattern matches the GUIDs in the paths of the CF API and UAA.
+var guidPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+// AuditRecord tells who did what through the dashboard.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	RequestID string    `json:"request_id,omitempty"`
+	UserID    string    `json:"user_id,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Method    string    `json:"method"`
+	Upstream  string    `json:"upstream"`
+	Path      string    `json:"path"`
+	// TargetGUID is the org, space, app or other resource acted on, if known.
+	TargetGUID string `json:"target_guid,omitempty"`
+	// UpstreamStatus is 0 if the upstream could not be reached.
+	UpstreamStatus int `json:"upstream_status"`
+	// Body is the JSON request body, with the sensitive fields redacted.
+	Body  json.RawMessage `json:"body,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// AuditSink stores the audit records.
+type AuditSink interface {
+	Write(record AuditRecord) error
+	Close() error
+}
+
+// NewAuditSink creates the sink: "stdout" and "file" write a JSON record per
+// line, to the standard output or to the file, and "syslog" sends them to the
+// syslog server at the address, such as udp://localhost:514, or to the local
+// one. "none" disables the audit records.
+func NewAuditSink(kind, file, address string) (AuditSink, error) {
+	switch kind {
+	case "none":
+		return nil, nil
+	case "stdout":
+		return NewWriterAuditSink(os.Stdout, nil), nil
+	case "file":
+		if file == "" {
+			return nil, fmt.Errorf("missing audit file")
+		}
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return NewWriterAuditSink(f, f), nil
+	case "syslog":
+		var network, raddr string
+		if address != "" {
+			u, err := url.Parse(address)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("invalid syslog address: %s", address)
+			}
+			network, raddr = u.Scheme, u.Host
+		}
+		w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, "cg-dashboard")
+		if err != nil {
+			return nil, err
+		}
+		return &syslogAuditSink{w: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown audit sink: %s", kind)
+	}
+}
+
+// writerAuditSink writes a JSON record per line.
+type writerAuditSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewWriterAuditSink creates a sink writing a JSON record per line to w. The
+// closer, if any, is closed with the sink.
+func NewWriterAuditSink(w io.Writer, closer io.Closer) AuditSink {
+	return &writerAuditSink{w: w, closer: closer}
+}
+
+func (s *writerAuditSink) Write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+func (s *writerAuditSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// syslogAuditSink sends a JSON record per message to syslog.
+type syslogAuditSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogAuditSink) Write(record AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(line))
+}
+
+func (s *syslogAuditSink) Close() error {
+	return s.w.Close()
+}
+
+// Audit writes the record to the audit sink, if any. The request goes on even
+// if the record can't be written.
+func (s *Settings) Audit(record AuditRecord) {
+	if s.AuditSink == nil {
+		return
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	if err := s.AuditSink.Write(record); err != nil {
+		Log.Error("unable to write the audit record", Fields{"error": err, "request_id": record.RequestID})
+	}
+}
+
+// AuditTargetGUID returns the first GUID in the path, which is the resource
+// acted on in the CF API and UAA, if any.
+func AuditTargetGUID(path string) string {
+	return guidPattern.FindString(path)
+}
+
+// RedactBody returns the JSON body with the values of the sensitive fields
+// replaced, at any depth. Bodies which are not JSON are left out.
+func RedactBody(body []byte) json.RawMessage {
+	var value interface{}
+	if len(body) == 0 || json.Unmarshal(body, &value) != nil {
+		return nil
+	}
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if auditSensitiveField(key) {
+				v[key] = AuditRedacted
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
+
+func auditSensitiveField(key string) bool {
+	key = strings.ToLower(key)
+	if auditSensitiveObjects[key] {
+		return true
+	}
+	for _, sensitive := range auditSensitiveFields {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package helpers_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		{
+			body:     `{"name": "app", "instances": 2}`,
+			expected: `{"instances":2,"name":"app"}`,
+		},
+		{
+			body:     `{"name": "db", "credentials": {"uri": "postgres://u:p@host"}, "params": [{"Client_Secret": "s", "size": 1}]}`,
+			expected: `{"credentials":"[REDACTED]","name":"db","params":[{"Client_Secret":"[REDACTED]","size":1}]}`,
+		},
+		{
+			body:     `{"name": "app", "environment_json": {"DATABASE_URL": "postgres://u:p@host", "DEBUG": "1"}, "docker_credentials": {"username": "u"}}`,
+			expected: `{"docker_credentials":"[REDACTED]","environment_json":"[REDACTED]","name":"app"}`,
+		},
+		{
+			body:     `{"password": "hunter2"}`,
+			expected: `{"password":"[REDACTED]"}`,
+		},
+		{body: `password=hunter2`},
+		{body: ``},
+	}
+	for _, test := range tests {
+		if redacted := string(helpers.RedactBody([]byte(test.body))); redacted != test.expected {
+			t.Errorf("Body %s: expected %s. Found %s", test.body, test.expected, redacted)
+		}
+	}
+}
+
+func TestAuditTargetGUID(t *testing.T) {
+	if guid := helpers.AuditTargetGUID("/v2/apps/3ce6b080-2c27-4adf-b73e-ed93e6478cfe/routes/6c1b2b4e-4ca1-4d2a-9c39-2d4b8c0e7a51"); guid != "3ce6b080-2c27-4adf-b73e-ed93e6478cfe" {
+		t.Errorf("Expected the app guid. Found %q", guid)
+	}
+	if guid := helpers.AuditTargetGUID("/v2/users"); guid != "" {
+		t.Errorf("Expected no guid. Found %q", guid)
+	}
+}
+
+func TestNewAuditSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+
+	sink, err := helpers.NewAuditSink("file", file, "")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	for _, path := range []string{"/v2/apps", "/v2/spaces"} {
+		if err := sink.Write(helpers.AuditRecord{Event: helpers.AuditProxiedRequest, Method: "POST", Path: path, UpstreamStatus: 201}); err != nil {
+			t.Errorf("Unexpected error %s", err)
+		}
+	}
+	sink.Close()
+	content, _ := ioutil.ReadFile(file)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a record per line. Found %q", content)
+	}
+	var record helpers.AuditRecord
+	if err := json.Unmarshal([]byte(lines[1]), &record); err != nil || record.Path != "/v2/spaces" || record.UpstreamStatus != 201 {
+		t.Errorf("Unexpected record %s", lines[1])
+	}
+
+	if sink, err := helpers.NewAuditSink("none", "", ""); sink != nil || err != nil {
+		t.Errorf("Expected no sink. Found %v, %v", sink, err)
+	}
+	for _, kind := range []string{"file", "kafka"} {
+		if _, err := helpers.NewAuditSink(kind, "", ""); err == nil {
+			t.Errorf("Expected an error with the %s sink", kind)
+		}
+	}
+	if _, err := helpers.NewAuditSink("syslog", "", "localhost:514"); err == nil {
+		t.Error("Expected an error with an address without network")
+	}
+}
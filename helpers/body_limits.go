@@ -0,0 +1,106 @@
+package helpers
+
+import (
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// defaultBodyLimits are the maximum sizes, in bytes, of the request bodies of
+// the route groups when not configured. Only the CF API gets large bodies,
+// such as the environment of an app.
+var defaultBodyLimits = map[string]int64{
+	RouteGroupAPI:     1 << 20,
+	RouteGroupUAA:     64 << 10,
+	RouteGroupLog:     64 << 10,
+	RouteGroupAdmin:   64 << 10,
+	RouteGroupDefault: 64 << 10,
+}
+
+// allowedContentTypes are the media types of the request bodies the dashboard
+// accepts.
+var allowedContentTypes = []string{"application/json"}
+
+// byteSizeUnits are the suffixes of the sizes in parseByteSize.
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"B", 1},
+}
+
+// parseByteSize parses a size in bytes, with an optional B, KB or MB suffix,
+// such as "512KB".
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return size * multiplier, nil
+}
+
+// parseBodyLimits overrides the default body limits with the comma separated
+// group=size pairs, such as "api=2MB,uaa=16KB". A zero size removes the limit.
+func parseBodyLimits(value string) (map[string]int64, error) {
+	limits := make(map[string]int64, len(defaultBodyLimits))
+	for group, limit := range defaultBodyLimits {
+		limits[group] = limit
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		group := strings.TrimSpace(kv[0])
+		if _, ok := defaultBodyLimits[group]; !ok || len(kv) != 2 {
+			return nil, fmt.Errorf("invalid body limit: %s", pair)
+		}
+		limit, err := parseByteSize(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid body limit: %s", pair)
+		}
+		limits[group] = limit
+	}
+	return limits, nil
+}
+
+// BodyLimit returns the maximum size, in bytes, of the request bodies to a
+// path, or zero if they are not limited.
+func (s *Settings) BodyLimit(path string) int64 {
+	if s.BodyLimits == nil {
+		return defaultBodyLimits[RouteGroup(path)]
+	}
+	return s.BodyLimits[RouteGroup(path)]
+}
+
+// AllowedContentType returns whether the dashboard accepts request bodies of
+// the content type, whatever its parameters, to the path. Only violation
+// reports are accepted by the CSP report endpoint.
+func AllowedContentType(path, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	allowedTypes := allowedContentTypes
+	if path == CSPReportPath {
+		allowedTypes = cspReportContentTypes
+	}
+	for _, allowed := range allowedTypes {
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package helpers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// AdminScope is the UAA scope a user must have in order to reach the
+// operator-only routes of the dashboard.
+const AdminScope = "cloud_controller.admin"
+
+// TokenClaims is the subset of the claims in a UAA access token that the
+// dashboard cares about.
+// https://docs.cloudfoundry.org/api/uaa/#token
+type TokenClaims struct {
+	UserID   string   `json:"user_id"`
+	UserName string   `json:"user_name"`
+	Email    string   `json:"email"`
+	Scopes   []string `json:"scope"`
+	Origin   string   `json:"origin"`
+	Expiry   int64    `json:"exp"`
+}
+
+// HasScope returns whether the token was granted the given scope.
+func (t *TokenClaims) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTokenClaims decodes the payload of the access token (a JWT issued by
+// UAA). The signature is not verified as the token was received directly from
+// UAA over TLS and has been stored server side since.
+func ParseTokenClaims(token *oauth2.Token) (*TokenClaims, error) {
+	if token == nil {
+		return nil, errors.New("no token")
+	}
+	parts := strings.Split(token.AccessToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("access token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
@@ -0,0 +1,32 @@
+package helpers_test
+
+import (
+	"testing"
+
+	"golang.org/x/oauth2"
+
+	"github.com/18F/cg-dashboard/helpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers"
+)
+
+func TestParseTokenClaims(t *testing.T) {
+	token := testhelpers.AdminTokenData["token"].(oauth2.Token)
+	claims, err := helpers.ParseTokenClaims(&token)
+	if err != nil {
+		t.Fatalf("Expected no error parsing the token claims. %s", err.Error())
+	}
+	if claims.Email != "admin@example.com" || claims.UserID != "admin-user-guid" {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+	if !claims.HasScope(helpers.AdminScope) {
+		t.Error("Expected the admin scope to be found")
+	}
+	if claims.HasScope("scim.invite") {
+		t.Error("Expected the scim.invite scope to not be found")
+	}
+
+	token = testhelpers.ValidTokenData["token"].(oauth2.Token)
+	if _, err = helpers.ParseTokenClaims(&token); err == nil {
+		t.Error("Expected an error parsing a token that is not a JWT")
+	}
+}
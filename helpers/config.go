@@ -0,0 +1,494 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+)
+
+// PortEnvVar is the port the dashboard listens on, set by Cloud Foundry.
+const PortEnvVar = "PORT"
+
+// defaultPort is the port when PORT is not set, for local development.
+const defaultPort = "9999"
+
+// defaultRedisURI is the redis server of the redis session backend when
+// neither REDIS_URI nor a bound service tagged redis is found.
+const defaultRedisURI = "redis://localhost:6379"
+
+// sessionBackends are the known values of SESSION_BACKEND. Unset means file.
+var sessionBackends = []string{"", "file", "cookie", "redis"}
+
+// Config is the configuration of the dashboard, read from the environment
+// variables and validated as a whole, so that every problem is reported at
+// once.
+type Config struct {
+	Port          string
+	BasePath      string
+	AppURL        string
+	APIURL        string
+	LoginURL      string
+	UAAURL        string
+	LogURL        string
+	ClientID      string
+	ClientSecret  string
+	PProfEnabled  bool
+	BuildInfo     string
+	LocalCF       bool
+	SecureCookies bool
+	// NewRelicLicense enables the New Relic agent, if set.
+	NewRelicLicense       string
+	SessionBackend        string
+	SessionKey            string
+	SessionEncryptionKeys string
+	SessionPlaintextUntil time.Time
+	SessionIdleTimeout    time.Duration
+	SessionMaxLifetime    time.Duration
+	// RedisURI is REDIS_URI, or else the URI of the bound service tagged
+	// redis when the redis session backend is used.
+	RedisURI              string
+	RedisTLSCACert        string
+	RedisTLSServerName    string
+	RedisSentinelAddrs    []string
+	RedisSentinelMaster   string
+	RedisSentinelPassword string
+	MetricsToken          string
+	SMTPHost              string
+	SMTPPort              string
+	SMTPUser              string
+	SMTPPass              string
+	SMTPFrom              string
+	TICSecret             string
+	TracingExporter       string
+	OTLPEndpoint          string
+	OTLPHeaders           string
+	ServiceName           string
+	TracingSampleRatio    float64
+	TracingTrustParent    bool
+	AuditSink             string
+	AuditFile             string
+	AuditSyslogAddress    string
+	// Timeouts and limits of the HTTP server.
+	ServerReadTimeout       time.Duration
+	ServerReadHeaderTimeout time.Duration
+	ServerWriteTimeout      time.Duration
+	ServerIdleTimeout       time.Duration
+	ServerMaxHeaderBytes    int
+	ShutdownTimeout         time.Duration
+	ShutdownDrainDelay      time.Duration
+	RouteTimeouts           map[string]time.Duration
+	BodyLimits              map[string]int64
+	RateLimits              map[string]RateLimit
+	SecurityHeaders         *SecurityHeaders
+	ProxyPolicy             *ProxyPolicy
+	// summary is the effective value of every variable, with the secrets
+	// redacted.
+	summary Fields
+}
+
+// ConfigError lists every problem found in the configuration.
+type ConfigError struct {
+	Problems []error
+}
+
+// Error returns an error string
+func (err *ConfigError) Error() string {
+	problems := make([]string, len(err.Problems))
+	for i, problem := range err.Problems {
+		problems[i] = problem.Error()
+	}
+	return "invalid configuration: " + strings.Join(problems, "; ")
+}
+
+// configLoader reads the variables of a Config, recording their problems
+// instead of stopping at the first one.
+type configLoader struct {
+	envVars  *EnvVars
+	problems []error
+	summary  Fields
+}
+
+func (l *configLoader) problem(format string, args ...interface{}) {
+	l.problems = append(l.problems, fmt.Errorf(format, args...))
+}
+
+// string returns the value of the variable, or defaultVal if not set.
+func (l *configLoader) string(key, defaultVal string) string {
+	val, found := l.envVars.load(key)
+	if !found {
+		val = defaultVal
+	}
+	l.summary[key] = val
+	return val
+}
+
+// secret returns the value of the variable, which is redacted in the summary.
+func (l *configLoader) secret(key string) string {
+	val, found := l.envVars.load(key)
+	if found {
+		l.summary[key] = AuditRedacted
+	}
+	return val
+}
+
+// required returns the value of the variable, which must be set.
+func (l *configLoader) required(key string) string {
+	val := l.string(key, "")
+	if val == "" {
+		l.problems = append(l.problems, &ErrMissingEnvVar{Name: key})
+	}
+	return val
+}
+
+// requiredSecret returns the value of the secret variable, which must be set.
+func (l *configLoader) requiredSecret(key string) string {
+	val := l.secret(key)
+	if val == "" {
+		l.problems = append(l.problems, &ErrMissingEnvVar{Name: key})
+	}
+	return val
+}
+
+// url returns the value of the required variable, which must be an http or
+// https URL. Credentials in the URL are redacted in the summary.
+func (l *configLoader) url(key string) string {
+	val := l.required(key)
+	if val == "" {
+		return ""
+	}
+	if err := validateURL(val); err != nil {
+		l.problem("invalid %s: %s", key, err)
+		return val
+	}
+	l.summary[key] = redactURL(val)
+	return val
+}
+
+// bool returns the value of the variable as parsed by strconv.ParseBool, or
+// false if not set.
+func (l *configLoader) bool(key string) bool {
+	val := l.string(key, "")
+	if val == "" {
+		return false
+	}
+	rv, err := strconv.ParseBool(val)
+	if err != nil {
+		l.problem("invalid %s: %s is not a boolean", key, val)
+	}
+	return rv
+}
+
+// duration returns the value of the variable as a non-negative duration, or
+// defaultVal if not set.
+func (l *configLoader) duration(key string, defaultVal time.Duration) time.Duration {
+	val := l.string(key, defaultVal.String())
+	rv, err := time.ParseDuration(val)
+	if err != nil || rv < 0 {
+		l.problem("invalid %s: %s is not a duration", key, val)
+		return defaultVal
+	}
+	return rv
+}
+
+// int returns the value of the variable as a positive integer, or defaultVal
+// if not set.
+func (l *configLoader) int(key string, defaultVal int) int {
+	val := l.string(key, strconv.Itoa(defaultVal))
+	rv, err := strconv.Atoi(val)
+	if err != nil || rv <= 0 {
+		l.problem("invalid %s: %s is not a positive integer", key, val)
+		return defaultVal
+	}
+	return rv
+}
+
+// ratio returns the value of the variable as a number between 0 and 1, or
+// defaultVal if not set.
+func (l *configLoader) ratio(key string, defaultVal float64) float64 {
+	val := l.string(key, strconv.FormatFloat(defaultVal, 'g', -1, 64))
+	rv, err := strconv.ParseFloat(val, 64)
+	if err != nil || rv < 0 || rv > 1 {
+		l.problem("invalid %s: %s is not a ratio between 0 and 1", key, val)
+		return defaultVal
+	}
+	return rv
+}
+
+// port returns the value of the variable, which must be a TCP port if set.
+func (l *configLoader) port(key, defaultVal string) string {
+	val := l.string(key, defaultVal)
+	if val == "" {
+		return ""
+	}
+	if port, err := strconv.Atoi(val); err != nil || port < 1 || port > 65535 {
+		l.problem("invalid %s: %s is not a port", key, val)
+	}
+	return val
+}
+
+// check records the error, if any, as a problem of the variable.
+func (l *configLoader) check(key string, err error) {
+	if err != nil {
+		l.problem("%s: %s", key, err)
+	}
+}
+
+// LoadConfig reads and validates the configuration, and the services bound to
+// the app in env, if any. If it is invalid, the error is a *ConfigError
+// listing every problem.
+func LoadConfig(envVars *EnvVars, env *cfenv.App) (*Config, error) {
+	l := &configLoader{envVars: envVars, summary: Fields{}}
+	c := &Config{}
+	var err error
+
+	c.Port = l.port(PortEnvVar, defaultPort)
+	c.BasePath = l.string(BasePathEnvVar, "")
+	c.AppURL = l.url(HostnameEnvVar)
+	c.APIURL = l.url(APIURLEnvVar)
+	c.LoginURL = l.url(LoginURLEnvVar)
+	c.UAAURL = l.url(UAAURLEnvVar)
+	c.LogURL = l.url(LogURLEnvVar)
+	c.ClientID = l.required(ClientIDEnvVar)
+	c.ClientSecret = l.requiredSecret(ClientSecretEnvVar)
+	c.PProfEnabled = l.bool(PProfEnabledEnvVar)
+	c.BuildInfo = l.string(BuildInfoEnvVar, "developer-build")
+	c.LocalCF = l.bool(LocalCFEnvVar)
+	c.SecureCookies = l.bool(SecureCookiesEnvVar)
+	// Safe guard: shouldn't run with insecure cookies if we are
+	// in a non-development environment (i.e. production)
+	if !c.LocalCF && !c.SecureCookies {
+		l.problem("cannot run with insecure cookies when targeting a production CF environment")
+	}
+	c.NewRelicLicense = l.secret(NewRelicLicenseEnvVar)
+
+	c.SessionBackend = l.string(SessionBackendEnvVar, "")
+	if !stringInSlice(c.SessionBackend, sessionBackends) {
+		l.problem("unknown %s: %s", SessionBackendEnvVar, c.SessionBackend)
+	}
+	c.SessionKey = l.requiredSecret(SessionKeyEnvVar)
+	c.SessionEncryptionKeys = l.secret(SessionEncryptionKeysEnvVar)
+	for _, secret := range strings.Split(c.SessionEncryptionKeys, ",") {
+		if c.SessionKey != "" && strings.TrimSpace(secret) == c.SessionKey {
+			l.problem("session encryption keys must be different from the session key")
+			break
+		}
+	}
+	if until := l.string(SessionPlaintextUntilEnvVar, ""); until != "" {
+		var err error
+		if c.SessionPlaintextUntil, err = time.Parse(time.RFC3339, until); err != nil {
+			l.problem("invalid %s: %s is not an RFC 3339 time", SessionPlaintextUntilEnvVar, until)
+		}
+	}
+	c.SessionIdleTimeout = l.duration(SessionIdleTimeoutEnvVar, 15*time.Minute)
+	c.SessionMaxLifetime = l.duration(SessionMaxLifetimeEnvVar, 12*time.Hour)
+	c.RedisURI = l.secret(RedisURIEnvVar)
+	redisSource := RedisURIEnvVar
+	if c.RedisURI == "" && c.SessionBackend == "redis" {
+		redisSource = "redis service"
+		c.RedisURI, _ = getRedisService(env)
+		if c.RedisURI == "" {
+			// A local redis server, as in development.
+			c.RedisURI = defaultRedisURI
+		}
+	}
+	if c.RedisURI != "" {
+		if err := validateRedisURI(c.RedisURI); err != nil {
+			l.problem("invalid %s: %s", redisSource, err)
+		} else {
+			l.summary[RedisURIEnvVar] = redactURL(c.RedisURI)
+		}
+	}
+	c.RedisTLSCACert = l.string(RedisTLSCACertEnvVar, "")
+	c.RedisTLSServerName = l.string(RedisTLSServerNameEnvVar, "")
+	for _, addr := range strings.Split(l.string(RedisSentinelAddrsEnvVar, ""), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			c.RedisSentinelAddrs = append(c.RedisSentinelAddrs, addr)
+		}
+	}
+	c.RedisSentinelMaster = l.string(RedisSentinelMasterEnvVar, "mymaster")
+	c.RedisSentinelPassword = l.secret(RedisSentinelPasswordEnvVar)
+	c.MetricsToken = l.secret(MetricsTokenEnvVar)
+
+	c.SMTPFrom = l.required(SMTPFromEnvVar)
+	c.SMTPHost = l.required(SMTPHostEnvVar)
+	c.SMTPPort = l.port(SMTPPortEnvVar, "")
+	c.SMTPUser = l.string(SMTPUserEnvVar, "")
+	c.SMTPPass = l.secret(SMTPPassEnvVar)
+	if (c.SMTPUser == "") != (c.SMTPPass == "") {
+		l.problem("%s and %s must be set together", SMTPUserEnvVar, SMTPPassEnvVar)
+	}
+	c.TICSecret = l.secret(TICSecretEnvVar)
+
+	c.TracingExporter = l.string(TracingExporterEnvVar, "")
+	c.OTLPEndpoint = l.string(OTLPEndpointEnvVar, "")
+	c.OTLPHeaders = l.secret(OTLPHeadersEnvVar)
+	c.ServiceName = l.string(ServiceNameEnvVar, "cg-dashboard")
+	c.TracingSampleRatio = l.ratio(TracingSampleRatioEnvVar, 1)
+	c.TracingTrustParent = l.bool(TracingTrustParentEnvVar)
+	switch c.TracingExporter {
+	case "", "stdout":
+	case "otlp":
+		if c.OTLPEndpoint == "" {
+			l.problem("%s requires %s", TracingExporterEnvVar+"=otlp", OTLPEndpointEnvVar)
+		} else if err := validateURL(c.OTLPEndpoint); err != nil {
+			l.problem("invalid %s: %s", OTLPEndpointEnvVar, err)
+		} else {
+			_, err = NewOTLPExporter(c.OTLPEndpoint, c.OTLPHeaders, c.ServiceName)
+			l.check(OTLPHeadersEnvVar, err)
+		}
+	default:
+		l.problem("unknown tracing exporter: %s", c.TracingExporter)
+	}
+
+	c.AuditSink = l.string(AuditSinkEnvVar, "stdout")
+	c.AuditFile = l.string(AuditFileEnvVar, "")
+	c.AuditSyslogAddress = l.string(AuditSyslogAddressEnvVar, "")
+	switch c.AuditSink {
+	case "none", "stdout":
+	case "file":
+		if c.AuditFile == "" {
+			l.problem("%s requires %s", AuditSinkEnvVar+"=file", AuditFileEnvVar)
+		} else if err := checkWritable(c.AuditFile); err != nil {
+			l.problem("%s is not writable: %s", AuditFileEnvVar, err)
+		}
+	case "syslog":
+		if c.AuditSyslogAddress != "" {
+			if u, err := url.Parse(c.AuditSyslogAddress); err != nil || u.Host == "" {
+				l.problem("invalid %s: %s", AuditSyslogAddressEnvVar, c.AuditSyslogAddress)
+			}
+		}
+	default:
+		l.problem("unknown audit sink: %s", c.AuditSink)
+	}
+
+	// The route timeouts limit the requests, so that long log dumps and
+	// streams aren't cut by the server. Reading the requests is still bounded.
+	c.ServerReadTimeout = l.duration(ServerReadTimeoutEnvVar, defaultServerReadTimeout)
+	c.ServerReadHeaderTimeout = l.duration(ServerReadHeaderTimeoutEnvVar, defaultServerReadHeaderTimeout)
+	c.ServerWriteTimeout = l.duration(ServerWriteTimeoutEnvVar, 0)
+	c.ServerIdleTimeout = l.duration(ServerIdleTimeoutEnvVar, defaultServerIdleTimeout)
+	c.ServerMaxHeaderBytes = l.int(ServerMaxHeaderBytesEnvVar, defaultServerMaxHeaderBytes)
+	c.ShutdownTimeout = l.duration(ShutdownTimeoutEnvVar, defaultShutdownTimeout)
+	c.ShutdownDrainDelay = l.duration(ShutdownDrainDelayEnvVar, defaultShutdownDrainDelay)
+	if c.ShutdownDrainDelay >= c.ShutdownTimeout {
+		l.problem("%s must be shorter than %s", ShutdownDrainDelayEnvVar, ShutdownTimeoutEnvVar)
+	}
+	c.RouteTimeouts, err = parseRouteTimeouts(l.string(RouteTimeoutsEnvVar, ""))
+	l.check(RouteTimeoutsEnvVar, err)
+	c.BodyLimits, err = parseBodyLimits(l.string(BodyLimitsEnvVar, ""))
+	l.check(BodyLimitsEnvVar, err)
+	c.RateLimits, err = parseRateLimits(l.string(RateLimitsEnvVar, ""))
+	l.check(RateLimitsEnvVar, err)
+
+	// Browsers only honor HSTS over HTTPS, which secure cookies require.
+	hstsMaxAge := time.Duration(0)
+	if c.SecureCookies {
+		hstsMaxAge = l.duration(HSTSMaxAgeEnvVar, defaultHSTSMaxAge)
+	}
+	c.SecurityHeaders, err = newSecurityHeaders(l.string(ContentSecurityPolicyEnvVar, defaultContentSecurityPolicy),
+		l.string(CSPModeEnvVar, CSPModeEnforce), hstsMaxAge)
+	l.check(CSPModeEnvVar, err)
+	c.ProxyPolicy, err = NewProxyPolicy(l.string(ProxyRulesEnvVar, ""))
+	l.check(ProxyRulesEnvVar, err)
+
+	c.summary = l.summary
+	if len(l.problems) > 0 {
+		return nil, &ConfigError{Problems: l.problems}
+	}
+	return c, nil
+}
+
+// Summary returns the effective value of every variable, defaults included,
+// for the startup logs. Secrets and the credentials in URLs are redacted.
+func (c *Config) Summary() Fields {
+	summary := make(Fields, len(c.summary))
+	for key, val := range c.summary {
+		summary[key] = val
+	}
+	return summary
+}
+
+// validateURL checks that the value is an absolute http or https URL.
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New(value + " is not an http or https URL")
+	}
+	return nil
+}
+
+// validateRedisURI checks that the value is a redis or rediss URI.
+func validateRedisURI(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return errors.New(redactURL(value) + " is not a redis or rediss URI")
+	}
+	return nil
+}
+
+// checkWritable checks that the file can be appended to, or else created in
+// its directory, as the file audit sink does, without changing either.
+func checkWritable(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		dir, err := os.Stat(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if !dir.IsDir() {
+			return errors.New("parent is not a directory")
+		}
+		// Only a hint, as the mode doesn't say whose the write permission is.
+		if dir.Mode().Perm()&0222 == 0 {
+			return errors.New("directory is not writable")
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return errors.New("is a directory")
+	}
+	// Opening the file for appending checks the permissions without writing.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// redactURL hides the password of the URL, if any.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), AuditRedacted)
+	}
+	return u.String()
+}
+
+// stringInSlice returns whether the value is one of the values.
+func stringInSlice(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package helpers
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// maxCookieLength is the largest cookie that browsers reliably accept.
+const maxCookieLength = 4096
+
+// compressedGobEncoder is a securecookie.Serializer that compresses the gob
+// encoded session values. The oauth tokens would otherwise not fit in a
+// cookie once encrypted and base64 encoded.
+type compressedGobEncoder struct{}
+
+// Serialize gob encodes and then compresses src.
+func (e compressedGobEncoder) Serialize(src interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if err := gob.NewEncoder(w).Encode(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize decompresses and then gob decodes src into dst.
+func (e compressedGobEncoder) Deserialize(src []byte, dst interface{}) error {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return gob.NewDecoder(r).Decode(dst)
+}
+
+// cookieStoreInfo binds the key derived from SESSION_KEY to the encryption of
+// the session cookies.
+const cookieStoreInfo = "cg-dashboard session cookie encryption"
+
+// cookieHealthCheckName and cookieHealthCheckValue are the cookie the health
+// check encodes and decodes.
+const (
+	cookieHealthCheckName  = "health_check"
+	cookieHealthCheckValue = "ok"
+)
+
+// cookieStore is a sessions.CookieStore that counts the sessions it could not
+// save.
+type cookieStore struct {
+	*sessions.CookieStore
+}
+
+// newCookieStore creates a session store that keeps the whole session in an
+// encrypted cookie. No state is kept on the server, so it works across any
+// number of instances.
+func newCookieStore(sessionKey string) (*cookieStore, error) {
+	// SESSION_KEY is used to authenticate the cookie as with the other stores.
+	// The encryption key is derived from it as AES needs a 32 byte key.
+	blockKey, err := deriveKey(sessionKey, cookieStoreInfo)
+	if err != nil {
+		return nil, err
+	}
+	store := sessions.NewCookieStore([]byte(sessionKey), blockKey)
+	for _, codec := range store.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.SetSerializer(compressedGobEncoder{})
+			sc.MaxLength(maxCookieLength)
+		}
+	}
+	return &cookieStore{CookieStore: store}, nil
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *cookieStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session decoded from the cookie, saved back through this
+// store.
+func (s *cookieStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	inner, err := s.CookieStore.New(r, name)
+	session := sessions.NewSession(s, name)
+	session.Values = inner.Values
+	session.Options = inner.Options
+	session.IsNew = inner.IsNew
+	return session, err
+}
+
+// Save encodes the session into the cookie. A session that can't be saved,
+// most likely because it has grown past maxCookieLength, only affects its
+// user, so it is counted rather than reported by the health check.
+func (s *cookieStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	err := s.CookieStore.Save(r, w, session)
+	if err != nil {
+		Metrics.SessionSaveFailures.WithLabelValues("cookie").Inc()
+		RequestLogger(r).Error("unable to save the session cookie", Fields{"error": err})
+	}
+	return err
+}
+
+// healthCheck encodes and decodes a probe value with the codecs of the
+// sessions, which fails if the keys or the serializer are broken. There is no
+// server side state that could be down.
+func (s *cookieStore) healthCheck() (bool, string) {
+	encoded, err := securecookie.EncodeMulti(cookieHealthCheckName, cookieHealthCheckValue, s.Codecs...)
+	if err == nil {
+		var decoded string
+		err = securecookie.DecodeMulti(cookieHealthCheckName, encoded, &decoded, s.Codecs...)
+		if err == nil && decoded != cookieHealthCheckValue {
+			err = errors.New("decoded a different value")
+		}
+	}
+	if err != nil {
+		Log.Error("session store health check failed", Fields{"error": err})
+		return false, ""
+	}
+	return true, ""
+}
@@ -2,8 +2,6 @@ package helpers
 
 import (
 	"fmt"
-	"log"
-	"strconv"
 
 	cfenv "github.com/cloudfoundry-community/go-cfenv"
 )
@@ -41,10 +39,25 @@ var (
 	SecureCookiesEnvVar = "SECURE_COOKIES"
 	// LocalCFEnvVar is set to true or 1, then we indicate that we are using a local CF env.
 	LocalCFEnvVar = "LOCAL_CF"
-	// SessionBackendEnvVar is the session backend type
+	// SessionBackendEnvVar is the session backend type: "redis", "cookie" or
+	// "file" (the default).
 	SessionBackendEnvVar = "SESSION_BACKEND"
 	// SessionKeyEnvVar is the secret key used to protect session data
 	SessionKeyEnvVar = "SESSION_KEY"
+	// SessionEncryptionKeysEnvVar is a comma separated list of secrets used to
+	// encrypt the session values at rest. The first one is used to encrypt, all
+	// of them can decrypt, which allows rotating keys.
+	SessionEncryptionKeysEnvVar = "SESSION_ENCRYPTION_KEYS"
+	// SessionPlaintextUntilEnvVar is until when, as an RFC 3339 time, the
+	// sessions saved before SESSION_ENCRYPTION_KEYS was set are still accepted
+	// and encrypted as they are read. They are rejected when not set.
+	SessionPlaintextUntilEnvVar = "SESSION_PLAINTEXT_UNTIL"
+	// SessionIdleTimeoutEnvVar is how long a session can be unused before it
+	// expires, as a duration. Defaults to 15m, 0 means no idle timeout.
+	SessionIdleTimeoutEnvVar = "SESSION_IDLE_TIMEOUT"
+	// SessionMaxLifetimeEnvVar is how long a session can last after logging in,
+	// as a duration. Defaults to 12h, 0 means no limit.
+	SessionMaxLifetimeEnvVar = "SESSION_MAX_LIFETIME"
 	// BasePathEnvVar is the path to the application root
 	BasePathEnvVar = "BASE_PATH"
 	// SMTPHostEnvVar is SMTP host for UAA invites
@@ -59,6 +72,110 @@ var (
 	SMTPFromEnvVar = "SMTP_FROM"
 	// TICSecretEnvVar is the shared secret with CF API proxy for forwarding client IPs
 	TICSecretEnvVar = "TIC_SECRET"
+	// RedisURIEnvVar is the URI of the redis server, such as
+	// redis://:password@localhost:6379, used with the redis session backend.
+	// Unset means the bound service tagged redis.
+	RedisURIEnvVar = "REDIS_URI"
+	// RedisSentinelAddrsEnvVar is a comma separated list of redis sentinel
+	// addresses (host:port). If set, the redis master is discovered through them.
+	RedisSentinelAddrsEnvVar = "REDIS_SENTINEL_ADDRS"
+	// RedisSentinelMasterEnvVar is the name of the master monitored by the redis
+	// sentinels. Defaults to "mymaster".
+	RedisSentinelMasterEnvVar = "REDIS_SENTINEL_MASTER"
+	// RedisSentinelPasswordEnvVar is the password of the redis sentinels.
+	// Defaults to the password of the redis URI.
+	RedisSentinelPasswordEnvVar = "REDIS_SENTINEL_PASSWORD"
+	// RedisTLSCACertEnvVar is the PEM encoded CA certificate used to verify the
+	// redis server when connecting with a rediss:// URI.
+	RedisTLSCACertEnvVar = "REDIS_TLS_CA_CERT"
+	// RedisTLSServerNameEnvVar is the name the certificate of the redis server
+	// is checked against with a rediss:// URI. Defaults to the host of the URI
+	// with sentinels, as the masters they report are usually IPs.
+	RedisTLSServerNameEnvVar = "REDIS_TLS_SERVER_NAME"
+	// MetricsTokenEnvVar is the bearer token required to read /metrics, if
+	// set. /metrics is open without it.
+	MetricsTokenEnvVar = "METRICS_TOKEN"
+	// TracingExporterEnvVar is where the traces are sent: "otlp" for an
+	// OpenTelemetry collector or "stdout" for local testing. Unset means tracing
+	// is disabled.
+	TracingExporterEnvVar = "TRACING_EXPORTER"
+	// OTLPEndpointEnvVar is the base URL of the OpenTelemetry collector, such as
+	// http://localhost:4318.
+	OTLPEndpointEnvVar = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	// OTLPHeadersEnvVar is a comma separated list of key=value headers sent to
+	// the OpenTelemetry collector, such as credentials.
+	OTLPHeadersEnvVar = "OTEL_EXPORTER_OTLP_HEADERS"
+	// TracingSampleRatioEnvVar is the share, between 0 and 1, of the new traces
+	// that are sampled. Traces continued from a trusted caller follow its
+	// decision. Defaults to 1.
+	TracingSampleRatioEnvVar = "OTEL_TRACES_SAMPLER_ARG"
+	// TracingTrustParentEnvVar, if set to true or 1, makes requests with a
+	// traceparent header continue the trace of the caller. Only set it when
+	// every caller is a trusted service, as browsers can send any traceparent.
+	// Otherwise every request starts a new trace.
+	TracingTrustParentEnvVar = "TRACING_TRUST_TRACEPARENT"
+	// RouteTimeoutsEnvVar is a comma separated list of group=duration pairs
+	// overriding the timeouts of the route groups (api, uaa, log, admin and
+	// default), such as "api=30s,log=0". Zero means no timeout.
+	RouteTimeoutsEnvVar = "ROUTE_TIMEOUTS"
+	// BodyLimitsEnvVar is a comma separated list of group=size pairs overriding
+	// the maximum sizes of the request bodies of the route groups, such as
+	// "api=2MB,uaa=16KB". Zero means no limit.
+	BodyLimitsEnvVar = "BODY_LIMITS"
+	// RateLimitsEnvVar is a comma separated list of budget=requests/window pairs
+	// overriding the rate limits of the invite, privileged and api budgets,
+	// such as "invite=10/1h,api=1000/1m". Zero disables a limit.
+	RateLimitsEnvVar = "RATE_LIMITS"
+	// CSPModeEnvVar is how the Content-Security-Policy is applied: "enforce"
+	// (the default), "report-only" or "off".
+	CSPModeEnvVar = "CSP_MODE"
+	// ContentSecurityPolicyEnvVar overrides the Content-Security-Policy. The
+	// "{nonce}" placeholder is replaced by the nonce of the inline scripts.
+	ContentSecurityPolicyEnvVar = "CONTENT_SECURITY_POLICY"
+	// HSTSMaxAgeEnvVar is how long browsers must only use HTTPS, as a duration.
+	// Zero disables the Strict-Transport-Security header. It is only sent with
+	// secure cookies.
+	HSTSMaxAgeEnvVar = "HSTS_MAX_AGE"
+	// ProxyRulesEnvVar is a list of rules, separated by semicolons, checked
+	// before the default rules to allow or deny the requests proxied to the CF
+	// API, such as "allow GET /v2/buildpacks/**; deny DELETE /v2/apps/*".
+	ProxyRulesEnvVar = "PROXY_RULES"
+	// AuditSinkEnvVar is where the audit records are written: "stdout" (the
+	// default), "file", "syslog" or "none".
+	AuditSinkEnvVar = "AUDIT_SINK"
+	// AuditFileEnvVar is the file the audit records are appended to with the
+	// file sink.
+	AuditFileEnvVar = "AUDIT_FILE"
+	// AuditSyslogAddressEnvVar is the syslog server the audit records are sent
+	// to with the syslog sink, such as udp://localhost:514. Unset means the
+	// local syslog.
+	AuditSyslogAddressEnvVar = "AUDIT_SYSLOG_ADDRESS"
+	// ServerReadTimeoutEnvVar is how long the server waits for a whole request,
+	// as a duration (e.g. 30s). Defaults to 1m.
+	ServerReadTimeoutEnvVar = "SERVER_READ_TIMEOUT"
+	// ServerReadHeaderTimeoutEnvVar is how long the server waits for the headers
+	// of a request, as a duration.
+	ServerReadHeaderTimeoutEnvVar = "SERVER_READ_HEADER_TIMEOUT"
+	// ServerWriteTimeoutEnvVar is how long the server can take to write a
+	// response, as a duration. Unset means no limit besides the route timeouts,
+	// which lets responses stream.
+	ServerWriteTimeoutEnvVar = "SERVER_WRITE_TIMEOUT"
+	// ServerIdleTimeoutEnvVar is how long keep-alive connections are kept open
+	// between requests, as a duration.
+	ServerIdleTimeoutEnvVar = "SERVER_IDLE_TIMEOUT"
+	// ServerMaxHeaderBytesEnvVar is the maximum size of the request headers, in
+	// bytes.
+	ServerMaxHeaderBytesEnvVar = "SERVER_MAX_HEADER_BYTES"
+	// ShutdownTimeoutEnvVar is how long the app has to shut down once asked to
+	// stop, including the drain delay, as a duration.
+	ShutdownTimeoutEnvVar = "SHUTDOWN_TIMEOUT"
+	// ShutdownDrainDelayEnvVar is how long the app keeps accepting requests
+	// once asked to stop, while the router stops sending it any, as a
+	// duration. It must be shorter than the shutdown timeout.
+	ShutdownDrainDelayEnvVar = "SHUTDOWN_DRAIN_DELAY"
+	// ServiceNameEnvVar is the name of the service in the traces. Defaults to
+	// "cg-dashboard".
+	ServiceNameEnvVar = "OTEL_SERVICE_NAME"
 )
 
 // EnvVars provides a convenient method to access environment variables
@@ -75,33 +192,6 @@ func (el *EnvVars) String(key, defaultVal string) string {
 	return rv
 }
 
-// MustString will panic if value is not set, otherwise it returns the value.
-func (el *EnvVars) MustString(key string) string {
-	rv, found := el.load(key)
-	if !found {
-		panic(&ErrMissingEnvVar{Name: key})
-	}
-	return rv
-}
-
-// Bool looks for the key, and if found, parses it using strconv.ParseBool and returns
-// the result. If not found, returns false. If found and won't parse, panics.
-func (el *EnvVars) Bool(key string) bool {
-	val, found := el.load(key)
-	if !found {
-		return false
-	}
-
-	rv, err := strconv.ParseBool(val)
-	if err != nil {
-		// invalid values will now return an error
-		// previous behavior defaulted to false
-		panic(err)
-	}
-
-	return rv
-}
-
 // load is an internal method that looks for a given key within
 // all elements in the path, and if none found, returns "", false.
 func (el *EnvVars) load(key string) (string, bool) {
@@ -123,7 +213,7 @@ func NewEnvVarsFromPath(path ...EnvLookup) *EnvVars {
 // EnvLookup must return the value for the given key and whether it was found or not
 type EnvLookup func(key string) (string, bool)
 
-// ErrMissingEnvVar is panicked if a MustGet fails.
+// ErrMissingEnvVar is the problem of a required variable that is not set.
 type ErrMissingEnvVar struct {
 	// Name of the key that was not found
 	Name string
@@ -138,9 +228,13 @@ func (err *ErrMissingEnvVar) Error() string {
 // with the given name, and will allow sourcing of environment variables
 // from there. If no service is found, a warning is printed, but no error thrown.
 func NewEnvLookupFromCFAppNamedService(cfApp *cfenv.App, namedService string) EnvLookup {
-	service, err := cfApp.Services.WithName(namedService)
+	var service *cfenv.Service
+	var err error
+	if cfApp != nil {
+		service, err = cfApp.Services.WithName(namedService)
+	}
 	if err != nil {
-		log.Printf("Warning: No bound service found with name: %s, will not be used for sourcing env variables.\n", namedService)
+		Log.Warn("no bound service found, will not be used for sourcing env variables", Fields{"service": namedService})
 	}
 	return func(name string) (string, bool) {
 		if service == nil { // no service
@@ -152,7 +246,7 @@ func NewEnvLookupFromCFAppNamedService(cfApp *cfenv.App, namedService string) En
 		}
 		serviceVarAsString, ok := serviceVar.(string)
 		if !ok {
-			log.Printf("Warning: variable found in service for %s, but unable to cast as string, so ignoring.\n", name)
+			Log.Warn("variable found in service, but unable to cast as string, so ignoring", Fields{"variable": name})
 			return "", false
 		}
 		return serviceVarAsString, true
@@ -0,0 +1,130 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// healthCheckTimeout is how long a dependency has to answer a health check.
+	healthCheckTimeout = 2 * time.Second
+	// healthCheckTTL is how long health check results are reused, so that
+	// frequent pings don't hammer the dependencies.
+	healthCheckTTL = 10 * time.Second
+)
+
+// DependencyHealth is the result of the health check of a dependency.
+type DependencyHealth struct {
+	Up bool `json:"up"`
+	// Critical dependencies are needed for the dashboard to work at all. The
+	// dashboard is only degraded when the others are down.
+	Critical  bool    `json:"critical"`
+	LatencyMS float64 `json:"latency-ms"`
+	// Error is why the dependency is down. It is logged rather than reported,
+	// as it can reveal internal addresses.
+	Error string `json:"-"`
+}
+
+// dependencyCheck checks that a dependency is reachable.
+type dependencyCheck struct {
+	name     string
+	critical bool
+	check    func() error
+}
+
+// HealthChecker checks the dependencies of the dashboard concurrently and
+// caches the results.
+type HealthChecker struct {
+	checks []dependencyCheck
+
+	mu        sync.Mutex
+	results   map[string]DependencyHealth
+	checkedAt time.Time
+}
+
+// NewHealthChecker creates the health checker of the CF API, UAA, login
+// server, loggregator and SMTP relay.
+func (s *Settings) NewHealthChecker() *HealthChecker {
+	client := &http.Client{Timeout: healthCheckTimeout}
+	if c := s.httpClient(); c.Transport != nil {
+		client.Transport = c.Transport
+	}
+	smtpPort := s.SMTPPort
+	if smtpPort == "" {
+		smtpPort = "25"
+	}
+	return &HealthChecker{checks: []dependencyCheck{
+		{name: "cf-api", critical: true, check: httpCheck(client, s.ConsoleAPI+"/v2/info")},
+		{name: "uaa", critical: true, check: httpCheck(client, s.UaaURL+"/healthz")},
+		{name: "login", critical: true, check: httpCheck(client, s.LoginURL+"/healthz")},
+		{name: "loggregator", check: httpCheck(client, s.LogURL)},
+		{name: "smtp", check: tcpCheck(net.JoinHostPort(s.SMTPHost, smtpPort))},
+	}}
+}
+
+// Check returns the health of each dependency, checking them again if the
+// last results are stale.
+func (h *HealthChecker) Check() map[string]DependencyHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.results != nil && time.Since(h.checkedAt) < healthCheckTTL {
+		return h.results
+	}
+	results := make(map[string]DependencyHealth, len(h.checks))
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c dependencyCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.check()
+			health := DependencyHealth{
+				Up:        err == nil,
+				Critical:  c.critical,
+				LatencyMS: time.Since(start).Seconds() * 1000,
+			}
+			if err != nil {
+				health.Error = err.Error()
+				Log.Error("dependency health check failed", Fields{"dependency": c.name, "critical": c.critical, "error": health.Error})
+			}
+			resultsMu.Lock()
+			results[c.name] = health
+			resultsMu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	h.results = results
+	h.checkedAt = time.Now()
+	return results
+}
+
+// httpCheck considers a dependency up when it answers the request, with
+// anything but a server error.
+func httpCheck(client *http.Client, url string) func() error {
+	return func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("unexpected status: %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// tcpCheck considers a dependency up when it accepts connections.
+func tcpCheck(addr string) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", addr, healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -3,9 +3,23 @@ package helpers_test
 import (
 	"github.com/18F/cg-dashboard/helpers"
 	"github.com/18F/cg-dashboard/helpers/testhelpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers/docker"
 
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/oauth2"
 )
 
 type tokenTestData struct {
@@ -48,10 +62,250 @@ func TestGetValidToken(t *testing.T) {
 		store.ResetSessionData(test.sessionData, test.sessionName)
 		mockSettings.Sessions = store
 
-		value := helpers.GetValidToken(mockRequest, &mockSettings)
+		value := helpers.GetValidToken(httptest.NewRecorder(), mockRequest, &mockSettings)
 		if (value == nil) == test.returnValueNull {
 		} else {
 			t.Errorf("Test %s did not meet expected value. Expected: %t. Actual: %t\n", test.testName, test.returnValueNull, (value == nil))
 		}
 	}
 }
+
+// newTokenServer creates a fake UAA token endpoint that hands out a new access
+// token for every refresh and counts how many it handed out.
+func newTokenServer(refreshes *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(refreshes, 1)
+		// Give concurrent requests a chance to pile up.
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "refreshedtoken%d", "token_type": "bearer", "refresh_token": "newrefreshtoken", "expires_in": 3600}`, n)
+	}))
+}
+
+func TestGetValidTokenRefresh(t *testing.T) {
+	var refreshes int32
+	server := newTokenServer(&refreshes)
+	defer server.Close()
+
+	mockRequest, _ := http.NewRequest("GET", "", nil)
+	store := testhelpers.MockSessionStore{}
+	store.ResetSessionData(map[string]interface{}{
+		"token": oauth2.Token{Expiry: time.Now().Add(-1 * time.Minute), AccessToken: "expiredtoken", RefreshToken: "refreshtoken"},
+	}, "")
+	mockSettings := helpers.Settings{
+		Sessions:       store,
+		OAuthConfig:    &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL}},
+		TokenRefresher: helpers.NewMemoryTokenRefresher(),
+	}
+
+	token := helpers.GetValidToken(httptest.NewRecorder(), mockRequest, &mockSettings)
+	if token == nil {
+		t.Fatal("Expected the expired token to be refreshed")
+	}
+	if token.AccessToken != "refreshedtoken1" {
+		t.Errorf("Expected the refreshed access token. Found %s", token.AccessToken)
+	}
+	saved, _ := store.Session.Values["token"].(oauth2.Token)
+	if saved.AccessToken != "refreshedtoken1" || saved.RefreshToken != "newrefreshtoken" {
+		t.Errorf("Expected the refreshed token to be saved in the session. Found %+v", saved)
+	}
+
+	// The saved token is valid, so it is used as is from now on.
+	helpers.GetValidToken(httptest.NewRecorder(), mockRequest, &mockSettings)
+	if refreshes != 1 {
+		t.Errorf("Expected the token to be refreshed once. Refreshed %d times", refreshes)
+	}
+}
+
+func TestGetValidTokenRefreshCancelled(t *testing.T) {
+	// A UAA that doesn't answer until the end of the test.
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	mockRequest, _ := http.NewRequest("GET", "", nil)
+	mockRequest = mockRequest.WithContext(ctx)
+	store := testhelpers.MockSessionStore{}
+	store.ResetSessionData(map[string]interface{}{
+		"token": oauth2.Token{Expiry: time.Now().Add(-1 * time.Minute), AccessToken: "expiredtoken", RefreshToken: "refreshtoken"},
+	}, "")
+	mockSettings := helpers.Settings{
+		Sessions:       store,
+		OAuthConfig:    &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL}},
+		TokenRefresher: helpers.NewMemoryTokenRefresher(),
+	}
+
+	start := time.Now()
+	if token := helpers.GetValidToken(httptest.NewRecorder(), mockRequest, &mockSettings); token != nil {
+		t.Errorf("Expected no token. Found %+v", token)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the refresh to be cancelled with the request. Took %s", elapsed)
+	}
+}
+
+func TestGetValidTokenConcurrentRefresh(t *testing.T) {
+	var refreshes int32
+	server := newTokenServer(&refreshes)
+	defer server.Close()
+
+	// Every request of the instance loads its own copy of the same session.
+	refresher := helpers.NewMemoryTokenRefresher()
+	var wg sync.WaitGroup
+	tokens := make([]*oauth2.Token, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mockRequest, _ := http.NewRequest("GET", "", nil)
+			store := testhelpers.MockSessionStore{}
+			store.ResetSessionData(map[string]interface{}{
+				"token": oauth2.Token{Expiry: time.Now().Add(-1 * time.Minute), AccessToken: "expiredtoken", RefreshToken: "sharedrefreshtoken"},
+			}, "")
+			mockSettings := helpers.Settings{
+				Sessions:       store,
+				OAuthConfig:    &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: server.URL}},
+				TokenRefresher: refresher,
+			}
+			tokens[i] = helpers.GetValidToken(httptest.NewRecorder(), mockRequest, &mockSettings)
+		}(i)
+	}
+	wg.Wait()
+
+	if refreshes != 1 {
+		t.Errorf("Expected the token to be refreshed once. Refreshed %d times", refreshes)
+	}
+	for i, token := range tokens {
+		if token == nil || token.AccessToken != "refreshedtoken1" {
+			t.Errorf("Expected request %d to get the refreshed token. Found %+v", i, token)
+		}
+	}
+}
+
+func TestRedisTokenRefresher(t *testing.T) {
+	redisURI, cleanUpRedis, _, _ := docker.CreateTestRedis()
+	defer cleanUpRedis()
+	envVars := testhelpers.GetMockCompleteEnvVars()
+	envVars[helpers.SessionBackendEnvVar] = "redis"
+	envVars[helpers.RedisURIEnvVar] = redisURI
+	envVars[helpers.SessionEncryptionKeysEnvVar] = "encryption-secret-of-at-least-32-bytes"
+	env, _ := cfenv.Current()
+
+	// Two instances sharing the redis session backend.
+	var refreshers []helpers.TokenRefresher
+	for i := 0; i < 2; i++ {
+		s := helpers.Settings{}
+		if err := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		refreshers = append(refreshers, s.TokenRefresher)
+	}
+
+	var refreshes int32
+	refresh := func(context.Context) (*oauth2.Token, error) {
+		n := atomic.AddInt32(&refreshes, 1)
+		// Give concurrent requests a chance to pile up.
+		time.Sleep(50 * time.Millisecond)
+		return &oauth2.Token{AccessToken: fmt.Sprintf("refreshedtoken%d", n), RefreshToken: "newrefreshtoken", Expiry: time.Now().Add(time.Hour)}, nil
+	}
+	// Results are kept in redis for a while, so every run refreshes its own
+	// token.
+	refreshToken, _ := helpers.GenerateRandomString(16)
+	var wg sync.WaitGroup
+	tokens := make([]*oauth2.Token, 6)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], _ = refreshers[i%len(refreshers)].Refresh(context.Background(), refreshToken, refresh)
+		}(i)
+	}
+	wg.Wait()
+
+	if refreshes != 1 {
+		t.Errorf("Expected the token to be refreshed once across the instances. Refreshed %d times", refreshes)
+	}
+	for i, token := range tokens {
+		if token == nil || token.AccessToken != "refreshedtoken1" || token.RefreshToken != "newrefreshtoken" {
+			t.Errorf("Expected request %d to get the refreshed token. Found %+v", i, token)
+		}
+	}
+
+	// The shared token is encrypted like the sessions.
+	c, err := redis.DialURL(redisURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sum := sha256.Sum256([]byte(refreshToken))
+	shared, err := redis.Bytes(c.Do("GET", "token_refresh_"+hex.EncodeToString(sum[:])+"_result"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(shared, []byte("refreshedtoken1")) || bytes.Contains(shared, []byte("newrefreshtoken")) {
+		t.Errorf("Expected the shared token to be encrypted. Found %q", shared)
+	}
+}
+
+func TestMemoryTokenRefresherPanic(t *testing.T) {
+	refresher := helpers.NewMemoryTokenRefresher()
+	_, err := refresher.Refresh(context.Background(), "refreshtoken", func(context.Context) (*oauth2.Token, error) {
+		panic("boom")
+	})
+	if err == nil {
+		t.Error("Expected the refresh that panicked to fail")
+	}
+
+	// The next requests don't wait for the refresh that panicked.
+	done := make(chan *oauth2.Token)
+	go func() {
+		token, _ := refresher.Refresh(context.Background(), "refreshtoken", func(context.Context) (*oauth2.Token, error) {
+			return &oauth2.Token{AccessToken: "refreshedtoken"}, nil
+		})
+		done <- token
+	}()
+	select {
+	case token := <-done:
+		if token == nil || token.AccessToken != "refreshedtoken" {
+			t.Errorf("Expected the token to be refreshed again. Found %+v", token)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the next refresh not to block")
+	}
+}
+
+func TestMemoryTokenRefresherWaiterCancelled(t *testing.T) {
+	refresher := helpers.NewMemoryTokenRefresher()
+	release := make(chan struct{})
+	refresh := func(ctx context.Context) (*oauth2.Token, error) {
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return &oauth2.Token{AccessToken: "refreshedtoken"}, nil
+	}
+
+	// The first request gives up waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := refresher.Refresh(ctx, "refreshtoken", refresh); err != context.Canceled {
+		t.Errorf("Expected the wait to be cancelled. Found %v", err)
+	}
+
+	// The refresh goes on for the other requests.
+	done := make(chan *oauth2.Token)
+	go func() {
+		token, _ := refresher.Refresh(context.Background(), "refreshtoken", refresh)
+		done <- token
+	}()
+	close(release)
+	if token := <-done; token == nil || token.AccessToken != "refreshedtoken" {
+		t.Errorf("Expected the other requests to get the refreshed token. Found %+v", token)
+	}
+}
@@ -0,0 +1,158 @@
+package helpers
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// RequestIDHeader is the header carrying the ID of a request. It is taken
+// from the incoming request when present and forwarded to CF and UAA, so that
+// a request can be followed across systems.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the longest incoming request ID that is kept.
+const maxRequestIDLength = 128
+
+// Fields are the structured data attached to a log entry.
+type Fields map[string]interface{}
+
+// syncWriter serializes the writes of all the loggers sharing it, so that log
+// entries don't get interleaved.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(b)
+}
+
+// Logger writes log entries as JSON lines, with a level, a timestamp, a
+// message and fields.
+type Logger struct {
+	out    *syncWriter
+	fields Fields
+}
+
+// Log is the logger for everything that does not happen within a request.
+var Log = NewLogger(os.Stdout)
+
+// NewLogger creates a logger writing to w.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{out: &syncWriter{w: w}}
+}
+
+// SetOutput changes where the logger, and all the loggers derived from it with
+// With, write to.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w = w
+}
+
+// With returns a logger adding the fields to every entry.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{out: l.out, fields: merged}
+}
+
+// Info logs normal operations.
+func (l *Logger) Info(msg string, fields ...Fields) {
+	l.log("info", msg, fields)
+}
+
+// Warn logs unexpected situations that can be recovered from.
+func (l *Logger) Warn(msg string, fields ...Fields) {
+	l.log("warn", msg, fields)
+}
+
+// Error logs failures.
+func (l *Logger) Error(msg string, fields ...Fields) {
+	l.log("error", msg, fields)
+}
+
+func (l *Logger) log(level, msg string, fields []Fields) {
+	entry := make(Fields, len(l.fields)+3)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	for _, f := range fields {
+		for k, v := range f {
+			// Errors don't marshal to anything useful.
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			entry[k] = v
+		}
+	}
+	entry["level"] = level
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["msg"] = msg
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(Fields{
+			"level": "error",
+			"time":  entry["time"],
+			"msg":   "unable to marshal log entry: " + err.Error(),
+		})
+	}
+	l.out.Write(append(b, '\n'))
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of the request carrying the logger.
+func WithLogger(req *http.Request, l *Logger) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), loggerKey{}, l))
+}
+
+// RequestLogger returns the logger of the request, or Log if it has none.
+func RequestLogger(req *http.Request) *Logger {
+	if l, ok := req.Context().Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Log
+}
+
+// RequestID returns the ID of the request from its header, or a new one if it
+// has none or if it doesn't look like an ID.
+func RequestID(req *http.Request) string {
+	if id := req.Header.Get(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	b, err := GenerateRandomBytes(16)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID checks that an incoming request ID can be safely logged and
+// forwarded.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
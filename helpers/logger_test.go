@@ -0,0 +1,64 @@
+package helpers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := helpers.NewLogger(&out).With(helpers.Fields{"request_id": "abc"})
+	logger.Error("something failed", helpers.Fields{"error": errors.New("boom"), "status": 500})
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a JSON log entry. Found %s", out.String())
+	}
+	expected := map[string]interface{}{
+		"level":      "error",
+		"msg":        "something failed",
+		"request_id": "abc",
+		"error":      "boom",
+		"status":     float64(500),
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Errorf("Expected %s to be %v. Found %v", k, v, entry[k])
+		}
+	}
+	if entry["time"] == nil {
+		t.Error("Expected the entry to have a timestamp")
+	}
+	if !strings.HasSuffix(out.String(), "}\n") {
+		t.Error("Expected one entry per line")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{header: "abc-123_4.5", expected: "abc-123_4.5"},
+		{header: "", expected: ""},
+		{header: "abc\ninjected", expected: ""},
+		{header: strings.Repeat("a", 200), expected: ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(helpers.RequestIDHeader, test.header)
+		id := helpers.RequestID(req)
+		if test.expected != "" && id != test.expected {
+			t.Errorf("Expected request id %s to be kept. Found %s", test.expected, id)
+		}
+		if test.expected == "" && (id == test.header || len(id) != 32) {
+			t.Errorf("Expected a new request id instead of %q. Found %q", test.header, id)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package helpers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultLatencyBuckets are the upper bounds, in seconds, of the latency
+// histograms.
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20}
+
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+}
+
+func newHistogramVec(name, help string, labels ...string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: defaultLatencyBuckets}, labels)
+}
+
+// Upstreams the dashboard talks to, as used in the upstream metric labels.
+const (
+	UpstreamCFAPI       = "cf_api"
+	UpstreamUAA         = "uaa"
+	UpstreamLoggregator = "loggregator"
+	UpstreamOther       = "other"
+)
+
+// Metrics are the application metrics exposed at /metrics.
+var Metrics = struct {
+	HTTPRequests            *prometheus.CounterVec
+	HTTPRequestDuration     *prometheus.HistogramVec
+	UpstreamRequests        *prometheus.CounterVec
+	UpstreamRequestDuration *prometheus.HistogramVec
+	ProxyErrors             *prometheus.CounterVec
+	TokenRefreshes          *prometheus.CounterVec
+	SessionSaveFailures     *prometheus.CounterVec
+	Invites                 *prometheus.CounterVec
+	Emails                  *prometheus.CounterVec
+	RateLimited             *prometheus.CounterVec
+	CSPViolations           *prometheus.CounterVec
+}{
+	HTTPRequests: newCounterVec("dashboard_http_requests_total",
+		"Requests served, by route, method and status.", "route", "method", "status"),
+	HTTPRequestDuration: newHistogramVec("dashboard_http_request_duration_seconds",
+		"Time taken to serve requests, by route and method.", "route", "method"),
+	UpstreamRequests: newCounterVec("dashboard_upstream_requests_total",
+		"Requests sent to CF, UAA and loggregator, by upstream, method and status.", "upstream", "method", "status"),
+	UpstreamRequestDuration: newHistogramVec("dashboard_upstream_request_duration_seconds",
+		"Time taken by CF, UAA and loggregator to answer, by upstream.", "upstream"),
+	ProxyErrors: newCounterVec("dashboard_proxy_errors_total",
+		"Requests to CF, UAA and loggregator that got no response, by upstream.", "upstream"),
+	TokenRefreshes: newCounterVec("dashboard_token_refreshes_total",
+		"Access token refreshes, by result.", "result"),
+	SessionSaveFailures: newCounterVec("dashboard_session_save_failures_total",
+		"Sessions that could not be saved, by store type.", "store_type"),
+	Invites: newCounterVec("dashboard_invites_total",
+		"User invitations, by outcome.", "outcome"),
+	Emails: newCounterVec("dashboard_emails_total",
+		"E-mails sent, by template and result.", "template", "result"),
+	RateLimited: newCounterVec("dashboard_rate_limited_requests_total",
+		"Requests rejected for exceeding a rate limit, by budget.", "budget"),
+	CSPViolations: newCounterVec("dashboard_csp_violations_total",
+		"Content-Security-Policy violations reported by browsers, by directive.", "directive"),
+}
+
+// metricsRegistry holds the application metrics along with the Go runtime and
+// process metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		Metrics.HTTPRequests,
+		Metrics.HTTPRequestDuration,
+		Metrics.UpstreamRequests,
+		Metrics.UpstreamRequestDuration,
+		Metrics.ProxyErrors,
+		Metrics.TokenRefreshes,
+		Metrics.SessionSaveFailures,
+		Metrics.Invites,
+		Metrics.Emails,
+		Metrics.RateLimited,
+		Metrics.CSPViolations,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// Upstream returns which upstream a URL belongs to.
+func (s *Settings) Upstream(url string) string {
+	switch {
+	case s.ConsoleAPI != "" && strings.HasPrefix(url, s.ConsoleAPI):
+		return UpstreamCFAPI
+	case s.UaaURL != "" && strings.HasPrefix(url, s.UaaURL):
+		return UpstreamUAA
+	case s.LogURL != "" && strings.HasPrefix(url, s.LogURL):
+		return UpstreamLoggregator
+	}
+	return UpstreamOther
+}
+
+// MetricsHandler serves all the metrics, including whether the session store
+// of the settings is up, in the Prometheus exposition format.
+func (s *Settings) MetricsHandler() http.Handler {
+	sessionStore := prometheus.NewRegistry()
+	sessionStore.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "dashboard_session_store_up",
+		Help:        "Whether the session store is reachable.",
+		ConstLabels: prometheus.Labels{"store_type": s.SessionBackend},
+	}, func() float64 {
+		if s.SessionBackendHealthCheck != nil {
+			if ok, _ := s.SessionBackendHealthCheck(); ok {
+				return 1
+			}
+		}
+		return 0
+	}))
+	return promhttp.HandlerFor(prometheus.Gatherers{metricsRegistry, sessionStore}, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,51 @@
+package helpers_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	helpers.Metrics.UpstreamRequestDuration.WithLabelValues("test\"upstream").Observe(0.3)
+	helpers.Metrics.UpstreamRequestDuration.WithLabelValues("test\"upstream").Observe(3)
+	helpers.Metrics.TokenRefreshes.WithLabelValues("test").Inc()
+
+	settings := helpers.Settings{SessionBackend: "file"}
+	response := httptest.NewRecorder()
+	settings.MetricsHandler().ServeHTTP(response, httptest.NewRequest("GET", "/metrics", nil))
+	out := response.Body.String()
+	for _, expected := range []string{
+		`dashboard_upstream_request_duration_seconds_bucket{upstream="test\"upstream",le="0.25"} 0`,
+		`dashboard_upstream_request_duration_seconds_bucket{upstream="test\"upstream",le="0.5"} 1`,
+		`dashboard_upstream_request_duration_seconds_bucket{upstream="test\"upstream",le="5"} 2`,
+		`dashboard_upstream_request_duration_seconds_bucket{upstream="test\"upstream",le="+Inf"} 2`,
+		`dashboard_upstream_request_duration_seconds_sum{upstream="test\"upstream"} 3.3`,
+		`dashboard_upstream_request_duration_seconds_count{upstream="test\"upstream"} 2`,
+		`dashboard_token_refreshes_total{result="test"} 1`,
+		`dashboard_session_store_up{store_type="file"} 0`,
+		"# TYPE go_goroutines gauge",
+		"# TYPE process_open_fds gauge",
+	} {
+		if !strings.Contains(out, expected+"\n") {
+			t.Errorf("Expected metrics to contain %s. Found %s", expected, out)
+		}
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	settings := helpers.Settings{ConsoleAPI: "https://api.example.com", UaaURL: "https://uaa.example.com", LogURL: "https://log.example.com"}
+	tests := map[string]string{
+		"https://api.example.com/v2/info":     helpers.UpstreamCFAPI,
+		"https://uaa.example.com/userinfo":    helpers.UpstreamUAA,
+		"https://log.example.com/recent?app=": helpers.UpstreamLoggregator,
+		"https://elsewhere.example.com/":      helpers.UpstreamOther,
+	}
+	for url, expected := range tests {
+		if upstream := settings.Upstream(url); upstream != expected {
+			t.Errorf("Expected %s to be %s. Found %s", url, expected, upstream)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package helpers
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// tokenKeysTTL is how long the UAA token keys are cached before being
+	// fetched again.
+	tokenKeysTTL = time.Hour
+	// idTokenLeeway is the clock skew allowed when checking the ID token
+	// expiry.
+	idTokenLeeway = time.Minute
+)
+
+// UserIdentity is the verified identity of the logged in user, taken from the
+// OpenID Connect ID token and stored in the session.
+type UserIdentity struct {
+	UserID   string
+	UserName string
+	Email    string
+	Origin   string
+}
+
+// idTokenClaims are the claims of a UAA ID token.
+// https://docs.cloudfoundry.org/api/uaa/#openid-connect
+type idTokenClaims struct {
+	Issuer   string          `json:"iss"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+	Expiry   int64           `json:"exp"`
+	Nonce    string          `json:"nonce"`
+	UserID   string          `json:"user_id"`
+	UserName string          `json:"user_name"`
+	Email    string          `json:"email"`
+	Origin   string          `json:"origin"`
+}
+
+// hasAudience returns whether the ID token was issued for the client. The aud
+// claim is either a single string or an array of strings.
+func (c *idTokenClaims) hasAudience(clientID string) bool {
+	var audiences []string
+	if err := json.Unmarshal(c.Audience, &audiences); err != nil {
+		var audience string
+		if err := json.Unmarshal(c.Audience, &audience); err != nil {
+			return false
+		}
+		audiences = []string{audience}
+	}
+	for _, audience := range audiences {
+		if audience == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// NewPKCEVerifier generates a PKCE code verifier.
+// https://tools.ietf.org/html/rfc7636
+func NewPKCEVerifier() (string, error) {
+	b, err := GenerateRandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// PKCEChallenge returns the S256 code challenge for the code verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the URL of the UAA login page, asking for a code bound
+// to the PKCE code verifier and an ID token bound to the nonce.
+func (s *Settings) AuthCodeURL(state, verifier, nonce string) string {
+	return s.OAuthConfig.AuthCodeURL(state, oauth2.AccessTypeOnline,
+		oauth2.SetAuthURLParam("code_challenge", PKCEChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		oauth2.SetAuthURLParam("nonce", nonce))
+}
+
+// ExchangeCode exchanges the authorization code for a token, sending the PKCE
+// code verifier along. It is cancelled with ctx.
+func (s *Settings) ExchangeCode(ctx context.Context, code, verifier string) (*oauth2.Token, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.OAuthConfig.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", s.OAuthConfig.Endpoint.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.OAuthConfig.ClientID), url.QueryEscape(s.OAuthConfig.ClientSecret))
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Only keep the error code, UAA repeats the code in the description.
+		var tokenError struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &tokenError)
+		return nil, fmt.Errorf("cannot exchange code: %s: %s", resp.Status, tokenError.Error)
+	}
+	var tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return nil, err
+	}
+	if tokenResponse.AccessToken == "" {
+		return nil, errors.New("no access token in the token response")
+	}
+	var extra map[string]interface{}
+	json.Unmarshal(body, &extra)
+	token := &oauth2.Token{
+		AccessToken:  tokenResponse.AccessToken,
+		TokenType:    tokenResponse.TokenType,
+		RefreshToken: tokenResponse.RefreshToken,
+	}
+	if tokenResponse.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	}
+	return token.WithExtra(extra), nil
+}
+
+// httpClient returns the client to talk to UAA with, outside of the oauth2
+// clients.
+func (s *Settings) httpClient() *http.Client {
+	// Prevents lingering goroutines from living forever.
+	return &http.Client{Transport: s.upstreamTransport(), Timeout: TimeoutConstant}
+}
+
+// IDTokenVerifier validates the ID tokens issued by UAA against the keys
+// published at its JWKS endpoint. The issuer and the JWKS endpoint are read
+// from the OpenID Connect discovery document of UAA.
+type IDTokenVerifier struct {
+	discoveryURL string
+	clientID     string
+	client       func() *http.Client
+
+	mu sync.Mutex
+	// issuer and keysURL are empty until discovered.
+	issuer    string
+	keysURL   string
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// fetch is the fetch of the keys in flight, if any. Logins needing the
+	// keys wait for it rather than each asking UAA.
+	fetch *keysFetch
+}
+
+// keysFetch is an in flight discovery and fetch of the token keys.
+type keysFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// NewIDTokenVerifier creates a verifier for the ID tokens that the UAA at
+// uaaURL issues to the client.
+func NewIDTokenVerifier(uaaURL, clientID string, client func() *http.Client) *IDTokenVerifier {
+	return &IDTokenVerifier{
+		discoveryURL: uaaURL + "/.well-known/openid-configuration",
+		clientID:     clientID,
+		client:       client,
+	}
+}
+
+// discover reads the issuer and the JWKS endpoint from UAA.
+// https://docs.cloudfoundry.org/api/uaa/#openid-connect
+func (v *IDTokenVerifier) discover(ctx context.Context) (issuer, keysURL string, err error) {
+	var config struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.get(ctx, v.discoveryURL, "openid configuration", &config); err != nil {
+		return "", "", err
+	}
+	if config.Issuer == "" || config.JWKSURI == "" {
+		return "", "", errors.New("openid configuration has no issuer or jwks_uri")
+	}
+	return config.Issuer, config.JWKSURI, nil
+}
+
+// get decodes the JSON document that UAA serves at docURL into doc. name
+// describes the document in errors.
+func (v *IDTokenVerifier) get(ctx context.Context, docURL, name string, doc interface{}) error {
+	req, err := http.NewRequest("GET", docURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot get %s: %s", name, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(doc)
+}
+
+// Verify checks the signature and claims of the ID token, including that it
+// carries the nonce sent when starting the login, and returns the identity of
+// the user. ctx cancels the wait for the token keys when they must be fetched.
+func (v *IDTokenVerifier) Verify(ctx context.Context, rawIDToken, nonce string) (*UserIdentity, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("id token is not a JWT")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("unsupported id token algorithm: %s", header.Algorithm)
+	}
+	key, issuer, err := v.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature); err != nil {
+		return nil, errors.New("invalid id token signature")
+	}
+
+	var claims idTokenClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != issuer {
+		return nil, fmt.Errorf("unexpected id token issuer: %s", claims.Issuer)
+	}
+	if !claims.hasAudience(v.clientID) {
+		return nil, errors.New("id token was not issued for this client")
+	}
+	if time.Unix(claims.Expiry, 0).Add(idTokenLeeway).Before(time.Now()) {
+		return nil, errors.New("id token has expired")
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("id token nonce does not match")
+	}
+	userID := claims.UserID
+	if userID == "" {
+		userID = claims.Subject
+	}
+	return &UserIdentity{
+		UserID:   userID,
+		UserName: claims.UserName,
+		Email:    claims.Email,
+		Origin:   claims.Origin,
+	}, nil
+}
+
+// key returns the public key with the given key ID, fetching the keys from UAA
+// when they are stale or when the key is unknown, as keys get rotated. ID
+// tokens only ever come from the UAA token endpoint, so unknown keys can't be
+// used to make us hammer UAA. It also returns the issuer of the ID tokens.
+func (v *IDTokenVerifier) key(ctx context.Context, keyID string) (*rsa.PublicKey, string, error) {
+	v.mu.Lock()
+	key, ok := v.keys[keyID]
+	issuer := v.issuer
+	if ok && time.Since(v.fetchedAt) < tokenKeysTTL {
+		v.mu.Unlock()
+		return key, issuer, nil
+	}
+	fetch := v.fetch
+	if fetch == nil {
+		fetch = &keysFetch{done: make(chan struct{})}
+		v.fetch = fetch
+		go v.fetchKeys(fetch)
+	}
+	v.mu.Unlock()
+
+	select {
+	case <-fetch.done:
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	}
+	if fetch.err != nil {
+		if ok {
+			// Better use the key we know than fail while UAA is unreachable.
+			return key, issuer, nil
+		}
+		return nil, "", fetch.err
+	}
+	v.mu.Lock()
+	key, ok = v.keys[keyID]
+	issuer = v.issuer
+	v.mu.Unlock()
+	if !ok {
+		return nil, "", fmt.Errorf("unknown id token key: %s", keyID)
+	}
+	return key, issuer, nil
+}
+
+// fetchKeys discovers UAA if needed and gets its token keys, without holding
+// mu, then swaps them in. The fetch is shared by all the logins waiting for
+// it, so it isn't cancelled with any one of them.
+func (v *IDTokenVerifier) fetchKeys(fetch *keysFetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), TimeoutConstant)
+	defer cancel()
+
+	v.mu.Lock()
+	issuer, keysURL := v.issuer, v.keysURL
+	v.mu.Unlock()
+	var err error
+	if issuer == "" {
+		issuer, keysURL, err = v.discover(ctx)
+	}
+	var keys map[string]*rsa.PublicKey
+	if err == nil {
+		keys, err = v.getKeys(ctx, keysURL)
+	}
+
+	v.mu.Lock()
+	if err == nil {
+		v.issuer, v.keysURL = issuer, keysURL
+		v.keys = keys
+		v.fetchedAt = time.Now()
+	}
+	fetch.err = err
+	v.fetch = nil
+	v.mu.Unlock()
+	close(fetch.done)
+}
+
+// getKeys gets the RSA token keys from UAA.
+// https://docs.cloudfoundry.org/api/uaa/#token-keys
+func (v *IDTokenVerifier) getKeys(ctx context.Context, keysURL string) (map[string]*rsa.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := v.get(ctx, keysURL, "token keys", &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.N, "="))
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jwk.E, "="))
+		if err != nil {
+			return nil, err
+		}
+		keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA token keys found")
+	}
+	return keys, nil
+}
+
+// decodeJWTPart decodes the header or payload of a JWT.
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,202 @@
+package helpers_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/18F/cg-dashboard/helpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers"
+)
+
+func TestPKCEChallenge(t *testing.T) {
+	// Example from https://tools.ietf.org/html/rfc7636#appendix-B
+	challenge := helpers.PKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("Unexpected code challenge %s", challenge)
+	}
+}
+
+func TestIDTokenVerifier(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var uaaServer *httptest.Server
+	uaaServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			// The issuer is not necessarily the URL of UAA.
+			fmt.Fprint(w, testhelpers.NewTestOpenIDConfiguration("https://uaa.example.com/oauth/token", uaaServer.URL+"/keys"))
+			return
+		}
+		fmt.Fprint(w, testhelpers.NewTestTokenKeys(key, "key-1"))
+	}))
+	defer uaaServer.Close()
+	verifier := helpers.NewIDTokenVerifier(uaaServer.URL, "client", func() *http.Client { return http.DefaultClient })
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":       "https://uaa.example.com/oauth/token",
+			"aud":       []string{"client"},
+			"exp":       time.Now().Add(time.Hour).Unix(),
+			"nonce":     "nonce",
+			"sub":       "user-guid",
+			"user_id":   "user-guid",
+			"user_name": "user",
+			"email":     "user@example.com",
+			"origin":    "uaa",
+		}
+	}
+	tests := []struct {
+		testName string
+		modify   func(claims map[string]interface{})
+		key      *rsa.PrivateKey
+		keyID    string
+		valid    bool
+	}{
+		{testName: "Valid id token", key: key, keyID: "key-1", valid: true},
+		{testName: "Single audience", modify: func(c map[string]interface{}) { c["aud"] = "client" }, key: key, keyID: "key-1", valid: true},
+		{testName: "Wrong audience", modify: func(c map[string]interface{}) { c["aud"] = []string{"other"} }, key: key, keyID: "key-1"},
+		{testName: "Wrong issuer", modify: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com/oauth/token" }, key: key, keyID: "key-1"},
+		{testName: "Issuer from the UAA URL", modify: func(c map[string]interface{}) { c["iss"] = uaaServer.URL + "/oauth/token" }, key: key, keyID: "key-1"},
+		{testName: "Expired", modify: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, key: key, keyID: "key-1"},
+		{testName: "Wrong nonce", modify: func(c map[string]interface{}) { c["nonce"] = "other" }, key: key, keyID: "key-1"},
+		{testName: "Wrong key", key: otherKey, keyID: "key-1"},
+		{testName: "Unknown key", key: key, keyID: "key-2"},
+	}
+	for _, test := range tests {
+		claims := validClaims()
+		if test.modify != nil {
+			test.modify(claims)
+		}
+		identity, err := verifier.Verify(context.Background(), testhelpers.NewTestSignedJWT(test.key, test.keyID, claims), "nonce")
+		if test.valid {
+			if err != nil {
+				t.Errorf("Test %s: unexpected error %s", test.testName, err)
+				continue
+			}
+			expected := helpers.UserIdentity{UserID: "user-guid", UserName: "user", Email: "user@example.com", Origin: "uaa"}
+			if *identity != expected {
+				t.Errorf("Test %s: expected %+v. Found %+v", test.testName, expected, *identity)
+			}
+		} else if err == nil {
+			t.Errorf("Test %s: expected the id token to be rejected", test.testName)
+		}
+	}
+
+	// Unsigned tokens are rejected.
+	if _, err := verifier.Verify(context.Background(), testhelpers.NewTestJWT(validClaims()), "nonce"); err == nil {
+		t.Error("Expected an unsigned id token to be rejected")
+	}
+
+	// Without the discovery document, the issuer is unknown.
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	verifier = helpers.NewIDTokenVerifier(notFound.URL, "client", func() *http.Client { return http.DefaultClient })
+	if _, err := verifier.Verify(context.Background(), testhelpers.NewTestSignedJWT(key, "key-1", validClaims()), "nonce"); err == nil {
+		t.Error("Expected the id token to be rejected without the openid configuration")
+	}
+}
+
+func TestIDTokenVerifierKeyRotation(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var rotated int32
+	var fetches int32
+	var uaaServer *httptest.Server
+	uaaServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			fmt.Fprint(w, testhelpers.NewTestOpenIDConfiguration(uaaServer.URL+"/oauth/token", uaaServer.URL+"/token_keys"))
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&rotated) == 1 {
+			fmt.Fprint(w, testhelpers.NewTestTokenKeys(newKey, "new-key"))
+			return
+		}
+		fmt.Fprint(w, testhelpers.NewTestTokenKeys(oldKey, "old-key"))
+	}))
+	defer uaaServer.Close()
+	verifier := helpers.NewIDTokenVerifier(uaaServer.URL, "client", func() *http.Client { return http.DefaultClient })
+	claims := map[string]interface{}{
+		"iss":   uaaServer.URL + "/oauth/token",
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "nonce",
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := verifier.Verify(context.Background(), testhelpers.NewTestSignedJWT(oldKey, "old-key", claims), "nonce"); err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Expected the token keys to be cached. Fetched %d times", fetches)
+	}
+
+	// UAA starts signing with a new key.
+	atomic.StoreInt32(&rotated, 1)
+	if _, err := verifier.Verify(context.Background(), testhelpers.NewTestSignedJWT(newKey, "new-key", claims), "nonce"); err != nil {
+		t.Errorf("Expected the new key to be fetched. Found error %s", err)
+	}
+}
+
+func TestIDTokenVerifierSlowUAA(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	release := make(chan struct{})
+	var fetches int32
+	var uaaServer *httptest.Server
+	uaaServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.well-known/openid-configuration" {
+			fmt.Fprint(w, testhelpers.NewTestOpenIDConfiguration(uaaServer.URL+"/oauth/token", uaaServer.URL+"/token_keys"))
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		fmt.Fprint(w, testhelpers.NewTestTokenKeys(key, "key-1"))
+	}))
+	defer uaaServer.Close()
+	verifier := helpers.NewIDTokenVerifier(uaaServer.URL, "client", func() *http.Client { return http.DefaultClient })
+	idToken := testhelpers.NewTestSignedJWT(key, "key-1", map[string]interface{}{
+		"iss":   uaaServer.URL + "/oauth/token",
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "nonce",
+	})
+
+	// A login that gives up doesn't wait for UAA.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := verifier.Verify(ctx, idToken, "nonce"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the verification to stop with the request. Found %v", err)
+	}
+
+	// Logins waiting for the keys share the fetch in flight.
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := verifier.Verify(context.Background(), idToken, "nonce")
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected error %s", err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("Expected the token keys to be fetched once. Fetched %d times", n)
+	}
+}
@@ -0,0 +1,139 @@
+package helpers
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultProxyRules allow the CF API requests made by the dashboard UI. The
+// others are denied.
+const defaultProxyRules = `
+allow GET,HEAD /v2/{apps,organizations,private_domains,quota_definitions,routes,service_bindings,service_instances,service_plans,services,shared_domains,space_quota_definitions,spaces,users}/**
+allow PUT /v2/apps/*
+allow POST /v2/apps/*/restage
+allow DELETE /v2/apps/*/routes/*
+allow PUT,DELETE /v2/organizations/*/{users,managers,billing_managers,auditors}/*
+allow PUT,DELETE /v2/spaces/*/{developers,managers,auditors}/*
+allow POST /v2/{routes,service_bindings,service_instances,users}
+allow PUT,DELETE /v2/routes/*
+allow PUT /v2/routes/*/apps/*
+allow DELETE /v2/{service_bindings,service_instances}/*
+`
+
+// ProxyRule allows or denies the requests with one of the methods to the
+// paths matching the pattern. In patterns, "*" matches a path segment, "**" at
+// the end matches any remaining segments and "{a,b}" matches one of the
+// listed segments.
+type ProxyRule struct {
+	Allow bool
+	// Methods are the methods the rule applies to. Empty means all of them.
+	Methods []string
+	Pattern string
+}
+
+// matches returns whether the rule applies to the request.
+func (r ProxyRule) matches(method, requestPath string) bool {
+	if len(r.Methods) > 0 {
+		found := false
+		for _, m := range r.Methods {
+			if m == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return matchPathPattern(strings.Split(strings.Trim(r.Pattern, "/"), "/"),
+		strings.Split(strings.Trim(requestPath, "/"), "/"))
+}
+
+func matchPathPattern(pattern, segments []string) bool {
+	for i, p := range pattern {
+		if p == "**" {
+			return true
+		}
+		if i >= len(segments) || !matchPathSegment(p, segments[i]) {
+			return false
+		}
+	}
+	return len(pattern) == len(segments)
+}
+
+func matchPathSegment(pattern, segment string) bool {
+	if pattern == "*" {
+		return segment != ""
+	}
+	if strings.HasPrefix(pattern, "{") && strings.HasSuffix(pattern, "}") {
+		for _, alternative := range strings.Split(pattern[1:len(pattern)-1], ",") {
+			if alternative == segment {
+				return true
+			}
+		}
+		return false
+	}
+	return pattern == segment
+}
+
+// ProxyPolicy decides which requests can be proxied to the CF API, so that a
+// session can't be used for anything the dashboard doesn't do.
+type ProxyPolicy struct {
+	rules []ProxyRule
+}
+
+// NewProxyPolicy creates the policy made of the rules, followed by the
+// default rules. The first rule matching a request applies, and requests
+// matching no rule are denied.
+func NewProxyPolicy(rules string) (*ProxyPolicy, error) {
+	configured, err := ParseProxyRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := ParseProxyRules(defaultProxyRules)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyPolicy{rules: append(configured, defaults...)}, nil
+}
+
+// ParseProxyRules parses the rules separated by semicolons or new lines, such
+// as "deny DELETE /v2/apps/*; allow GET /v2/buildpacks/**". The methods are
+// comma separated, "*" meaning all of them.
+func ParseProxyRules(value string) ([]ProxyRule, error) {
+	var rules []ProxyRule
+	for _, line := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 || fields[0] != "allow" && fields[0] != "deny" || !strings.HasPrefix(fields[2], "/") {
+			return nil, fmt.Errorf("invalid proxy rule: %s", strings.TrimSpace(line))
+		}
+		rule := ProxyRule{Allow: fields[0] == "allow", Pattern: fields[2]}
+		if fields[1] != "*" {
+			rule.Methods = strings.Split(strings.ToUpper(fields[1]), ",")
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Allowed returns whether the request can be proxied. Paths which are not
+// canonical, such as with ".." or "//", are denied so they can't be used to
+// get around the rules. A nil policy allows everything.
+func (p *ProxyPolicy) Allowed(method, requestPath string) bool {
+	if p == nil {
+		return true
+	}
+	if path.Clean(requestPath) != requestPath {
+		return false
+	}
+	for _, rule := range p.rules {
+		if rule.matches(method, requestPath) {
+			return rule.Allow
+		}
+	}
+	return false
+}
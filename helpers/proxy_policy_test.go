@@ -0,0 +1,62 @@
+package helpers_test
+
+import (
+	"testing"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+func TestProxyPolicy(t *testing.T) {
+	policy, err := helpers.NewProxyPolicy("deny PUT /v2/apps/*\n allow * /v2/buildpacks/**")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	tests := []struct {
+		method   string
+		path     string
+		expected bool
+	}{
+		{"GET", "/v2/organizations", true},
+		{"GET", "/v2/organizations/org-guid/user_roles", true},
+		{"HEAD", "/v2/spaces/space-guid/summary", true},
+		{"POST", "/v2/apps/app-guid/restage", true},
+		{"PUT", "/v2/spaces/space-guid/developers/user-guid", true},
+		{"PUT", "/v2/spaces/space-guid/developers/", false},
+		{"PUT", "/v2/spaces/space-guid/billing_managers/user-guid", false},
+		{"POST", "/v2/service_instances", true},
+		{"POST", "/v2/service_instances/instance-guid", false},
+		{"DELETE", "/v2/service_instances/instance-guid", true},
+		{"PUT", "/v2/apps/app-guid", false},
+		{"DELETE", "/v2/buildpacks/buildpack-guid", true},
+		{"GET", "/v2/config/feature_flags", false},
+		{"GET", "/v2/security_groups", false},
+		{"GET", "/v2/apps/../config/feature_flags", false},
+		{"GET", "/v2//config/feature_flags", false},
+	}
+	for _, test := range tests {
+		if allowed := policy.Allowed(test.method, test.path); allowed != test.expected {
+			t.Errorf("%s %s: expected %v. Found %v", test.method, test.path, test.expected, allowed)
+		}
+	}
+
+	var disabled *helpers.ProxyPolicy
+	if !disabled.Allowed("DELETE", "/v2/organizations/org-guid") {
+		t.Error("Expected a nil policy to allow everything")
+	}
+}
+
+func TestParseProxyRules(t *testing.T) {
+	rules, err := helpers.ParseProxyRules("allow get,head /v2/buildpacks/**; deny * /v2/apps/*;")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if len(rules) != 2 || !rules[0].Allow || len(rules[0].Methods) != 2 || rules[0].Methods[1] != "HEAD" ||
+		rules[1].Allow || rules[1].Methods != nil || rules[1].Pattern != "/v2/apps/*" {
+		t.Errorf("Unexpected rules %+v", rules)
+	}
+	for _, invalid := range []string{"permit GET /v2/apps", "allow GET", "allow GET v2/apps", "allow GET /v2/apps extra"} {
+		if _, err := helpers.ParseProxyRules(invalid); err == nil {
+			t.Errorf("Expected an error with %q", invalid)
+		}
+	}
+}
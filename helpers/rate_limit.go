@@ -0,0 +1,270 @@
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Rate limit budgets. Each budget is counted separately.
+const (
+	// RateLimitInvite counts the user invitations, which send e-mails.
+	RateLimitInvite = "invite"
+	// RateLimitPrivileged counts the calls made with the credentials of the
+	// dashboard rather than those of the user.
+	RateLimitPrivileged = "privileged"
+	// RateLimitAPI counts the requests proxied to CF, UAA and loggregator.
+	RateLimitAPI = "api"
+	// RateLimitCSPReport counts the CSP violation reports, which anyone can
+	// send.
+	RateLimitCSPReport = "csp_report"
+)
+
+// redisRateLimitKeyPrefix is the prefix of the keys holding the rate limit
+// counters in redis.
+const redisRateLimitKeyPrefix = "rate_limit_"
+
+// RateLimit allows a number of requests per window of time.
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// defaultRateLimits are the budgets when not configured.
+var defaultRateLimits = map[string]RateLimit{
+	RateLimitInvite:     {Requests: 20, Window: time.Hour},
+	RateLimitPrivileged: {Requests: 100, Window: time.Hour},
+	RateLimitAPI:        {Requests: 600, Window: time.Minute},
+	RateLimitCSPReport:  {Requests: 60, Window: time.Minute},
+}
+
+// RateLimitResult tells whether a request is allowed and how much of the
+// budget is left.
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the budget is renewed.
+	Reset time.Duration
+}
+
+// RateLimiter counts the requests made with a key, such as a user ID or a
+// client IP, in fixed windows of time.
+type RateLimiter interface {
+	// Allow counts the cost of a request made with the key, in requests, and
+	// tells whether it is within the limit. Denied requests are not counted,
+	// so that retrying doesn't push the budget further away.
+	Allow(key string, limit RateLimit, cost int) (RateLimitResult, error)
+	// Refund gives back the cost of requests that were counted but not made,
+	// within the current window.
+	Refund(key string, cost int) error
+}
+
+// newRateLimitResult computes the result of the count-th request of a window.
+func newRateLimitResult(count int, limit RateLimit, reset time.Duration) RateLimitResult {
+	remaining := limit.Requests - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	return RateLimitResult{
+		Allowed:   count <= limit.Requests,
+		Limit:     limit.Requests,
+		Remaining: remaining,
+		Reset:     reset,
+	}
+}
+
+// rateLimitWindow is the count of requests of a key in the current window.
+type rateLimitWindow struct {
+	count   int
+	expires time.Time
+}
+
+// memoryRateLimiter is a RateLimiter for a single instance, used when the
+// session backend is not redis.
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	windows   map[string]*rateLimitWindow
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimiter creates a RateLimiter keeping the counters in memory.
+func NewMemoryRateLimiter() RateLimiter {
+	return &memoryRateLimiter{windows: make(map[string]*rateLimitWindow)}
+}
+
+func (l *memoryRateLimiter) Allow(key string, limit RateLimit, cost int) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		// Forget the keys that are not used anymore.
+		for k, w := range l.windows {
+			if now.After(w.expires) {
+				delete(l.windows, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	w, ok := l.windows[key]
+	if !ok || now.After(w.expires) {
+		w = &rateLimitWindow{expires: now.Add(limit.Window)}
+		l.windows[key] = w
+	}
+	if w.count+cost > limit.Requests {
+		return newRateLimitResult(w.count+cost, limit, w.expires.Sub(now)), nil
+	}
+	w.count += cost
+	return newRateLimitResult(w.count, limit, w.expires.Sub(now)), nil
+}
+
+func (l *memoryRateLimiter) Refund(key string, cost int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w, ok := l.windows[key]; ok && time.Now().Before(w.expires) {
+		w.count -= cost
+		if w.count < 0 {
+			w.count = 0
+		}
+	}
+	return nil
+}
+
+// redisRateLimitScript adds the cost to the counter of the key, starting a
+// window if it is new, unless it would go over the limit. It returns the count
+// including the cost and the milliseconds left in the window.
+var redisRateLimitScript = redis.NewScript(1, `
+local cost = tonumber(ARGV[2])
+local count = tonumber(redis.call("GET", KEYS[1]) or "0") + cost
+if count > tonumber(ARGV[3]) then
+	return {count, redis.call("PTTL", KEYS[1])}
+end
+count = redis.call("INCRBY", KEYS[1], cost)
+if count == cost then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+// redisRateLimitRefundScript takes the cost off the counter of the key, if its
+// window is still open, without going under zero.
+var redisRateLimitRefundScript = redis.NewScript(1, `
+local count = tonumber(redis.call("GET", KEYS[1]) or "0")
+if count > 0 then
+	redis.call("DECRBY", KEYS[1], math.min(count, tonumber(ARGV[1])))
+end
+return 0
+`)
+
+// redisRateLimiter is a RateLimiter shared by all the instances, used with
+// the redis session backend.
+type redisRateLimiter struct {
+	pool *redis.Pool
+}
+
+func newRedisRateLimiter(pool *redis.Pool) *redisRateLimiter {
+	return &redisRateLimiter{pool: pool}
+}
+
+func (l *redisRateLimiter) Allow(key string, limit RateLimit, cost int) (RateLimitResult, error) {
+	c := l.pool.Get()
+	defer c.Close()
+	values, err := redis.Ints(redisRateLimitScript.Do(c, redisRateLimitKeyPrefix+key, int64(limit.Window/time.Millisecond), cost, limit.Requests))
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(values) != 2 {
+		return RateLimitResult{}, fmt.Errorf("unexpected rate limit script result: %v", values)
+	}
+	reset := time.Duration(values[1]) * time.Millisecond
+	if reset < 0 {
+		reset = limit.Window
+	}
+	return newRateLimitResult(values[0], limit, reset), nil
+}
+
+func (l *redisRateLimiter) Refund(key string, cost int) error {
+	c := l.pool.Get()
+	defer c.Close()
+	_, err := redisRateLimitRefundScript.Do(c, redisRateLimitKeyPrefix+key, cost)
+	return err
+}
+
+// parseRateLimits overrides the default budgets with the comma separated
+// budget=requests/window pairs, such as "invite=10/1h,api=0". Zero requests
+// disables the limit.
+func parseRateLimits(value string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit, len(defaultRateLimits))
+	for budget, limit := range defaultRateLimits {
+		limits[budget] = limit
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		budget := strings.TrimSpace(kv[0])
+		if _, ok := defaultRateLimits[budget]; !ok || len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rate limit: %s", pair)
+		}
+		if strings.TrimSpace(kv[1]) == "0" {
+			delete(limits, budget)
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(kv[1]), "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid rate limit: %s", pair)
+		}
+		requests, err := strconv.Atoi(parts[0])
+		if err != nil || requests <= 0 {
+			return nil, fmt.Errorf("invalid rate limit: %s", pair)
+		}
+		window, err := time.ParseDuration(parts[1])
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid rate limit: %s", pair)
+		}
+		limits[budget] = RateLimit{Requests: requests, Window: window}
+	}
+	return limits, nil
+}
+
+// rateLimitKey is the key the budget is counted with: the user when known, so
+// that users behind the same NAT or proxy don't share it, or else the client
+// IP.
+func rateLimitKey(budget, userID, clientIP string) string {
+	if userID != "" {
+		return budget + ":user:" + userID
+	}
+	return budget + ":ip:" + clientIP
+}
+
+// AllowRequest counts the cost of a request, in requests, against the budget
+// of the user, or of the client IP for anonymous requests. The request is
+// allowed if the budget is not limited or if the counters can't be reached.
+func (s *Settings) AllowRequest(budget, userID, clientIP string, cost int) (RateLimitResult, bool) {
+	limit, ok := s.RateLimits[budget]
+	if !ok || s.RateLimiter == nil {
+		return RateLimitResult{Allowed: true}, false
+	}
+	result, err := s.RateLimiter.Allow(rateLimitKey(budget, userID, clientIP), limit, cost)
+	if err != nil {
+		Log.Error("unable to check the rate limit", Fields{"error": err, "budget": budget})
+		return RateLimitResult{Allowed: true, Limit: limit.Requests, Remaining: limit.Requests}, true
+	}
+	return result, true
+}
+
+// RefundRequest gives back to the budget the cost of requests that were
+// allowed by AllowRequest but not made.
+func (s *Settings) RefundRequest(budget, userID, clientIP string, cost int) {
+	if _, ok := s.RateLimits[budget]; !ok || s.RateLimiter == nil || cost <= 0 {
+		return
+	}
+	if err := s.RateLimiter.Refund(rateLimitKey(budget, userID, clientIP), cost); err != nil {
+		Log.Error("unable to refund the rate limit", Fields{"error": err, "budget": budget})
+	}
+}
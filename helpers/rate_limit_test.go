@@ -0,0 +1,128 @@
+package helpers_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+
+	"github.com/18F/cg-dashboard/helpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers/docker"
+)
+
+func testRateLimiter(t *testing.T, limiter helpers.RateLimiter) {
+	limit := helpers.RateLimit{Requests: 2, Window: 200 * time.Millisecond}
+	for i, expected := range []bool{true, true, false} {
+		result, err := limiter.Allow("test:user:1", limit, 1)
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err)
+		}
+		if result.Allowed != expected || result.Limit != 2 || result.Remaining != 1-i && result.Remaining != 0 {
+			t.Errorf("Request %d: unexpected result %+v", i, result)
+		}
+		if result.Reset <= 0 || result.Reset > limit.Window {
+			t.Errorf("Request %d: unexpected reset %s", i, result.Reset)
+		}
+	}
+	// Other keys have their own budget.
+	if result, _ := limiter.Allow("test:user:2", limit, 1); !result.Allowed {
+		t.Error("Expected another key to be allowed")
+	}
+
+	// Denied requests are not counted, so a cheaper one still fits.
+	if result, _ := limiter.Allow("test:user:2", limit, 2); result.Allowed {
+		t.Error("Expected a request over the limit to be denied")
+	}
+	if result, _ := limiter.Allow("test:user:2", limit, 1); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected the denied request not to be counted. Found %+v", result)
+	}
+
+	// Refunded requests can be made again.
+	if err := limiter.Refund("test:user:2", 1); err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	if result, _ := limiter.Allow("test:user:2", limit, 1); !result.Allowed {
+		t.Errorf("Expected the refunded request to be allowed. Found %+v", result)
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	limiter := helpers.NewMemoryRateLimiter()
+	testRateLimiter(t, limiter)
+
+	// The budget is renewed with the next window.
+	time.Sleep(250 * time.Millisecond)
+	limit := helpers.RateLimit{Requests: 2, Window: 200 * time.Millisecond}
+	if result, _ := limiter.Allow("test:user:1", limit, 1); !result.Allowed || result.Remaining != 1 {
+		t.Errorf("Expected the budget to be renewed. Found %+v", result)
+	}
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	redisURI, cleanUpRedis, _, _ := docker.CreateTestRedis()
+	defer cleanUpRedis()
+	envVars := testhelpers.GetMockCompleteEnvVars()
+	envVars[helpers.SessionBackendEnvVar] = "redis"
+	envVars[helpers.RedisURIEnvVar] = redisURI
+	env, _ := cfenv.Current()
+	s := helpers.Settings{}
+	if err := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err != nil {
+		t.Fatal(err)
+	}
+	testRateLimiter(t, s.RateLimiter)
+}
+
+func TestAllowRequest(t *testing.T) {
+	env, _ := cfenv.Current()
+	envVars := testhelpers.GetMockCompleteEnvVars()
+	envVars[helpers.RateLimitsEnvVar] = "invite=2/1h, api=0"
+	s := helpers.Settings{}
+	if err := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, limited := s.AllowRequest(helpers.RateLimitAPI, "user", "10.0.0.1", 1); limited {
+		t.Error("Expected the api budget to be disabled")
+	}
+	if _, limited := s.AllowRequest(helpers.RateLimitPrivileged, "user", "10.0.0.1", 1); !limited {
+		t.Error("Expected the privileged budget to keep its default")
+	}
+
+	// Users are limited wherever they come from, and don't share the budget
+	// of their client IP. Anonymous requests are limited per client IP.
+	tests := []struct {
+		userID    string
+		clientIP  string
+		allowed   bool
+		remaining int
+	}{
+		{"user", "10.0.0.1", true, 1},
+		{"other-user", "10.0.0.1", true, 1},
+		{"third-user", "10.0.0.1", true, 1},
+		{"user", "10.0.0.2", true, 0},
+		{"user", "10.0.0.3", false, 0},
+		{"", "10.0.0.1", true, 1},
+		{"", "10.0.0.1", true, 0},
+		{"", "10.0.0.1", false, 0},
+	}
+	for i, test := range tests {
+		result, _ := s.AllowRequest(helpers.RateLimitInvite, test.userID, test.clientIP, 1)
+		if result.Allowed != test.allowed || result.Remaining != test.remaining {
+			t.Errorf("Request %d: expected allowed %t with %d remaining. Found %+v", i, test.allowed, test.remaining, result)
+		}
+	}
+
+	// Refunds give the budget back.
+	s.RefundRequest(helpers.RateLimitInvite, "user", "10.0.0.3", 1)
+	if result, _ := s.AllowRequest(helpers.RateLimitInvite, "user", "10.0.0.3", 1); !result.Allowed {
+		t.Errorf("Expected the refunded invite to be allowed. Found %+v", result)
+	}
+
+	for _, invalid := range []string{"emails=1/1h", "invite", "invite=1", "invite=0/1h", "invite=1/soon"} {
+		envVars[helpers.RateLimitsEnvVar] = invalid
+		if err := (&helpers.Settings{}).InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err == nil {
+			t.Errorf("Expected an error with rate limits %q", invalid)
+		}
+	}
+}
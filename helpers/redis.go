@@ -0,0 +1,304 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/garyburd/redigo/redis"
+)
+
+// redisSettings holds everything needed to connect to the redis session
+// backend.
+type redisSettings struct {
+	// address of the redis server. Unused when sentinels are configured.
+	address  string
+	password string
+	// useTLS is set for rediss:// URIs.
+	useTLS    bool
+	tlsConfig *tls.Config
+	// sentinelTLSConfig verifies the sentinels against their own addresses,
+	// while tlsConfig verifies the masters they report against the name of
+	// the redis URI, as those are usually IPs.
+	sentinelTLSConfig *tls.Config
+	// sentinelAddrs and sentinelMaster are set when the master should be
+	// discovered through redis sentinel.
+	sentinelAddrs    []string
+	sentinelMaster   string
+	sentinelPassword string
+}
+
+// redisTimeout is how long connecting to a redis node, sending it a command or
+// reading its answer can take.
+const redisTimeout = 3 * time.Second
+
+// dialOptions returns the options to use when connecting to a redis data node.
+func (r *redisSettings) dialOptions() []redis.DialOption {
+	return r.dialOptionsWithTLS(r.tlsConfig)
+}
+
+// sentinelDialOptions returns the options to use when connecting to a redis
+// sentinel.
+func (r *redisSettings) sentinelDialOptions() []redis.DialOption {
+	return r.dialOptionsWithTLS(r.sentinelTLSConfig)
+}
+
+func (r *redisSettings) dialOptionsWithTLS(tlsConfig *tls.Config) []redis.DialOption {
+	// We need to control how long connections are attempted and how long
+	// redis has to answer. Commands don't follow the deadlines of the
+	// requests, so the limit is well under the route timeouts, even for the
+	// few commands a request sends.
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(redisTimeout),
+		redis.DialWriteTimeout(redisTimeout),
+		redis.DialReadTimeout(redisTimeout),
+	}
+	if r.useTLS {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig))
+	}
+	return options
+}
+
+// redisSentinel discovers the current master of a redis deployment by asking
+// its sentinels.
+type redisSentinel struct {
+	masterName  string
+	password    string
+	dialOptions []redis.DialOption
+
+	mu    sync.Mutex
+	addrs []string
+	// master is the address of the last master that was discovered.
+	master string
+}
+
+// masterAddr asks each sentinel in turn for the address of the master. The
+// first sentinel to answer is moved to the front of the list so it is asked
+// first next time.
+func (s *redisSentinel) masterAddr() (string, error) {
+	s.mu.Lock()
+	addrs := make([]string, len(s.addrs))
+	copy(addrs, s.addrs)
+	s.mu.Unlock()
+
+	lastErr := errors.New("no sentinels configured")
+	for i, addr := range addrs {
+		master, err := s.askSentinel(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.mu.Lock()
+		s.addrs[0], s.addrs[i] = s.addrs[i], s.addrs[0]
+		if s.master != master {
+			Log.Info("redis sentinel master changed", Fields{"redis_master": master})
+		}
+		s.master = master
+		s.mu.Unlock()
+		return master, nil
+	}
+	return "", fmt.Errorf("unable to find redis master %s: %s", s.masterName, lastErr)
+}
+
+func (s *redisSentinel) askSentinel(addr string) (string, error) {
+	c, err := redis.Dial("tcp", addr, s.dialOptions...)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	if s.password != "" {
+		if _, err = c.Do("AUTH", s.password); err != nil {
+			return "", err
+		}
+	}
+	res, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err != nil {
+		return "", err
+	}
+	if len(res) != 2 {
+		return "", fmt.Errorf("sentinel %s does not know master %s", addr, s.masterName)
+	}
+	return net.JoinHostPort(res[0], res[1]), nil
+}
+
+// currentMaster returns the address of the last master that was discovered.
+func (s *redisSentinel) currentMaster() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.master
+}
+
+// checkRedisRole makes sure that the connection is to a master. After a
+// sentinel failover, connections to the old master must not be reused.
+func checkRedisRole(c redis.Conn) error {
+	reply, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errors.New("empty ROLE reply")
+	}
+	role, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("redis node has role %s, not master", role)
+	}
+	return nil
+}
+
+// newRedisPool creates a common redis pool of connections. When sentinels are
+// configured, connections are made to the master they report.
+// It also returns a function reporting the address of the master (empty when
+// not using sentinels).
+func newRedisPool(settings *redisSettings) (*redis.Pool, func() string) {
+	var sentinel *redisSentinel
+	if len(settings.sentinelAddrs) > 0 {
+		sentinel = &redisSentinel{
+			masterName: settings.sentinelMaster,
+			password:   settings.sentinelPassword,
+			// Sentinels are reached the same way as the data nodes, over TLS
+			// for rediss:// URIs.
+			dialOptions: settings.sentinelDialOptions(),
+			addrs:       settings.sentinelAddrs,
+		}
+	}
+	pool := &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if sentinel != nil {
+				return checkRedisRole(c)
+			}
+			_, pingErr := c.Do("PING")
+			return pingErr
+		},
+		Dial: func() (redis.Conn, error) {
+			address := settings.address
+			if sentinel != nil {
+				var err error
+				if address, err = sentinel.masterAddr(); err != nil {
+					return nil, err
+				}
+			}
+			c, dialErr := redis.Dial("tcp", address, settings.dialOptions()...)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			if settings.password != "" {
+				if _, authErr := c.Do("AUTH", settings.password); authErr != nil {
+					c.Close()
+					return nil, authErr
+				}
+			}
+			if sentinel != nil {
+				if roleErr := checkRedisRole(c); roleErr != nil {
+					c.Close()
+					return nil, roleErr
+				}
+			}
+			return c, nil
+		},
+	}
+	master := func() string { return "" }
+	if sentinel != nil {
+		master = sentinel.currentMaster
+	}
+	return pool, master
+}
+
+// getRedisSettings reads the settings of the redis server from the
+// configuration, where its URI has been validated.
+func getRedisSettings(config *Config) (*redisSettings, error) {
+	u, err := url.Parse(config.RedisURI)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &redisSettings{address: u.Host}
+	if u.User != nil {
+		settings.password, _ = u.User.Password()
+	}
+
+	if u.Scheme == "rediss" {
+		settings.useTLS = true
+		settings.tlsConfig = &tls.Config{}
+		if caCert := config.RedisTLSCACert; caCert != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(caCert)) {
+				return nil, fmt.Errorf("unable to parse any certificate in %s", RedisTLSCACertEnvVar)
+			}
+			settings.tlsConfig.RootCAs = pool
+		}
+		// Without a name, the certificate is checked against the address
+		// dialed.
+		settings.sentinelTLSConfig = settings.tlsConfig.Clone()
+		settings.tlsConfig.ServerName = config.RedisTLSServerName
+		if settings.tlsConfig.ServerName == "" && len(config.RedisSentinelAddrs) > 0 {
+			// The masters reported by the sentinels are addresses, so their
+			// certificate is checked against the host of the URI instead.
+			settings.tlsConfig.ServerName = u.Hostname()
+		}
+	}
+
+	if len(config.RedisSentinelAddrs) > 0 {
+		settings.sentinelAddrs = config.RedisSentinelAddrs
+		settings.sentinelMaster = config.RedisSentinelMaster
+		// Unless they have their own, sentinels share the password of the
+		// data nodes.
+		settings.sentinelPassword = config.RedisSentinelPassword
+		if settings.sentinelPassword == "" {
+			settings.sentinelPassword = settings.password
+		}
+	}
+
+	return settings, nil
+}
+
+func getRedisService(env *cfenv.App) (string, error) {
+	if env == nil {
+		return "", errors.New("Empty Cloud Foundry environment")
+	}
+	services, err := env.Services.WithTag("redis")
+	if err != nil {
+		return "", err
+	}
+	if len(services) == 0 {
+		return "", errors.New(`Could not find service with tag "redis"`)
+	}
+	uri, ok := services[0].Credentials["uri"].(string)
+	if !ok {
+		if uri, err = getRedisURIFromParts(services[0]); err == nil {
+			return uri, nil
+		}
+		return "", errors.New("Could not parse redis uri")
+	}
+	return uri, nil
+}
+
+// TODO: Delete after east-west is retired
+func getRedisURIFromParts(service cfenv.Service) (string, error) {
+	host, ok := service.Credentials["hostname"].(string)
+	if !ok {
+		return "", errors.New(`Could not find "host" key`)
+	}
+
+	port, ok := service.Credentials["port"].(string)
+	if !ok {
+		return "", errors.New(`Could not find "port" key`)
+	}
+
+	password, ok := service.Credentials["password"].(string)
+	if !ok {
+		return "", errors.New(`Could not find "password" key`)
+	}
+
+	return fmt.Sprintf("redis://:%s@%s:%s", password, host, port), nil
+}
@@ -0,0 +1,63 @@
+package helpers_test
+
+import (
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+
+	"github.com/18F/cg-dashboard/helpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers/docker"
+)
+
+var redisSentinelTests = []struct {
+	testName         string
+	sentinelPassword string
+	expectedUp       bool
+}{
+	{
+		testName:   "Sentinel sharing the password of the redis URI",
+		expectedUp: true,
+	},
+	{
+		testName:         "Sentinel with its own password",
+		sentinelPassword: "secret",
+		expectedUp:       true,
+	},
+	{
+		testName:         "Sentinel with the wrong password",
+		sentinelPassword: "wrong",
+		expectedUp:       false,
+	},
+}
+
+func TestRedisSentinel(t *testing.T) {
+	sentinelAddr, cleanUp := docker.CreateTestRedisSentinel("secret")
+	defer cleanUp()
+	env, _ := cfenv.Current()
+
+	for _, test := range redisSentinelTests {
+		envVars := testhelpers.GetMockCompleteEnvVars()
+		envVars[helpers.SessionBackendEnvVar] = "redis"
+		// Only the password of the URI is used with sentinels.
+		envVars[helpers.RedisURIEnvVar] = "redis://:secret@unused:6379"
+		envVars[helpers.RedisSentinelAddrsEnvVar] = sentinelAddr
+		envVars[helpers.RedisSentinelPasswordEnvVar] = test.sentinelPassword
+		s := helpers.Settings{}
+		// The store checks the connection when it is created.
+		if err := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err != nil {
+			if test.expectedUp {
+				t.Errorf("Test %s failed: %s", test.testName, err)
+			}
+			continue
+		}
+		up, master := s.SessionBackendHealthCheck()
+		if up != test.expectedUp {
+			t.Errorf("Test %s failed. Expected up %t. Found %t", test.testName, test.expectedUp, up)
+		}
+		if test.expectedUp && master == "" {
+			t.Errorf("Test %s failed. Expected the master to be reported", test.testName)
+		}
+		s.Close()
+	}
+}
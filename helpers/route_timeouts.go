@@ -0,0 +1,83 @@
+package helpers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Route groups with their own timeout. The default group covers the login
+// routes, the health checks and the static files.
+const (
+	RouteGroupAPI     = "api"
+	RouteGroupUAA     = "uaa"
+	RouteGroupLog     = "log"
+	RouteGroupAdmin   = "admin"
+	RouteGroupDefault = "default"
+)
+
+// defaultRouteTimeouts are the timeouts of the route groups when not
+// configured. Log dumps can be large, so they get more time.
+var defaultRouteTimeouts = map[string]time.Duration{
+	RouteGroupAPI:     TimeoutConstant,
+	RouteGroupUAA:     TimeoutConstant,
+	RouteGroupLog:     2 * time.Minute,
+	RouteGroupAdmin:   TimeoutConstant,
+	RouteGroupDefault: TimeoutConstant,
+}
+
+// routeGroupPrefixes map the path prefixes of the subrouters to their group.
+var routeGroupPrefixes = []struct {
+	prefix string
+	group  string
+}{
+	{"/v2/", RouteGroupAPI},
+	{"/uaa/", RouteGroupUAA},
+	{"/log/", RouteGroupLog},
+	{"/admin/", RouteGroupAdmin},
+}
+
+// RouteGroup returns the timeout group of a request path.
+func RouteGroup(path string) string {
+	for _, p := range routeGroupPrefixes {
+		if strings.HasPrefix(path, p.prefix) {
+			return p.group
+		}
+	}
+	return RouteGroupDefault
+}
+
+// parseRouteTimeouts overrides the default timeouts with the comma separated
+// group=duration pairs, such as "api=30s,log=0". A zero duration exempts the
+// group from timeouts, for streaming.
+func parseRouteTimeouts(value string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(defaultRouteTimeouts))
+	for group, timeout := range defaultRouteTimeouts {
+		timeouts[group] = timeout
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		group := strings.TrimSpace(kv[0])
+		if _, ok := defaultRouteTimeouts[group]; !ok || len(kv) != 2 {
+			return nil, fmt.Errorf("invalid route timeout: %s", pair)
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid route timeout: %s", pair)
+		}
+		timeouts[group] = timeout
+	}
+	return timeouts, nil
+}
+
+// RouteTimeout returns how long the requests to a path can take, or zero if
+// they are exempt from timeouts.
+func (s *Settings) RouteTimeout(path string) time.Duration {
+	if s.RouteTimeouts == nil {
+		return defaultRouteTimeouts[RouteGroup(path)]
+	}
+	return s.RouteTimeouts[RouteGroup(path)]
+}
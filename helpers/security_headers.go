@@ -0,0 +1,232 @@
+package helpers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CSPReportPath is where browsers report the violations of the
+// Content-Security-Policy.
+const CSPReportPath = "/csp-report"
+
+// Modes of the Content-Security-Policy.
+const (
+	// CSPModeEnforce blocks and reports the violations.
+	CSPModeEnforce = "enforce"
+	// CSPModeReportOnly only reports the violations, to try out a policy.
+	CSPModeReportOnly = "report-only"
+	// CSPModeOff sends no policy.
+	CSPModeOff = "off"
+)
+
+// cspNoncePlaceholder is replaced by the nonce of the request in the policy.
+const cspNoncePlaceholder = "{nonce}"
+
+// defaultContentSecurityPolicy allows the dashboard's own assets and the
+// inline scripts carrying the nonce, which load Google Analytics and New Relic.
+const defaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'nonce-{nonce}' https://www.google-analytics.com https://js-agent.newrelic.com https://bam.nr-data.net; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data: https://www.google-analytics.com; " +
+	"connect-src 'self' https://www.google-analytics.com https://bam.nr-data.net; " +
+	"font-src 'self' data:; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'; " +
+	"report-uri " + CSPReportPath + "; " +
+	"report-to csp-endpoint"
+
+// defaultHSTSMaxAge is how long browsers only use HTTPS with the dashboard.
+const defaultHSTSMaxAge = 365 * 24 * time.Hour
+
+// cspReportContentTypes are the media types of the violation reports, with
+// the report-uri and the report-to directives.
+var cspReportContentTypes = []string{"application/csp-report", "application/reports+json"}
+
+// SecurityHeaders are the headers protecting the responses of the dashboard
+// in browsers.
+type SecurityHeaders struct {
+	// ContentSecurityPolicy is the policy, where "{nonce}" is replaced by the
+	// nonce of the request.
+	ContentSecurityPolicy string
+	CSPMode               string
+	// HSTSMaxAge is the max-age of Strict-Transport-Security. Zero means no
+	// header.
+	HSTSMaxAge time.Duration
+}
+
+// newSecurityHeaders creates the security headers, validating the CSP mode.
+func newSecurityHeaders(policy, mode string, hstsMaxAge time.Duration) (*SecurityHeaders, error) {
+	switch mode {
+	case CSPModeEnforce, CSPModeReportOnly, CSPModeOff:
+	default:
+		return nil, fmt.Errorf("unknown CSP mode: %s", mode)
+	}
+	if hstsMaxAge < 0 {
+		return nil, fmt.Errorf("invalid HSTS max age: %s", hstsMaxAge)
+	}
+	return &SecurityHeaders{ContentSecurityPolicy: policy, CSPMode: mode, HSTSMaxAge: hstsMaxAge}, nil
+}
+
+// NewCSPNonce generates a random nonce for the inline scripts of a response.
+func NewCSPNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Write sets the security headers of a response, with the nonce of its inline
+// scripts, if any.
+func (h *SecurityHeaders) Write(header http.Header, nonce string) {
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("Referrer-Policy", "strict-origin-when-cross-origin")
+	header.Set("Permissions-Policy", "camera=(), microphone=(), geolocation=(), payment=(), usb=()")
+	if h.HSTSMaxAge > 0 {
+		header.Set("Strict-Transport-Security",
+			"max-age="+strconv.FormatInt(int64(h.HSTSMaxAge/time.Second), 10)+"; includeSubDomains")
+	}
+	policy := strings.Replace(h.ContentSecurityPolicy, cspNoncePlaceholder, nonce, -1)
+	switch h.CSPMode {
+	case CSPModeEnforce:
+		header.Set("Content-Security-Policy", policy)
+	case CSPModeReportOnly:
+		header.Set("Content-Security-Policy-Report-Only", policy)
+	default:
+		return
+	}
+	header.Set("Reporting-Endpoints", `csp-endpoint="`+CSPReportPath+`"`)
+}
+
+// CSPViolation is a violation of the Content-Security-Policy reported by a
+// browser.
+type CSPViolation struct {
+	DocumentURI string
+	Directive   string
+	BlockedURI  string
+	SourceFile  string
+	LineNumber  int
+}
+
+// cspDirectives are the directives counted in the metrics under their own
+// name. The others, which browsers may report however they like, are counted
+// as "other".
+var cspDirectives = map[string]bool{
+	"base-uri":                  true,
+	"block-all-mixed-content":   true,
+	"child-src":                 true,
+	"connect-src":               true,
+	"default-src":               true,
+	"font-src":                  true,
+	"form-action":               true,
+	"frame-ancestors":           true,
+	"frame-src":                 true,
+	"img-src":                   true,
+	"manifest-src":              true,
+	"media-src":                 true,
+	"object-src":                true,
+	"prefetch-src":              true,
+	"require-trusted-types-for": true,
+	"sandbox":                   true,
+	"script-src":                true,
+	"script-src-attr":           true,
+	"script-src-elem":           true,
+	"style-src":                 true,
+	"style-src-attr":            true,
+	"style-src-elem":            true,
+	"trusted-types":             true,
+	"upgrade-insecure-requests": true,
+	"worker-src":                true,
+}
+
+// CSPDirectiveLabel returns the name of the violated directive for the
+// metrics, or "other" if it is not a known directive. Older browsers report
+// the directive with its sources.
+func CSPDirectiveLabel(directive string) string {
+	fields := strings.Fields(directive)
+	if len(fields) > 0 && cspDirectives[strings.ToLower(fields[0])] {
+		return strings.ToLower(fields[0])
+	}
+	return "other"
+}
+
+// cspReport is a violation report sent for the report-uri directive.
+type cspReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		BlockedURI         string `json:"blocked-uri"`
+		SourceFile         string `json:"source-file"`
+		LineNumber         int    `json:"line-number"`
+	} `json:"csp-report"`
+}
+
+// reportingAPIReport is a report sent for the report-to directive.
+// https://www.w3.org/TR/reporting-1/
+type reportingAPIReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		BlockedURL         string `json:"blockedURL"`
+		SourceFile         string `json:"sourceFile"`
+		LineNumber         int    `json:"lineNumber"`
+	} `json:"body"`
+}
+
+// ParseCSPReports parses the violation reports sent by a browser, in either
+// the report-uri or the report-to format.
+func ParseCSPReports(contentType string, body []byte) ([]CSPViolation, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/csp-report":
+		var report cspReport
+		if err := json.Unmarshal(body, &report); err != nil {
+			return nil, err
+		}
+		r := report.Report
+		directive := r.EffectiveDirective
+		if directive == "" {
+			directive = r.ViolatedDirective
+		}
+		return []CSPViolation{{
+			DocumentURI: r.DocumentURI,
+			Directive:   directive,
+			BlockedURI:  r.BlockedURI,
+			SourceFile:  r.SourceFile,
+			LineNumber:  r.LineNumber,
+		}}, nil
+	case "application/reports+json":
+		var reports []reportingAPIReport
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+		var violations []CSPViolation
+		for _, r := range reports {
+			if r.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, CSPViolation{
+				DocumentURI: r.Body.DocumentURL,
+				Directive:   r.Body.EffectiveDirective,
+				BlockedURI:  r.Body.BlockedURL,
+				SourceFile:  r.Body.SourceFile,
+				LineNumber:  r.Body.LineNumber,
+			})
+		}
+		return violations, nil
+	default:
+		return nil, fmt.Errorf("unsupported report content type: %s", contentType)
+	}
+}
@@ -0,0 +1,104 @@
+package helpers_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+func TestSecurityHeadersWrite(t *testing.T) {
+	headers := &helpers.SecurityHeaders{
+		ContentSecurityPolicy: "script-src 'self' 'nonce-{nonce}'",
+		CSPMode:               helpers.CSPModeEnforce,
+		HSTSMaxAge:            24 * time.Hour,
+	}
+	header := http.Header{}
+	headers.Write(header, "abc")
+	expected := map[string]string{
+		"Content-Security-Policy":   "script-src 'self' 'nonce-abc'",
+		"Strict-Transport-Security": "max-age=86400; includeSubDomains",
+		"X-Frame-Options":           "DENY",
+		"X-Content-Type-Options":    "nosniff",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+		"Reporting-Endpoints":       `csp-endpoint="/csp-report"`,
+	}
+	for name, value := range expected {
+		if header.Get(name) != value {
+			t.Errorf("Expected %s: %s. Found %q", name, value, header.Get(name))
+		}
+	}
+	if header.Get("Permissions-Policy") == "" || header.Get("Content-Security-Policy-Report-Only") != "" {
+		t.Errorf("Unexpected headers %v", header)
+	}
+
+	headers.CSPMode = helpers.CSPModeReportOnly
+	headers.HSTSMaxAge = 0
+	header = http.Header{}
+	headers.Write(header, "def")
+	if header.Get("Content-Security-Policy-Report-Only") != "script-src 'self' 'nonce-def'" ||
+		header.Get("Content-Security-Policy") != "" || header.Get("Strict-Transport-Security") != "" {
+		t.Errorf("Expected a report only policy without HSTS. Found %v", header)
+	}
+
+	headers.CSPMode = helpers.CSPModeOff
+	header = http.Header{}
+	headers.Write(header, "ghi")
+	if header.Get("Content-Security-Policy-Report-Only") != "" || header.Get("Content-Security-Policy") != "" ||
+		header.Get("Reporting-Endpoints") != "" || header.Get("X-Frame-Options") != "DENY" {
+		t.Errorf("Expected no policy. Found %v", header)
+	}
+}
+
+func TestNewCSPNonce(t *testing.T) {
+	first, err := helpers.NewCSPNonce()
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	second, _ := helpers.NewCSPNonce()
+	if len(first) < 22 || first == second || strings.ContainsAny(first, "+/=") {
+		t.Errorf("Expected distinct random nonces. Found %q and %q", first, second)
+	}
+}
+
+func TestParseCSPReports(t *testing.T) {
+	violations, err := helpers.ParseCSPReports("application/csp-report", []byte(`{"csp-report": {
+		"document-uri": "https://dashboard/", "violated-directive": "script-src-elem",
+		"blocked-uri": "inline", "source-file": "https://dashboard/", "line-number": 13}}`))
+	if err != nil || len(violations) != 1 {
+		t.Fatalf("Expected a violation. Found %v, %v", violations, err)
+	}
+	if v := violations[0]; v.Directive != "script-src-elem" || v.BlockedURI != "inline" || v.LineNumber != 13 {
+		t.Errorf("Unexpected violation %+v", v)
+	}
+
+	violations, err = helpers.ParseCSPReports("application/reports+json", []byte(`[
+		{"type": "csp-violation", "body": {"documentURL": "https://dashboard/", "effectiveDirective": "img-src", "blockedURL": "https://example.com/a.png"}},
+		{"type": "deprecation", "body": {}}]`))
+	if err != nil || len(violations) != 1 || violations[0].Directive != "img-src" || violations[0].BlockedURI != "https://example.com/a.png" {
+		t.Errorf("Expected the CSP violation only. Found %v, %v", violations, err)
+	}
+
+	if _, err := helpers.ParseCSPReports("application/csp-report", []byte(`{`)); err == nil {
+		t.Error("Expected an error with an invalid report")
+	}
+	if _, err := helpers.ParseCSPReports("application/json", []byte(`{}`)); err == nil {
+		t.Error("Expected an error with another content type")
+	}
+}
+
+func TestCSPDirectiveLabel(t *testing.T) {
+	for directive, expected := range map[string]string{
+		"img-src":                       "img-src",
+		"Script-Src-Elem":               "script-src-elem",
+		"script-src 'self' 'nonce-abc'": "script-src",
+		"made-up-src-1234":              "other",
+		"":                              "other",
+	} {
+		if label := helpers.CSPDirectiveLabel(directive); label != expected {
+			t.Errorf("Directive %q: expected %s. Found %s", directive, expected, label)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"golang.org/x/crypto/hkdf"
+)
+
+// encryptedValuesKey is the only session value written to the underlying
+// store when session encryption is enabled.
+const encryptedValuesKey = "encrypted-values"
+
+// sessionEncryptionInfo binds the keys derived from the secrets to their use.
+const sessionEncryptionInfo = "cg-dashboard session encryption"
+
+// sessionKey is a key used to encrypt the session values.
+type sessionKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// encryptedValues is the envelope stored in the session.
+type encryptedValues struct {
+	// KeyID identifies the key used to encrypt Ciphertext.
+	KeyID      string
+	Ciphertext []byte
+	Nonce      []byte
+	// Binding is what the ciphertext belongs to, such as the ID of the
+	// session, so that it can't be moved elsewhere. It is authenticated along
+	// with the ciphertext.
+	Binding string
+}
+
+// errPlaintextSession is returned for the sessions that are not encrypted
+// once they are no longer accepted.
+var errPlaintextSession = errors.New("session is not encrypted")
+
+// EncryptedStore wraps a session store so that the session values are
+// encrypted before they reach the underlying store, with the current key.
+// Older keys can still decrypt existing sessions, which are re-encrypted with
+// the current key the next time they are saved.
+type EncryptedStore struct {
+	store sessions.Store
+	// keys are the encryption keys. The first one is the current key.
+	keys []sessionKey
+	// plaintextUntil is until when the sessions from before encryption was
+	// enabled are accepted.
+	plaintextUntil time.Time
+}
+
+// NewEncryptedStore wraps the given store. secrets is a comma separated list
+// of secrets to derive the encryption keys from with HKDF-SHA256, the current
+// one first.
+func NewEncryptedStore(store sessions.Store, secrets string) (*EncryptedStore, error) {
+	s := &EncryptedStore{store: store}
+	for _, secret := range strings.Split(secrets, ",") {
+		secret = strings.TrimSpace(secret)
+		if secret == "" {
+			continue
+		}
+		key, err := deriveKey(secret, sessionEncryptionInfo)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		id := sha256.Sum256(key)
+		s.keys = append(s.keys, sessionKey{id: hex.EncodeToString(id[:8]), aead: aead})
+	}
+	if len(s.keys) == 0 {
+		return nil, errors.New("no session encryption keys")
+	}
+	return s, nil
+}
+
+// deriveKey derives a 32 byte key from the secret with HKDF-SHA256, bound to
+// its use by info.
+func deriveKey(secret, info string) ([]byte, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, []byte(secret), nil, []byte(info))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// AcceptPlaintextUntil accepts the sessions from before encryption was enabled
+// until the given time, encrypting them as they are read. They are rejected
+// afterwards, and by default.
+func (s *EncryptedStore) AcceptPlaintextUntil(until time.Time) {
+	s.plaintextUntil = until
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *EncryptedStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session from the underlying store with its values
+// decrypted. If the values can't be decrypted, a new session is returned along
+// with the error.
+func (s *EncryptedStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	inner, err := s.store.New(r, name)
+	session := sessions.NewSession(s, name)
+	if inner == nil {
+		return session, err
+	}
+	session.ID = inner.ID
+	session.Options = inner.Options
+	session.IsNew = inner.IsNew
+	if len(inner.Values) == 0 {
+		return session, err
+	}
+	blob, ok := inner.Values[encryptedValuesKey].([]byte)
+	if !ok {
+		// Sessions from before encryption was enabled.
+		if !time.Now().Before(s.plaintextUntil) {
+			session.IsNew = true
+			return session, errPlaintextSession
+		}
+		session.Values = inner.Values
+		s.upgrade(r, session)
+		return session, err
+	}
+	values, bound, decryptErr := s.decrypt(blob, session.ID)
+	if decryptErr != nil {
+		session.IsNew = true
+		return session, decryptErr
+	}
+	session.Values = values
+	if !bound {
+		s.upgrade(r, session)
+	}
+	return session, err
+}
+
+// upgrade saves a session read from before encryption, or from before the
+// sessions were bound to their ID, right away. Only the sessions kept on the
+// server can be saved without the response; the others are upgraded the next
+// time they are saved.
+func (s *EncryptedStore) upgrade(r *http.Request, session *sessions.Session) {
+	if session.ID == "" {
+		return
+	}
+	if err := s.Save(r, httptest.NewRecorder(), session); err != nil {
+		RequestLogger(r).Error("unable to encrypt session", Fields{"error": err})
+	}
+}
+
+// Save encrypts the session values and saves them to the underlying store.
+// The values are bound to the ID of the session, which is generated first for
+// new sessions.
+func (s *EncryptedStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	blob, err := s.encrypt(session.Values, session.ID)
+	if err != nil {
+		return err
+	}
+	values := session.Values
+	session.Values = map[interface{}]interface{}{encryptedValuesKey: blob}
+	defer func() { session.Values = values }()
+	return s.store.Save(r, w, session)
+}
+
+func (s *EncryptedStore) encrypt(values map[interface{}]interface{}, sessionID string) ([]byte, error) {
+	plaintext := new(bytes.Buffer)
+	if err := gob.NewEncoder(plaintext).Encode(values); err != nil {
+		return nil, err
+	}
+	return s.seal(plaintext.Bytes(), sessionID)
+}
+
+// decrypt returns the values of the session with the given ID, and whether
+// they were bound to it. Values bound to another session are rejected, as are
+// values bound to none once plaintext sessions are. Stores that don't keep the
+// session ID, such as the cookie store, give no ID to check.
+func (s *EncryptedStore) decrypt(blob []byte, sessionID string) (map[interface{}]interface{}, bool, error) {
+	plaintext, binding, err := s.open(blob)
+	if err != nil {
+		return nil, false, err
+	}
+	bound := binding == sessionID
+	if !bound && sessionID != "" && (binding != "" || !time.Now().Before(s.plaintextUntil)) {
+		return nil, false, errors.New("session values belong to another session")
+	}
+	values := make(map[interface{}]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&values); err != nil {
+		return nil, false, err
+	}
+	return values, bound || sessionID == "", nil
+}
+
+// seal encrypts plaintext with the current key, bound to binding.
+func (s *EncryptedStore) seal(plaintext []byte, binding string) ([]byte, error) {
+	key := s.keys[0]
+	nonce, err := GenerateRandomBytes(key.aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	envelope := new(bytes.Buffer)
+	err = gob.NewEncoder(envelope).Encode(encryptedValues{
+		KeyID:      key.id,
+		Ciphertext: key.aead.Seal(nil, nonce, plaintext, []byte(key.id+binding)),
+		Nonce:      nonce,
+		Binding:    binding,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return envelope.Bytes(), nil
+}
+
+// open decrypts a blob sealed with any of the keys, and returns what it is
+// bound to.
+func (s *EncryptedStore) open(blob []byte) ([]byte, string, error) {
+	var envelope encryptedValues
+	if err := gob.NewDecoder(bytes.NewReader(blob)).Decode(&envelope); err != nil {
+		return nil, "", err
+	}
+	for _, key := range s.keys {
+		if key.id != envelope.KeyID {
+			continue
+		}
+		plaintext, err := key.aead.Open(nil, envelope.Nonce, envelope.Ciphertext, []byte(key.id+envelope.Binding))
+		return plaintext, envelope.Binding, err
+	}
+	return nil, "", fmt.Errorf("unknown session encryption key %s", envelope.KeyID)
+}
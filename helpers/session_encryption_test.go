@@ -0,0 +1,159 @@
+package helpers_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+// saveToken saves a token in a new session of the given store and returns the
+// resulting session cookie.
+func saveToken(t *testing.T, store sessions.Store, token oauth2.Token) *http.Cookie {
+	request, _ := http.NewRequest("GET", "/", nil)
+	response := httptest.NewRecorder()
+	session, _ := store.Get(request, "session")
+	session.Values["token"] = token
+	if err := session.Save(request, response); err != nil {
+		t.Fatalf("Expected no error saving the session. %s", err.Error())
+	}
+	return response.Result().Cookies()[0]
+}
+
+// loadToken reads the token back from the session cookie.
+func loadToken(store sessions.Store, cookie *http.Cookie) (*oauth2.Token, error) {
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.AddCookie(cookie)
+	session, err := store.Get(request, "session")
+	if err != nil {
+		return nil, err
+	}
+	token, _ := session.Values["token"].(oauth2.Token)
+	return &token, nil
+}
+
+func TestEncryptedStore(t *testing.T) {
+	gob.Register(oauth2.Token{})
+	cookieStore := sessions.NewCookieStore([]byte("session-key"))
+	token := oauth2.Token{AccessToken: "secret-access-token", RefreshToken: "secret-refresh-token"}
+
+	oldStore, err := helpers.NewEncryptedStore(cookieStore, "old-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCookie := saveToken(t, oldStore, token)
+
+	// The underlying store must only see the encrypted values.
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.AddCookie(oldCookie)
+	raw, _ := cookieStore.Get(request, "session")
+	if len(raw.Values) != 1 {
+		t.Errorf("Expected a single encrypted value. Found %d values", len(raw.Values))
+	}
+	for _, value := range raw.Values {
+		if b, ok := value.([]byte); !ok || bytes.Contains(b, []byte(token.AccessToken)) {
+			t.Error("Expected the token to be encrypted")
+		}
+	}
+
+	// Rotate the key: the old key can still decrypt.
+	rotatedStore, _ := helpers.NewEncryptedStore(cookieStore, "new-key, old-key")
+	if found, err := loadToken(rotatedStore, oldCookie); err != nil || found.AccessToken != token.AccessToken {
+		t.Errorf("Expected to decrypt the session with the old key. %v", err)
+	}
+
+	// Saving again uses the new key.
+	newCookie := saveToken(t, rotatedStore, token)
+	newStore, _ := helpers.NewEncryptedStore(cookieStore, "new-key")
+	if found, err := loadToken(newStore, newCookie); err != nil || found.AccessToken != token.AccessToken {
+		t.Errorf("Expected to decrypt the session with the new key. %v", err)
+	}
+	if _, err := loadToken(newStore, oldCookie); err == nil {
+		t.Error("Expected an error decrypting a session with a retired key")
+	}
+
+	if _, err := helpers.NewEncryptedStore(cookieStore, " , "); err == nil {
+		t.Error("Expected an error without any keys")
+	}
+}
+
+func TestEncryptedStorePlaintextSessions(t *testing.T) {
+	gob.Register(oauth2.Token{})
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileStore := sessions.NewFilesystemStore(dir, []byte("session-key"))
+	token := oauth2.Token{AccessToken: "secret-access-token", RefreshToken: "secret-refresh-token"}
+	// A session saved before encryption was enabled.
+	plaintextCookie := saveToken(t, fileStore, token)
+
+	// Plaintext sessions are rejected by default.
+	store, _ := helpers.NewEncryptedStore(fileStore, "encryption-key")
+	if _, err := loadToken(store, plaintextCookie); err == nil {
+		t.Error("Expected an error reading a plaintext session")
+	}
+
+	// Until the cutoff, they are accepted and encrypted as they are read.
+	store.AcceptPlaintextUntil(time.Now().Add(time.Hour))
+	if found, err := loadToken(store, plaintextCookie); err != nil || found.AccessToken != token.AccessToken {
+		t.Errorf("Expected to read the plaintext session before the cutoff. %v", err)
+	}
+	request, _ := http.NewRequest("GET", "/", nil)
+	request.AddCookie(plaintextCookie)
+	raw, _ := fileStore.Get(request, "session")
+	if _, ok := raw.Values["token"]; ok || len(raw.Values) != 1 {
+		t.Errorf("Expected the plaintext session to be encrypted once read. Found %v", raw.Values)
+	}
+}
+
+func TestEncryptedStoreSessionBinding(t *testing.T) {
+	gob.Register(oauth2.Token{})
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fileStore := sessions.NewFilesystemStore(dir, []byte("session-key"))
+	store, _ := helpers.NewEncryptedStore(fileStore, "encryption-key")
+
+	var ids []string
+	var cookies []*http.Cookie
+	for _, accessToken := range []string{"victim-access-token", "attacker-access-token"} {
+		request, _ := http.NewRequest("GET", "/", nil)
+		response := httptest.NewRecorder()
+		session, _ := store.Get(request, "session")
+		session.Values["token"] = oauth2.Token{AccessToken: accessToken}
+		if err := session.Save(request, response); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, session.ID)
+		cookies = append(cookies, response.Result().Cookies()[0])
+	}
+	if found, err := loadToken(store, cookies[1]); err != nil || found.AccessToken != "attacker-access-token" {
+		t.Fatalf("Expected to read back the session. %v", err)
+	}
+
+	// The encrypted values of a session can't be used as another's.
+	victim, err := ioutil.ReadFile(filepath.Join(dir, "session_"+ids[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "session_"+ids[1]), victim, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadToken(store, cookies[1]); err == nil {
+		t.Error("Expected an error reading the values of another session")
+	}
+}
@@ -0,0 +1,247 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// redisSessionKeyPrefix is the prefix of the keys holding the sessions in
+	// redis.
+	redisSessionKeyPrefix = "session_"
+	// redisUserSessionsKeyPrefix is the prefix of the keys holding the index of
+	// the sessions of each user in redis.
+	redisUserSessionsKeyPrefix = "user_sessions_"
+	// redisRevokedSessionKeyPrefix is the prefix of the keys marking revoked
+	// sessions in redis, by SessionInfo ID.
+	redisRevokedSessionKeyPrefix = "revoked_session_"
+	// lastSeenResolution is how often the last seen time of a session is
+	// updated at most.
+	lastSeenResolution = time.Minute
+)
+
+// ErrSessionNotFound is returned when revoking a session that does not exist.
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionRevoked is returned for the sessions revoked by an administrator.
+var ErrSessionRevoked = errors.New("revoked")
+
+// SessionInfo describes an active session of a user.
+type SessionInfo struct {
+	// ID identifies the session. It is not the session ID itself, which is
+	// never exposed.
+	ID       string    `json:"id"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen"`
+	ClientIP string    `json:"client_ip"`
+}
+
+// SessionIndex keeps track of the sessions of each user so that they can be
+// listed and revoked.
+type SessionIndex interface {
+	// Add records a new session for the user.
+	Add(userID, sessionID, clientIP string) error
+	// Touch updates the last seen time and client IP of the session.
+	Touch(userID, sessionID, clientIP string) error
+	// List returns the active sessions of the user, oldest first.
+	List(userID string) ([]SessionInfo, error)
+	// Revoke terminates the session with the given SessionInfo ID.
+	Revoke(userID, id string) error
+	// RevokeAll terminates all the sessions of the user and returns how many
+	// there were.
+	RevokeAll(userID string) (int, error)
+	// Remove forgets the session without terminating it, e.g. on logout.
+	Remove(userID, sessionID string) error
+	// Revoked returns whether the session was revoked. Requests that loaded
+	// the session before it was revoked may still save it back.
+	Revoked(sessionID string) (bool, error)
+}
+
+// indexedSession is what is stored in the index for each session.
+type indexedSession struct {
+	SessionInfo
+	SessionID string `json:"session_id"`
+}
+
+// sessionInfoID derives the public ID of a session from its session ID.
+func sessionInfoID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// redisSessionIndex is a SessionIndex for the redis session backend. The
+// sessions of each user are kept in a hash keyed by SessionInfo ID.
+type redisSessionIndex struct {
+	pool *redis.Pool
+	// revokedTTL is how long revoked sessions are remembered: as long as they
+	// could otherwise be used.
+	revokedTTL time.Duration
+}
+
+func newRedisSessionIndex(pool *redis.Pool, revokedTTL time.Duration) *redisSessionIndex {
+	return &redisSessionIndex{pool: pool, revokedTTL: revokedTTL}
+}
+
+func (i *redisSessionIndex) save(c redis.Conn, userID string, session indexedSession) error {
+	b, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	key := redisUserSessionsKeyPrefix + userID
+	if _, err := c.Do("HSET", key, session.ID, b); err != nil {
+		return err
+	}
+	// The index can't outlive the sessions it contains.
+	_, err = c.Do("EXPIRE", key, expirationConstant)
+	return err
+}
+
+func (i *redisSessionIndex) load(c redis.Conn, userID, id string) (*indexedSession, error) {
+	b, err := redis.Bytes(c.Do("HGET", redisUserSessionsKeyPrefix+userID, id))
+	if err == redis.ErrNil {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session indexedSession
+	if err := json.Unmarshal(b, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (i *redisSessionIndex) Add(userID, sessionID, clientIP string) error {
+	c := i.pool.Get()
+	defer c.Close()
+	now := time.Now().UTC()
+	return i.save(c, userID, indexedSession{
+		SessionInfo: SessionInfo{
+			ID:       sessionInfoID(sessionID),
+			Created:  now,
+			LastSeen: now,
+			ClientIP: clientIP,
+		},
+		SessionID: sessionID,
+	})
+}
+
+func (i *redisSessionIndex) Touch(userID, sessionID, clientIP string) error {
+	c := i.pool.Get()
+	defer c.Close()
+	session, err := i.load(c, userID, sessionInfoID(sessionID))
+	if err != nil {
+		return err
+	}
+	// Avoid writing on every single request.
+	now := time.Now().UTC()
+	if now.Sub(session.LastSeen) < lastSeenResolution && session.ClientIP == clientIP {
+		return nil
+	}
+	session.LastSeen = now
+	session.ClientIP = clientIP
+	return i.save(c, userID, *session)
+}
+
+func (i *redisSessionIndex) List(userID string) ([]SessionInfo, error) {
+	c := i.pool.Get()
+	defer c.Close()
+	key := redisUserSessionsKeyPrefix + userID
+	values, err := redis.ByteSlices(c.Do("HVALS", key))
+	if err != nil {
+		return nil, err
+	}
+	sessions := []SessionInfo{}
+	for _, b := range values {
+		var session indexedSession
+		if err := json.Unmarshal(b, &session); err != nil {
+			return nil, err
+		}
+		// Sessions expire on their own, clean up the index when they do.
+		exists, err := redis.Bool(c.Do("EXISTS", redisSessionKeyPrefix+session.SessionID))
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			if _, err := c.Do("HDEL", key, session.ID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		sessions = append(sessions, session.SessionInfo)
+	}
+	sort.Sort(sessionInfosByCreated(sessions))
+	return sessions, nil
+}
+
+func (i *redisSessionIndex) Revoke(userID, id string) error {
+	c := i.pool.Get()
+	defer c.Close()
+	session, err := i.load(c, userID, id)
+	if err != nil {
+		return err
+	}
+	if err := i.revoke(c, *session); err != nil {
+		return err
+	}
+	_, err = c.Do("HDEL", redisUserSessionsKeyPrefix+userID, id)
+	return err
+}
+
+// revoke deletes the session and remembers it was revoked, so that it is
+// rejected if a request in flight saves it back.
+func (i *redisSessionIndex) revoke(c redis.Conn, session indexedSession) error {
+	ttl := int64(i.revokedTTL / time.Millisecond)
+	if _, err := c.Do("SET", redisRevokedSessionKeyPrefix+session.ID, 1, "PX", ttl); err != nil {
+		return err
+	}
+	_, err := c.Do("DEL", redisSessionKeyPrefix+session.SessionID)
+	return err
+}
+
+func (i *redisSessionIndex) RevokeAll(userID string) (int, error) {
+	c := i.pool.Get()
+	defer c.Close()
+	key := redisUserSessionsKeyPrefix + userID
+	values, err := redis.ByteSlices(c.Do("HVALS", key))
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range values {
+		var session indexedSession
+		if err := json.Unmarshal(b, &session); err != nil {
+			return 0, err
+		}
+		if err := i.revoke(c, session); err != nil {
+			return 0, err
+		}
+	}
+	_, err = c.Do("DEL", key)
+	return len(values), err
+}
+
+func (i *redisSessionIndex) Remove(userID, sessionID string) error {
+	c := i.pool.Get()
+	defer c.Close()
+	_, err := c.Do("HDEL", redisUserSessionsKeyPrefix+userID, sessionInfoID(sessionID))
+	return err
+}
+
+func (i *redisSessionIndex) Revoked(sessionID string) (bool, error) {
+	c := i.pool.Get()
+	defer c.Close()
+	return redis.Bool(c.Do("EXISTS", redisRevokedSessionKeyPrefix+sessionInfoID(sessionID)))
+}
+
+// sessionInfosByCreated sorts sessions from oldest to newest.
+type sessionInfosByCreated []SessionInfo
+
+func (s sessionInfosByCreated) Len() int           { return len(s) }
+func (s sessionInfosByCreated) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sessionInfosByCreated) Less(i, j int) bool { return s[i].Created.Before(s[j].Created) }
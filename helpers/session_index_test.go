@@ -0,0 +1,91 @@
+package helpers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+
+	"github.com/18F/cg-dashboard/helpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers/docker"
+)
+
+func TestRedisSessionIndex(t *testing.T) {
+	redisURI, cleanUpRedis, _, _ := docker.CreateTestRedis()
+	defer cleanUpRedis()
+	envVars := testhelpers.GetMockCompleteEnvVars()
+	envVars[helpers.SessionBackendEnvVar] = "redis"
+	envVars[helpers.RedisURIEnvVar] = redisURI
+	env, _ := cfenv.Current()
+	s := helpers.Settings{}
+	if err := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err != nil {
+		t.Fatal(err)
+	}
+	if s.SessionIndex == nil {
+		t.Fatal("Expected the redis backend to have a session index")
+	}
+
+	// Create two sessions for the user.
+	var sessionIDs []string
+	for i := 0; i < 2; i++ {
+		request, _ := http.NewRequest("GET", "/", nil)
+		session, _ := s.Sessions.Get(request, "session")
+		session.Values["state"] = "state"
+		if err := session.Save(request, httptest.NewRecorder()); err != nil {
+			t.Fatal(err)
+		}
+		sessionIDs = append(sessionIDs, session.ID)
+		if err := s.SessionIndex.Add("user-guid", session.ID, "1.2.3.4"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sessions, err := s.SessionIndex.List("user-guid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions. Found %d", len(sessions))
+	}
+	for _, session := range sessions {
+		if session.ClientIP != "1.2.3.4" {
+			t.Errorf("Expected client ip 1.2.3.4. Found %s", session.ClientIP)
+		}
+		for _, sessionID := range sessionIDs {
+			if session.ID == sessionID {
+				t.Error("Expected the session ID to not be exposed")
+			}
+		}
+	}
+
+	for _, sessionID := range sessionIDs {
+		if revoked, err := s.SessionIndex.Revoked(sessionID); err != nil || revoked {
+			t.Errorf("Expected the sessions not to be revoked yet. Found %t (%v)", revoked, err)
+		}
+	}
+
+	if err := s.SessionIndex.Revoke("user-guid", sessions[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SessionIndex.Revoke("user-guid", sessions[0].ID); err != helpers.ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound revoking a revoked session. Found %v", err)
+	}
+	if sessions, _ = s.SessionIndex.List("user-guid"); len(sessions) != 1 {
+		t.Errorf("Expected 1 session after revoking one. Found %d", len(sessions))
+	}
+
+	if revoked, err := s.SessionIndex.RevokeAll("user-guid"); err != nil || revoked != 1 {
+		t.Errorf("Expected to revoke 1 session. Found %d (%v)", revoked, err)
+	}
+	if sessions, _ = s.SessionIndex.List("user-guid"); len(sessions) != 0 {
+		t.Errorf("Expected no sessions after revoking all. Found %d", len(sessions))
+	}
+	// The sessions stay revoked, even if a request in flight saves them back.
+	for _, sessionID := range sessionIDs {
+		if revoked, err := s.SessionIndex.Revoked(sessionID); err != nil || !revoked {
+			t.Errorf("Expected the session to be revoked. Found %t (%v)", revoked, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package helpers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// sessionIssuedAtKey is the session value holding when the user logged in,
+	// as a unix timestamp.
+	sessionIssuedAtKey = "issued_at"
+	// sessionLastActivityKey is the session value holding when the session was
+	// last used, as a unix timestamp.
+	sessionLastActivityKey = "last_activity"
+	// lastActivityResolution is how often the last activity of a session is
+	// saved at most.
+	lastActivityResolution = 30 * time.Second
+)
+
+var (
+	// ErrSessionIdle is returned when a session has not been used for longer
+	// than the idle timeout.
+	ErrSessionIdle = errors.New("idle_timeout")
+	// ErrSessionTooOld is returned when a session is older than the maximum
+	// session lifetime.
+	ErrSessionTooOld = errors.New("max_lifetime")
+)
+
+// StartSessionLifetime records that the user just logged in.
+func StartSessionLifetime(session *sessions.Session, now time.Time) {
+	session.Values[sessionIssuedAtKey] = now.Unix()
+	session.Values[sessionLastActivityKey] = now.Unix()
+}
+
+// CheckSessionLifetime returns ErrSessionIdle or ErrSessionTooOld if the session
+// has expired according to the configured limits, nil otherwise. Logged in
+// sessions missing a timestamp (created before they were recorded) have
+// expired too, so that their users log in again.
+func (s *Settings) CheckSessionLifetime(session *sessions.Session, now time.Time) error {
+	if session.Values["token"] == nil {
+		return nil
+	}
+	if s.SessionMaxLifetime > 0 {
+		issuedAt, ok := session.Values[sessionIssuedAtKey].(int64)
+		if !ok || now.Sub(time.Unix(issuedAt, 0)) > s.SessionMaxLifetime {
+			return ErrSessionTooOld
+		}
+	}
+	if s.SessionIdleTimeout > 0 {
+		lastActivity, ok := session.Values[sessionLastActivityKey].(int64)
+		if !ok || now.Sub(time.Unix(lastActivity, 0)) > s.SessionIdleTimeout {
+			return ErrSessionIdle
+		}
+	}
+	return nil
+}
+
+// TouchSessionLifetime records activity on the session. It returns whether the
+// session values changed and the session needs to be saved.
+func TouchSessionLifetime(session *sessions.Session, now time.Time) bool {
+	lastActivity, _ := session.Values[sessionLastActivityKey].(int64)
+	if now.Sub(time.Unix(lastActivity, 0)) < lastActivityResolution {
+		return false
+	}
+	session.Values[sessionLastActivityKey] = now.Unix()
+	return true
+}
+
+// EndSession clears the authentication data from the session.
+func EndSession(session *sessions.Session) {
+	delete(session.Values, "token")
+	delete(session.Values, sessionIssuedAtKey)
+	delete(session.Values, sessionLastActivityKey)
+}
@@ -0,0 +1,79 @@
+package helpers_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+func TestCheckSessionLifetime(t *testing.T) {
+	settings := helpers.Settings{
+		SessionIdleTimeout: 15 * time.Minute,
+		SessionMaxLifetime: 12 * time.Hour,
+	}
+	now := time.Now()
+	tests := []struct {
+		testName     string
+		issuedAt     time.Time
+		lastActivity time.Time
+		expected     error
+	}{
+		{"Active session", now.Add(-time.Hour), now.Add(-time.Minute), nil},
+		{"Idle session", now.Add(-time.Hour), now.Add(-16 * time.Minute), helpers.ErrSessionIdle},
+		{"Session too old", now.Add(-13 * time.Hour), now.Add(-time.Minute), helpers.ErrSessionTooOld},
+		{"Session without issued at", time.Time{}, now.Add(-time.Minute), helpers.ErrSessionTooOld},
+		{"Session without last activity", now.Add(-time.Hour), time.Time{}, helpers.ErrSessionIdle},
+	}
+	for _, test := range tests {
+		session := sessions.NewSession(nil, "session")
+		session.Values["token"] = oauth2.Token{AccessToken: "token"}
+		if !test.issuedAt.IsZero() {
+			session.Values["issued_at"] = test.issuedAt.Unix()
+		}
+		if !test.lastActivity.IsZero() {
+			session.Values["last_activity"] = test.lastActivity.Unix()
+		}
+		if err := settings.CheckSessionLifetime(session, now); err != test.expected {
+			t.Errorf("Test %s expected %v. Found %v", test.testName, test.expected, err)
+		}
+	}
+
+	// Sessions that are not logged in have nothing to expire.
+	if err := settings.CheckSessionLifetime(sessions.NewSession(nil, "session"), now); err != nil {
+		t.Errorf("Expected no error without a token. Found %v", err)
+	}
+
+	// Without limits, sessions never expire.
+	session := sessions.NewSession(nil, "session")
+	session.Values["token"] = oauth2.Token{AccessToken: "token"}
+	session.Values["issued_at"] = now.Add(-100 * time.Hour).Unix()
+	session.Values["last_activity"] = now.Add(-100 * time.Hour).Unix()
+	if err := (&helpers.Settings{}).CheckSessionLifetime(session, now); err != nil {
+		t.Errorf("Expected no error without limits. Found %v", err)
+	}
+}
+
+func TestTouchSessionLifetime(t *testing.T) {
+	now := time.Now()
+	session := sessions.NewSession(nil, "session")
+	if !helpers.TouchSessionLifetime(session, now) {
+		t.Error("Expected a session without timestamps to be updated")
+	}
+	if _, ok := session.Values["issued_at"]; ok {
+		t.Error("Expected the lifetime to not be restarted")
+	}
+	helpers.StartSessionLifetime(session, now)
+	if helpers.TouchSessionLifetime(session, now.Add(time.Second)) {
+		t.Error("Expected a recently touched session to not be updated")
+	}
+	if !helpers.TouchSessionLifetime(session, now.Add(time.Minute)) {
+		t.Error("Expected the last activity to be updated after a minute")
+	}
+	if session.Values["issued_at"] != now.Unix() {
+		t.Error("Expected the issued at time to not change")
+	}
+}
@@ -3,17 +3,13 @@ package helpers
 import (
 	"crypto/tls"
 	"encoding/gob"
-	"errors"
-	"fmt"
-	"log"
+	"net"
 	"net/http"
-	"net/url"
-	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/boj/redistore"
 	"github.com/cloudfoundry-community/go-cfenv"
-	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/sessions"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -25,8 +21,34 @@ const (
 	expirationConstant = 60 * 60 * 24 * 7
 )
 
+// Server defaults, when not configured.
+const (
+	// Long enough for the largest request bodies the route groups accept.
+	defaultServerReadTimeout       = time.Minute
+	defaultServerReadHeaderTimeout = 10 * time.Second
+	defaultServerIdleTimeout       = 2 * time.Minute
+	defaultServerMaxHeaderBytes    = 1 << 20
+	// CF kills the app 10 seconds after asking it to stop.
+	defaultShutdownTimeout = 9 * time.Second
+	// The router takes a few seconds to stop sending requests to an app
+	// instance that is stopping.
+	defaultShutdownDrainDelay = 3 * time.Second
+)
+
+// Limits of the connections to CF, UAA and loggregator. The route timeouts
+// cancel the calls made while serving a request; these also bound the calls
+// of the routes without a timeout and the connections left idle.
+const (
+	upstreamDialTimeout           = 10 * time.Second
+	upstreamTLSHandshakeTimeout   = 10 * time.Second
+	upstreamResponseHeaderTimeout = 30 * time.Second
+	upstreamIdleConnTimeout       = 90 * time.Second
+)
+
 // Settings is the object to hold global values and objects for the service.
 type Settings struct {
+	// Config is the validated configuration the settings are made from.
+	Config *Config
 	// OAuthConfig is the OAuth client with all the parameters to talk with CF's UAA OAuth Provider.
 	OAuthConfig *oauth2.Config
 	// Console API
@@ -57,8 +79,70 @@ type Settings struct {
 	AppURL string
 	// Type of session backend
 	SessionBackend string
-	// Returns whether the backend is up.
-	SessionBackendHealthCheck func() bool
+	// Returns whether the backend is up and, for replicated backends, the
+	// address of the current master.
+	SessionBackendHealthCheck func() (bool, string)
+	// SessionIdleTimeout is how long a session can be unused before it
+	// expires. Zero means no idle timeout.
+	SessionIdleTimeout time.Duration
+	// SessionMaxLifetime is how long a session can last after logging in,
+	// however active it is. Zero means no limit (besides the session cookie).
+	SessionMaxLifetime time.Duration
+	// SessionIndex tracks the sessions of each user. Only available with the
+	// redis session backend, nil otherwise.
+	SessionIndex SessionIndex
+	// IDTokenVerifier validates the OpenID Connect ID tokens issued by UAA.
+	IDTokenVerifier *IDTokenVerifier
+	// MetricsToken is the bearer token required to read the metrics, if any.
+	MetricsToken string
+	// HealthChecker checks that the CF API, UAA, login server, loggregator and
+	// SMTP relay are reachable.
+	HealthChecker *HealthChecker
+	// Tracer traces the requests and the calls to the upstreams. Nil when
+	// tracing is disabled.
+	Tracer *Tracer
+	// RouteTimeouts are how long the requests of each route group can take.
+	// Zero means no timeout.
+	RouteTimeouts map[string]time.Duration
+	// BodyLimits are the maximum sizes, in bytes, of the request bodies of each
+	// route group. Zero means no limit.
+	BodyLimits map[string]int64
+	// RateLimits are the budgets of requests per user, or per client IP when
+	// anonymous.
+	RateLimits map[string]RateLimit
+	// RateLimiter counts the requests against the budgets, in redis with the
+	// redis session backend and in memory otherwise.
+	RateLimiter RateLimiter
+	// TokenRefresher makes sure each token is refreshed once, across the
+	// instances with the redis session backend and per instance otherwise.
+	TokenRefresher TokenRefresher
+	// SecurityHeaders protect the responses in browsers.
+	SecurityHeaders *SecurityHeaders
+	// ProxyPolicy decides which requests can be proxied to the CF API.
+	ProxyPolicy *ProxyPolicy
+	// AuditSink stores the records of the changes made through the dashboard.
+	// Nil when auditing is disabled.
+	AuditSink AuditSink
+	// Timeouts and limits of the HTTP server.
+	ServerReadTimeout       time.Duration
+	ServerReadHeaderTimeout time.Duration
+	ServerWriteTimeout      time.Duration
+	ServerIdleTimeout       time.Duration
+	ServerMaxHeaderBytes    int
+	// ShutdownTimeout is how long shutting down takes at most, including the
+	// drain delay.
+	ShutdownTimeout time.Duration
+	// ShutdownDrainDelay is how long the app keeps accepting requests once
+	// asked to stop, before waiting for the requests in flight to complete.
+	ShutdownDrainDelay time.Duration
+	// draining is set (to 1) once the app is shutting down.
+	draining int32
+	// transport is shared by the calls to the upstreams, so that they reuse
+	// the connections.
+	transport *http.Transport
+	// closeSessionBackend releases the connections to the session backend, if
+	// it has any.
+	closeSessionBackend func() error
 	// SMTP host for UAA invites
 	SMTPHost string
 	// SMTP post for UAA invites
@@ -73,113 +157,116 @@ type Settings struct {
 	TICSecret string
 }
 
-// CreateContext returns a new context to be used for http connections.
-func (s *Settings) CreateContext() context.Context {
-	ctx := context.TODO()
-	// If targeting local cf env, we won't have
-	// valid SSL certs so we need to disable verifying them.
-	if s.LocalCF {
-		httpClient := http.DefaultClient
-		httpClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
-	}
-	return ctx
+// CreateContext returns the context of the oauth2 clients calling the
+// upstreams on behalf of a request, so that their calls, token refreshes
+// included, are cancelled with the request.
+func (s *Settings) CreateContext(parent context.Context) context.Context {
+	return context.WithValue(parent, oauth2.HTTPClient, &http.Client{Transport: s.upstreamTransport()})
 }
 
-// InitSettings attempts to populate all the fields of the Settings struct. It will return an error if it fails,
-// otherwise it returns nil for success.
-func (s *Settings) InitSettings(envVars *EnvVars, env *cfenv.App) (retErr error) {
-	defer func() {
-		// While .MustString() is convenient in readability below, we'd prefer to convert this
-		// to an error for upstream callers.
-		if r := recover(); r != nil {
-			missingErr, ok := r.(*ErrMissingEnvVar)
-			if !ok {
-				// We don't know what this is, re-panic
-				panic(r)
-			}
+// upstreamTransport returns the transport of the calls to the upstreams.
+func (s *Settings) upstreamTransport() *http.Transport {
+	if s.transport == nil {
+		return newUpstreamTransport(s.LocalCF)
+	}
+	return s.transport
+}
 
-			// Set return code to the actual error
-			retErr = missingErr
-		}
-	}()
+// newUpstreamTransport creates a transport with the upstream connection
+// limits. If targeting local cf env, we won't have valid SSL certs so we need
+// to disable verifying them.
+func newUpstreamTransport(localCF bool) *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   upstreamDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   upstreamTLSHandshakeTimeout,
+		ResponseHeaderTimeout: upstreamResponseHeaderTimeout,
+		IdleConnTimeout:       upstreamIdleConnTimeout,
+		MaxIdleConnsPerHost:   10,
+	}
+	if localCF {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return transport
+}
 
-	s.BasePath = envVars.String(BasePathEnvVar, "")
-	s.AppURL = envVars.MustString(HostnameEnvVar)
-	s.ConsoleAPI = envVars.MustString(APIURLEnvVar)
-	s.LoginURL = envVars.MustString(LoginURLEnvVar)
-	s.UaaURL = envVars.MustString(UAAURLEnvVar)
-	s.LogURL = envVars.MustString(LogURLEnvVar)
-	s.PProfEnabled = envVars.Bool(PProfEnabledEnvVar)
-	s.BuildInfo = envVars.String(BuildInfoEnvVar, "developer-build")
-	s.LocalCF = envVars.Bool(LocalCFEnvVar)
-	s.SecureCookies = envVars.Bool(SecureCookiesEnvVar)
-	// Safe guard: shouldn't run with insecure cookies if we are
-	// in a non-development environment (i.e. production)
-	if s.LocalCF == false && s.SecureCookies == false {
-		return errors.New("cannot run with insecure cookies when targeting a production CF environment")
+// InitSettings attempts to populate all the fields of the Settings struct. It will return an error if it fails,
+// otherwise it returns nil for success. An invalid configuration is reported
+// at once as a *ConfigError.
+func (s *Settings) InitSettings(envVars *EnvVars, env *cfenv.App) error {
+	config, err := LoadConfig(envVars, env)
+	if err != nil {
+		return err
 	}
+	s.Config = config
+	s.BasePath = config.BasePath
+	s.AppURL = config.AppURL
+	s.ConsoleAPI = config.APIURL
+	s.LoginURL = config.LoginURL
+	s.UaaURL = config.UAAURL
+	s.LogURL = config.LogURL
+	s.PProfEnabled = config.PProfEnabled
+	s.BuildInfo = config.BuildInfo
+	s.LocalCF = config.LocalCF
+	s.transport = newUpstreamTransport(config.LocalCF)
+	s.SecureCookies = config.SecureCookies
+	s.SessionIdleTimeout = config.SessionIdleTimeout
+	s.SessionMaxLifetime = config.SessionMaxLifetime
+	s.MetricsToken = config.MetricsToken
+	if s.MetricsToken == "" && !s.LocalCF {
+		Log.Warn("METRICS_TOKEN is not set, /metrics is open to anyone")
+	}
+	s.ServerReadTimeout = config.ServerReadTimeout
+	s.ServerReadHeaderTimeout = config.ServerReadHeaderTimeout
+	s.ServerWriteTimeout = config.ServerWriteTimeout
+	s.ServerIdleTimeout = config.ServerIdleTimeout
+	s.ServerMaxHeaderBytes = config.ServerMaxHeaderBytes
+	s.ShutdownTimeout = config.ShutdownTimeout
+	s.ShutdownDrainDelay = config.ShutdownDrainDelay
+	s.RouteTimeouts = config.RouteTimeouts
+	s.BodyLimits = config.BodyLimits
+	s.RateLimits = config.RateLimits
+	s.RateLimiter = NewMemoryRateLimiter()
+	s.TokenRefresher = NewMemoryTokenRefresher()
+	s.SecurityHeaders = config.SecurityHeaders
+	s.ProxyPolicy = config.ProxyPolicy
 
 	// Setup OAuth2 Client Service.
 	s.OAuthConfig = &oauth2.Config{
-		ClientID:     envVars.MustString(ClientIDEnvVar),
-		ClientSecret: envVars.MustString(ClientSecretEnvVar),
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
 		RedirectURL:  s.AppURL + "/oauth2callback",
 		Scopes:       []string{"cloud_controller.read", "cloud_controller.write", "cloud_controller.admin", "scim.read", "openid"},
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  envVars.MustString(LoginURLEnvVar) + "/oauth/authorize",
-			TokenURL: envVars.MustString(UAAURLEnvVar) + "/oauth/token",
+			AuthURL:  config.LoginURL + "/oauth/authorize",
+			TokenURL: config.UAAURL + "/oauth/token",
 		},
 	}
 
+	s.IDTokenVerifier = NewIDTokenVerifier(config.UAAURL, s.OAuthConfig.ClientID, s.httpClient)
+
 	s.StateGenerator = func() (string, error) {
 		return GenerateRandomString(32)
 	}
 
 	// Initialize Sessions.
-	switch envVars.String(SessionBackendEnvVar, "") {
+	switch config.SessionBackend {
 	case "redis":
-		address, password, err := getRedisSettings(env)
+		redisSettings, err := getRedisSettings(config)
 		if err != nil {
 			return err
 		}
-		// Create a common redis pool of connections.
-		redisPool := &redis.Pool{
-			MaxIdle:     10,
-			IdleTimeout: 240 * time.Second,
-			TestOnBorrow: func(c redis.Conn, t time.Time) error {
-				_, pingErr := c.Do("PING")
-				return pingErr
-			},
-			Dial: func() (redis.Conn, error) {
-				// We need to control how long connections are attempted.
-				// Currently will limit how long redis should respond back to
-				// 10 seconds. Any time less than the overall connection timeout of 60
-				// seconds is good.
-				c, dialErr := redis.Dial("tcp", address,
-					redis.DialConnectTimeout(10*time.Second),
-					redis.DialWriteTimeout(10*time.Second),
-					redis.DialReadTimeout(10*time.Second))
-				if dialErr != nil {
-					return nil, dialErr
-				}
-				if password != "" {
-					if _, authErr := c.Do("AUTH", password); err != nil {
-						c.Close()
-						return nil, authErr
-					}
-				}
-				return c, nil
-			},
-		}
+		redisPool, redisMaster := newRedisPool(redisSettings)
 		// create our redis pool.
-		store, err := redistore.NewRediStoreWithPool(redisPool, []byte(envVars.MustString(SessionKeyEnvVar)))
+		store, err := redistore.NewRediStoreWithPool(redisPool, []byte(config.SessionKey))
 		if err != nil {
 			return err
 		}
 		store.SetMaxLength(4096 * 4)
+		store.SetKeyPrefix(redisSessionKeyPrefix)
 		store.Options = &sessions.Options{
 			HttpOnly: true,
 			MaxAge:   expirationConstant,
@@ -188,20 +275,45 @@ func (s *Settings) InitSettings(envVars *EnvVars, env *cfenv.App) (retErr error)
 		}
 		s.Sessions = store
 		s.SessionBackend = "redis"
+		// Revoked sessions are remembered for as long as they could be used.
+		revokedTTL := config.SessionMaxLifetime
+		if revokedTTL == 0 || revokedTTL > expirationConstant*time.Second {
+			revokedTTL = expirationConstant * time.Second
+		}
+		s.SessionIndex = newRedisSessionIndex(redisPool, revokedTTL)
+		s.RateLimiter = newRedisRateLimiter(redisPool)
+		s.TokenRefresher = newRedisTokenRefresher(redisPool)
+		s.closeSessionBackend = redisPool.Close
 
 		// Use health check function where we do a PING.
-		s.SessionBackendHealthCheck = func() bool {
+		s.SessionBackendHealthCheck = func() (bool, string) {
 			c := redisPool.Get()
 			defer c.Close()
 			_, err := c.Do("PING")
 			if err != nil {
-				log.Printf("{\"health-check-error\": \"%s\"}", err)
-				return false
+				Log.Error("session store health check failed", Fields{"error": err})
+				return false, redisMaster()
 			}
-			return true
+			return true, redisMaster()
+		}
+	case "cookie":
+		store, err := newCookieStore(config.SessionKey)
+		if err != nil {
+			return err
+		}
+		store.Options = &sessions.Options{
+			HttpOnly: true,
+			MaxAge:   expirationConstant,
+			Path:     "/",
+			Secure:   s.SecureCookies,
 		}
+		// Also expire the cookie values themselves, not just the cookie.
+		store.MaxAge(expirationConstant)
+		s.Sessions = store
+		s.SessionBackend = "cookie"
+		s.SessionBackendHealthCheck = store.healthCheck
 	default:
-		store := sessions.NewFilesystemStore("", []byte(envVars.MustString(SessionKeyEnvVar)))
+		store := sessions.NewFilesystemStore("", []byte(config.SessionKey))
 		store.MaxLength(4096 * 4)
 		store.Options = &sessions.Options{
 			HttpOnly: true,
@@ -213,91 +325,89 @@ func (s *Settings) InitSettings(envVars *EnvVars, env *cfenv.App) (retErr error)
 		}
 		s.Sessions = store
 		s.SessionBackend = "file"
-		s.SessionBackendHealthCheck = func() bool { return true }
+		s.SessionBackendHealthCheck = func() (bool, string) { return true, "" }
+	}
+
+	// Optionally encrypt the session values before they reach the store. The
+	// cookie store already encrypts the whole session, and the ciphertext
+	// wouldn't compress enough to fit in the cookie.
+	if secrets := config.SessionEncryptionKeys; secrets != "" && s.SessionBackend == "cookie" {
+		Log.Info("SESSION_ENCRYPTION_KEYS is not used with the cookie session backend, which is already encrypted")
+	} else if secrets != "" {
+		store, err := NewEncryptedStore(s.Sessions, secrets)
+		if err != nil {
+			return err
+		}
+		store.AcceptPlaintextUntil(config.SessionPlaintextUntil)
+		s.Sessions = store
+		// The tokens shared between the instances are encrypted too.
+		if refresher, ok := s.TokenRefresher.(*redisTokenRefresher); ok {
+			refresher.encryption = store
+		}
 	}
 
 	// Want to save a struct into the session. Have to register it.
 	gob.Register(oauth2.Token{})
+	gob.Register(UserIdentity{})
 
 	s.HighPrivilegedOauthConfig = &clientcredentials.Config{
-		ClientID:     envVars.MustString(ClientIDEnvVar),
-		ClientSecret: envVars.MustString(ClientSecretEnvVar),
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
 		Scopes:       []string{"scim.invite", "cloud_controller.admin", "scim.read"},
-		TokenURL:     envVars.MustString(UAAURLEnvVar) + "/oauth/token",
+		TokenURL:     config.UAAURL + "/oauth/token",
 	}
 
-	s.SMTPFrom = envVars.MustString(SMTPFromEnvVar)
-	s.SMTPHost = envVars.MustString(SMTPHostEnvVar)
-	s.SMTPPass = envVars.String(SMTPPassEnvVar, "")
-	s.SMTPPort = envVars.String(SMTPPortEnvVar, "")
-	s.SMTPUser = envVars.String(SMTPUserEnvVar, "")
-	s.TICSecret = envVars.String(TICSecretEnvVar, "")
-	return nil
-}
+	s.SMTPFrom = config.SMTPFrom
+	s.SMTPHost = config.SMTPHost
+	s.SMTPPass = config.SMTPPass
+	s.SMTPPort = config.SMTPPort
+	s.SMTPUser = config.SMTPUser
+	s.TICSecret = config.TICSecret
+	s.HealthChecker = s.NewHealthChecker()
 
-func getRedisSettings(env *cfenv.App) (string, string, error) {
-	var err error
-	// Try to read directly from REDIS_URI first.
-	uri := os.Getenv("REDIS_URI")
-	if uri == "" {
-		// If no direct REDIS_URI, parse VCAP_SERVICES
-		uri, err = getRedisService(env)
-	}
-	// If nothing worked so far, default to localhost
-	if uri == "" || err != nil {
-		uri = "redis://localhost:6379"
+	tracerOptions := TracerOptions{SampleRatio: config.TracingSampleRatio, TrustParent: config.TracingTrustParent}
+	switch config.TracingExporter {
+	case "stdout":
+		s.Tracer = NewTracer(StdoutExporter{}, tracerOptions)
+	case "otlp":
+		otlpExporter, err := NewOTLPExporter(config.OTLPEndpoint, config.OTLPHeaders, config.ServiceName)
+		if err != nil {
+			return err
+		}
+		s.Tracer = NewTracer(otlpExporter, tracerOptions)
 	}
 
-	u, err := url.Parse(uri)
+	auditSink, err := NewAuditSink(config.AuditSink, config.AuditFile, config.AuditSyslogAddress)
 	if err != nil {
-		return "", "", err
-	}
-
-	password := ""
-	if u.User != nil {
-		password, _ = u.User.Password()
+		return err
 	}
-
-	return u.Host, password, nil
+	s.AuditSink = auditSink
+	return nil
 }
 
-func getRedisService(env *cfenv.App) (string, error) {
-	if env == nil {
-		return "", errors.New("Empty Cloud Foundry environment")
-	}
-	services, err := env.Services.WithTag("redis")
-	if err != nil {
-		return "", err
-	}
-	if len(services) == 0 {
-		return "", errors.New(`Could not find service with tag "redis"`)
-	}
-	uri, ok := services[0].Credentials["uri"].(string)
-	if !ok {
-		if uri, err = getRedisURIFromParts(services[0]); err == nil {
-			return uri, nil
-		}
-		return "", errors.New("Could not parse redis uri")
-	}
-	return uri, nil
+// StartDraining marks the app as shutting down, so that health checks report
+// it.
+func (s *Settings) StartDraining() {
+	atomic.StoreInt32(&s.draining, 1)
 }
 
-// TODO: Delete after east-west is retired
-func getRedisURIFromParts(service cfenv.Service) (string, error) {
-	host, ok := service.Credentials["hostname"].(string)
-	if !ok {
-		return "", errors.New(`Could not find "host" key`)
-	}
+// Draining returns whether the app is shutting down.
+func (s *Settings) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
 
-	port, ok := service.Credentials["port"].(string)
-	if !ok {
-		return "", errors.New(`Could not find "port" key`)
+// Close releases the connections to the session backend, exports the
+// remaining spans and closes the audit sink. It is called once the server has
+// shut down.
+func (s *Settings) Close() error {
+	s.Tracer.Close()
+	if s.AuditSink != nil {
+		if err := s.AuditSink.Close(); err != nil {
+			Log.Error("unable to close the audit sink", Fields{"error": err})
+		}
 	}
-
-	password, ok := service.Credentials["password"].(string)
-	if !ok {
-		return "", errors.New(`Could not find "password" key`)
+	if s.closeSessionBackend != nil {
+		return s.closeSessionBackend()
 	}
-
-	return fmt.Sprintf("redis://:%s@%s:%s", password, host, port), nil
+	return nil
 }
@@ -1,9 +1,18 @@
 package helpers_test
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
 
 	"github.com/18F/cg-dashboard/helpers"
 	"github.com/18F/cg-dashboard/helpers/testhelpers"
@@ -13,6 +22,8 @@ type initSettingsTest struct {
 	testName        string
 	envVars         map[string]string
 	returnValueNull bool
+	// expectedProblems are the problems of the invalid settings.
+	expectedProblems []string
 }
 
 var initSettingsTests = []initSettingsTest{
@@ -21,16 +32,17 @@ var initSettingsTests = []initSettingsTest{
 		envVars: map[string]string{
 			helpers.ClientIDEnvVar:      "ID",
 			helpers.ClientSecretEnvVar:  "Secret",
-			helpers.HostnameEnvVar:      "hostname",
-			helpers.LoginURLEnvVar:      "loginurl",
-			helpers.UAAURLEnvVar:        "uaaurl",
-			helpers.APIURLEnvVar:        "apiurl",
-			helpers.LogURLEnvVar:        "logurl",
+			helpers.HostnameEnvVar:      "https://hostname",
+			helpers.LoginURLEnvVar:      "https://loginurl",
+			helpers.UAAURLEnvVar:        "https://uaaurl",
+			helpers.APIURLEnvVar:        "https://apiurl",
+			helpers.LogURLEnvVar:        "https://logurl",
 			helpers.SessionKeyEnvVar:    "lalala",
 			helpers.SMTPFromEnvVar:      "blah@blah.com",
 			helpers.SMTPHostEnvVar:      "localhost",
 			helpers.SecureCookiesEnvVar: "1",
 			helpers.TICSecretEnvVar:     "tic",
+			helpers.MetricsTokenEnvVar:  "metricstoken",
 		},
 		returnValueNull: true,
 	},
@@ -39,11 +51,11 @@ var initSettingsTests = []initSettingsTest{
 		envVars: map[string]string{
 			helpers.ClientIDEnvVar:      "ID",
 			helpers.ClientSecretEnvVar:  "Secret",
-			helpers.HostnameEnvVar:      "hostname",
-			helpers.LoginURLEnvVar:      "loginurl",
-			helpers.UAAURLEnvVar:        "uaaurl",
-			helpers.APIURLEnvVar:        "apiurl",
-			helpers.LogURLEnvVar:        "logurl",
+			helpers.HostnameEnvVar:      "https://hostname",
+			helpers.LoginURLEnvVar:      "https://loginurl",
+			helpers.UAAURLEnvVar:        "https://uaaurl",
+			helpers.APIURLEnvVar:        "https://apiurl",
+			helpers.LogURLEnvVar:        "https://logurl",
 			helpers.SessionKeyEnvVar:    "lalala",
 			helpers.SMTPFromEnvVar:      "blah@blah.com",
 			helpers.SMTPHostEnvVar:      "localhost",
@@ -58,11 +70,11 @@ var initSettingsTests = []initSettingsTest{
 		envVars: map[string]string{
 			helpers.ClientIDEnvVar:     "ID",
 			helpers.ClientSecretEnvVar: "Secret",
-			helpers.HostnameEnvVar:     "hostname",
-			helpers.LoginURLEnvVar:     "loginurl",
-			helpers.UAAURLEnvVar:       "uaaurl",
-			helpers.APIURLEnvVar:       "apiurl",
-			helpers.LogURLEnvVar:       "logurl",
+			helpers.HostnameEnvVar:     "https://hostname",
+			helpers.LoginURLEnvVar:     "https://loginurl",
+			helpers.UAAURLEnvVar:       "https://uaaurl",
+			helpers.APIURLEnvVar:       "https://apiurl",
+			helpers.LogURLEnvVar:       "https://logurl",
 			helpers.SessionKeyEnvVar:   "lalala",
 			helpers.SMTPFromEnvVar:     "blah@blah.com",
 			helpers.SMTPHostEnvVar:     "localhost",
@@ -71,139 +83,30 @@ var initSettingsTests = []initSettingsTest{
 			// Let SecureCookies Default to false (similar to what would happen in real life).
 		},
 		returnValueNull: false,
-	},
-	{
-		testName: "Missing Client ID check",
-		envVars: map[string]string{
-			helpers.ClientSecretEnvVar: "Secret",
-			helpers.HostnameEnvVar:     "hostname",
-			helpers.LoginURLEnvVar:     "loginurl",
-			helpers.UAAURLEnvVar:       "uaaurl",
-			helpers.APIURLEnvVar:       "apiurl",
-			helpers.LogURLEnvVar:       "logurl",
-			helpers.SessionKeyEnvVar:   "lalala",
-		},
-		returnValueNull: false,
-	},
-	{
-		testName: "Missing Client Secret check",
-		envVars: map[string]string{
-			helpers.ClientIDEnvVar:   "ID",
-			helpers.HostnameEnvVar:   "hostname",
-			helpers.LoginURLEnvVar:   "loginurl",
-			helpers.UAAURLEnvVar:     "uaaurl",
-			helpers.APIURLEnvVar:     "apiurl",
-			helpers.LogURLEnvVar:     "logurl",
-			helpers.SessionKeyEnvVar: "lalala",
-		},
-		returnValueNull: false,
-	},
-	{
-		testName: "Missing Hostname check",
-		envVars: map[string]string{
-			helpers.ClientIDEnvVar:     "ID",
-			helpers.ClientSecretEnvVar: "Secret",
-			helpers.LoginURLEnvVar:     "loginurl",
-			helpers.UAAURLEnvVar:       "uaaurl",
-			helpers.APIURLEnvVar:       "apiurl",
-			helpers.LogURLEnvVar:       "logurl",
-			helpers.SessionKeyEnvVar:   "lalala",
+		expectedProblems: []string{
+			"cannot run with insecure cookies when targeting a production CF environment",
 		},
-		returnValueNull: false,
-	},
-	{
-		testName: "Missing Auth URL check",
-		envVars: map[string]string{
-			helpers.ClientIDEnvVar:     "ID",
-			helpers.ClientSecretEnvVar: "Secret",
-			helpers.HostnameEnvVar:     "hostname",
-			helpers.UAAURLEnvVar:       "uaaurl",
-			helpers.APIURLEnvVar:       "apiurl",
-			helpers.LogURLEnvVar:       "logurl",
-			helpers.SessionKeyEnvVar:   "lalala",
-		},
-		returnValueNull: false,
-	},
-	{
-		testName: "Missing Token URL check",
-		envVars: map[string]string{
-			helpers.ClientIDEnvVar:     "ID",
-			helpers.ClientSecretEnvVar: "Secret",
-			helpers.HostnameEnvVar:     "hostname",
-			helpers.LoginURLEnvVar:     "loginurl",
-			helpers.APIURLEnvVar:       "apiurl",
-			helpers.LogURLEnvVar:       "logurl",
-			helpers.SessionKeyEnvVar:   "lalala",
-		},
-		returnValueNull: false,
-	},
-	{
-		testName: "Missing API URL check",
-		envVars: map[string]string{
-			helpers.ClientIDEnvVar:     "ID",
-			helpers.ClientSecretEnvVar: "Secret",
-			helpers.HostnameEnvVar:     "hostname",
-			helpers.LoginURLEnvVar:     "loginurl",
-			helpers.UAAURLEnvVar:       "uaaurl",
-			helpers.LogURLEnvVar:       "logurl",
-			helpers.SessionKeyEnvVar:   "lalala",
-		},
-		returnValueNull: false,
-	},
-	{
-		testName: "Missing Log URL check",
-		envVars: map[string]string{
-			helpers.ClientIDEnvVar:     "ID",
-			helpers.ClientSecretEnvVar: "Secret",
-			helpers.HostnameEnvVar:     "hostname",
-			helpers.LoginURLEnvVar:     "loginurl",
-			helpers.UAAURLEnvVar:       "uaaurl",
-			helpers.APIURLEnvVar:       "apiurl",
-			helpers.SessionKeyEnvVar:   "lalala",
-		},
-		returnValueNull: false,
-	},
-	{
-		testName: "Missing Session Key check",
-		envVars: map[string]string{
-			helpers.ClientIDEnvVar:     "ID",
-			helpers.ClientSecretEnvVar: "Secret",
-			helpers.HostnameEnvVar:     "hostname",
-			helpers.LoginURLEnvVar:     "loginurl",
-			helpers.UAAURLEnvVar:       "uaaurl",
-			helpers.APIURLEnvVar:       "apiurl",
-		},
-		returnValueNull: false,
-	},
-	{
-		testName: "Missing SMTP From",
-		envVars: map[string]string{
-			helpers.ClientIDEnvVar:     "ID",
-			helpers.ClientSecretEnvVar: "Secret",
-			helpers.HostnameEnvVar:     "hostname",
-			helpers.LoginURLEnvVar:     "loginurl",
-			helpers.UAAURLEnvVar:       "uaaurl",
-			helpers.APIURLEnvVar:       "apiurl",
-			helpers.SessionKeyEnvVar:   "blah",
-		},
-		returnValueNull: false,
-	},
-	{
-		testName: "Missing SMTP Host",
-		envVars: map[string]string{
-			helpers.ClientIDEnvVar:     "ID",
-			helpers.ClientSecretEnvVar: "Secret",
-			helpers.HostnameEnvVar:     "hostname",
-			helpers.LoginURLEnvVar:     "loginurl",
-			helpers.UAAURLEnvVar:       "uaaurl",
-			helpers.APIURLEnvVar:       "apiurl",
-			helpers.SessionKeyEnvVar:   "blah",
-			helpers.SMTPFromEnvVar:     "blah@blah.com",
-		},
-		returnValueNull: false,
 	},
 }
 
+// missingEnvVarTests are the variables which must be set. Each of them is
+// left out of otherwise valid settings.
+var missingEnvVarTests = []struct {
+	testName string
+	missing  string
+}{
+	{testName: "Missing Client ID check", missing: helpers.ClientIDEnvVar},
+	{testName: "Missing Client Secret check", missing: helpers.ClientSecretEnvVar},
+	{testName: "Missing Hostname check", missing: helpers.HostnameEnvVar},
+	{testName: "Missing Auth URL check", missing: helpers.LoginURLEnvVar},
+	{testName: "Missing Token URL check", missing: helpers.UAAURLEnvVar},
+	{testName: "Missing API URL check", missing: helpers.APIURLEnvVar},
+	{testName: "Missing Log URL check", missing: helpers.LogURLEnvVar},
+	{testName: "Missing Session Key check", missing: helpers.SessionKeyEnvVar},
+	{testName: "Missing SMTP From", missing: helpers.SMTPFromEnvVar},
+	{testName: "Missing SMTP Host", missing: helpers.SMTPHostEnvVar},
+}
+
 func TestInitSettings(t *testing.T) {
 	s := helpers.Settings{}
 	env, _ := cfenv.Current()
@@ -212,5 +115,283 @@ func TestInitSettings(t *testing.T) {
 		if (ret == nil) != test.returnValueNull {
 			t.Errorf("Test %s did not return correct value. Expected %t, Actual %t", test.testName, test.returnValueNull, (ret == nil))
 		}
+		if ret != nil {
+			checkConfigProblems(t, test.testName, ret, test.expectedProblems)
+		}
+	}
+	for _, test := range missingEnvVarTests {
+		envVars := testhelpers.GetMockCompleteEnvVars()
+		delete(envVars, test.missing)
+		ret := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env)
+		checkConfigProblems(t, test.testName, ret, []string{"missing env variable: " + test.missing})
+	}
+}
+
+// checkConfigProblems checks that err is a *ConfigError with exactly the
+// expected problems.
+func checkConfigProblems(t *testing.T, testName string, err error, expected []string) {
+	configErr, ok := err.(*helpers.ConfigError)
+	if !ok {
+		t.Errorf("Test %s: expected a config error. Found %v", testName, err)
+		return
+	}
+	if len(configErr.Problems) != len(expected) {
+		t.Errorf("Test %s: expected the problems %q. Found %s", testName, expected, configErr)
+		return
+	}
+	for i, problem := range configErr.Problems {
+		if problem.Error() != expected[i] {
+			t.Errorf("Test %s: expected problem %q. Found %q", testName, expected[i], problem)
+		}
+	}
+}
+
+func TestInitSettingsRedisURI(t *testing.T) {
+	env, _ := cfenv.Current()
+	tests := []struct {
+		testName string
+		uri      string
+		caCert   string
+	}{
+		{
+			testName: "Unsupported redis uri scheme",
+			uri:      "http://localhost:6379",
+		},
+		{
+			testName: "Invalid redis CA certificate",
+			uri:      "rediss://localhost:6379",
+			caCert:   "not a certificate",
+		},
+	}
+	for _, test := range tests {
+		envVars := testhelpers.GetMockCompleteEnvVars()
+		envVars[helpers.SessionBackendEnvVar] = "redis"
+		envVars[helpers.RedisTLSCACertEnvVar] = test.caCert
+		envVars[helpers.RedisURIEnvVar] = test.uri
+		s := helpers.Settings{}
+		if err := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err == nil {
+			t.Errorf("Test %s expected an error", test.testName)
+		}
+	}
+}
+
+func TestCookieSessionBackend(t *testing.T) {
+	env, _ := cfenv.Current()
+	token, identity := newProductionUAATokens(t)
+	var s helpers.Settings
+	var session *sessions.Session
+	var request *http.Request
+	// The cookie is already encrypted, the session encryption keys must not
+	// make it outgrow the cookie.
+	for _, encryptionKeys := range []string{"", "session-encryption-secret"} {
+		envVars := testhelpers.GetMockCompleteEnvVars()
+		envVars[helpers.SessionBackendEnvVar] = "cookie"
+		envVars[helpers.SessionEncryptionKeysEnvVar] = encryptionKeys
+		s = helpers.Settings{}
+		if err := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err != nil {
+			t.Fatalf("Expected no error initializing the cookie backend. %s", err.Error())
+		}
+		if up, _ := s.SessionBackendHealthCheck(); !up {
+			t.Error("Expected the cookie backend to be healthy")
+		}
+
+		// A session as saved after logging in with production sized UAA
+		// tokens must fit in the cookie.
+		request, _ = http.NewRequest("GET", "/", nil)
+		response := httptest.NewRecorder()
+		session, _ = s.Sessions.Get(request, "session")
+		session.Values["token"] = token
+		session.Values["user"] = identity
+		helpers.StartSessionLifetime(session, time.Now())
+		if err := session.Save(request, response); err != nil {
+			t.Fatalf("Encryption keys %q: expected no error saving the session. %s", encryptionKeys, err.Error())
+		}
+		setCookie := response.Header().Get("Set-Cookie")
+		if len(setCookie) > 4096 {
+			t.Errorf("Encryption keys %q: expected the Set-Cookie header to fit in 4096 bytes. Found %d", encryptionKeys, len(setCookie))
+		}
+		cookies := response.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("Expected one cookie. Found %d", len(cookies))
+		}
+
+		request, _ = http.NewRequest("GET", "/", nil)
+		request.AddCookie(cookies[0])
+		var err error
+		session, err = s.Sessions.Get(request, "session")
+		if err != nil {
+			t.Fatalf("Expected no error reading the session. %s", err.Error())
+		}
+		if found, ok := session.Values["token"].(oauth2.Token); !ok || found.AccessToken != token.AccessToken {
+			t.Error("Expected to read back the token from the session cookie")
+		}
+	}
+
+	// A session too large for the cookie is counted, but only affects its
+	// user, not the health of the backend.
+	session.Values["padding"] = make([]byte, 4096)
+	rand.Read(session.Values["padding"].([]byte))
+	if err := session.Save(request, httptest.NewRecorder()); err == nil {
+		t.Fatal("Expected an error saving a session too large for the cookie")
+	}
+	if up, _ := s.SessionBackendHealthCheck(); !up {
+		t.Error("Expected the cookie backend to stay healthy after failing to save a session")
+	}
+	metrics := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(metrics, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(metrics.Body.String(), `dashboard_session_save_failures_total{store_type="cookie"}`) {
+		t.Error("Expected the failed save to be counted")
+	}
+}
+
+func TestInitSettingsServer(t *testing.T) {
+	env, _ := cfenv.Current()
+	envVars := testhelpers.GetMockCompleteEnvVars()
+	s := helpers.Settings{}
+	if err := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err != nil {
+		t.Fatal(err)
+	}
+	// Responses are limited by the route timeouts rather than by the server,
+	// reading the requests is still bounded.
+	if s.ServerReadTimeout == 0 || s.ServerWriteTimeout != 0 || s.ServerReadHeaderTimeout == 0 || s.ServerIdleTimeout == 0 ||
+		s.ServerMaxHeaderBytes == 0 || s.ShutdownTimeout == 0 || s.ShutdownDrainDelay == 0 {
+		t.Errorf("Expected server defaults. Found %+v", s)
+	}
+	if s.RouteTimeout("/v2/apps") != helpers.TimeoutConstant || s.RouteTimeout("/log/recent") <= helpers.TimeoutConstant {
+		t.Errorf("Expected route timeout defaults. Found %v", s.RouteTimeouts)
+	}
+	if s.BodyLimit("/v2/apps") != 1<<20 || s.BodyLimit("/uaa/invite/users") != 64<<10 {
+		t.Errorf("Expected body limit defaults. Found %v", s.BodyLimits)
+	}
+
+	envVars[helpers.ServerWriteTimeoutEnvVar] = "45s"
+	envVars[helpers.ServerMaxHeaderBytesEnvVar] = "8192"
+	envVars[helpers.ShutdownTimeoutEnvVar] = "5s"
+	envVars[helpers.RouteTimeoutsEnvVar] = "api=30s, log=0"
+	envVars[helpers.BodyLimitsEnvVar] = "api=2MB, uaa=512b, admin=0"
+	s = helpers.Settings{}
+	if err := s.InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err != nil {
+		t.Fatal(err)
+	}
+	if s.ServerWriteTimeout != 45*time.Second || s.ServerMaxHeaderBytes != 8192 || s.ShutdownTimeout != 5*time.Second {
+		t.Errorf("Expected the configured server settings. Found %+v", s)
+	}
+	if s.RouteTimeout("/v2/apps") != 30*time.Second || s.RouteTimeout("/log/recent") != 0 || s.RouteTimeout("/uaa/userinfo") != helpers.TimeoutConstant {
+		t.Errorf("Expected the configured route timeouts. Found %v", s.RouteTimeouts)
+	}
+	if s.BodyLimit("/v2/apps") != 2<<20 || s.BodyLimit("/uaa/invite/users") != 512 || s.BodyLimit("/admin/mail") != 0 || s.BodyLimit("/log/recent") != 64<<10 {
+		t.Errorf("Expected the configured body limits. Found %v", s.BodyLimits)
+	}
+
+	for _, invalid := range []string{"images=1MB", "api", "api=big", "api=-1KB", "api=1GB"} {
+		envVars[helpers.BodyLimitsEnvVar] = invalid
+		if err := (&helpers.Settings{}).InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err == nil {
+			t.Errorf("Expected an error with body limits %q", invalid)
+		}
+	}
+	envVars[helpers.BodyLimitsEnvVar] = ""
+
+	envVars[helpers.CSPModeEnvVar] = "block"
+	if err := (&helpers.Settings{}).InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err == nil {
+		t.Error("Expected an error with an unknown CSP mode")
+	}
+	delete(envVars, helpers.CSPModeEnvVar)
+
+	for _, invalid := range []string{"streaming=1m", "api", "api=soon", "api=-1s"} {
+		envVars[helpers.RouteTimeoutsEnvVar] = invalid
+		if err := (&helpers.Settings{}).InitSettings(helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), env); err == nil {
+			t.Errorf("Expected an error with route timeouts %q", invalid)
+		}
+	}
+
+	if s.Draining() {
+		t.Error("Expected the app not to be draining")
+	}
+	s.StartDraining()
+	if !s.Draining() {
+		t.Error("Expected the app to be draining")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Unexpected error closing the settings: %s", err)
+	}
+}
+
+// newProductionUAATokens returns a token like the ones UAA issues to the
+// dashboard in production, with random claims and signatures that do not
+// compress, along with the identity read from its ID token.
+func newProductionUAATokens(t *testing.T) (oauth2.Token, helpers.UserIdentity) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	randomHex := func(n int) string {
+		b := make([]byte, n)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}
+	randomGUID := func() string {
+		h := randomHex(16)
+		return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+	}
+	now := time.Now().Unix()
+	userID := randomGUID()
+	userName := "firstname.lastname." + randomHex(4) + "@agency.gov"
+	scopes := []string{"openid", "cloud_controller.read", "cloud_controller.write",
+		"cloud_controller.admin", "cloud_controller.global_auditor", "cloud_controller_service_permissions.read",
+		"uaa.user", "scim.read", "scim.write", "scim.invite", "password.write", "routing.router_groups.read",
+		"network.admin", "doppler.firehose", "uaa.admin", "clients.read"}
+	claims := func(extra map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"jti":        randomHex(16),
+			"sub":        userID,
+			"client_id":  "dashboard",
+			"cid":        "dashboard",
+			"azp":        "dashboard",
+			"grant_type": "authorization_code",
+			"user_id":    userID,
+			"origin":     "cloud.gov",
+			"user_name":  userName,
+			"email":      userName,
+			"auth_time":  now,
+			"rev_sig":    randomHex(4),
+			"iat":        now,
+			"exp":        now + 600,
+			"iss":        "https://uaa.fr.cloud.gov/oauth/token",
+			"zid":        "uaa",
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
 	}
+	keyID := "key-" + randomHex(4)
+	accessToken := testhelpers.NewTestSignedJWT(key, keyID, claims(map[string]interface{}{
+		"scope": scopes,
+		"aud":   []string{"cloud_controller", "scim", "password", "openid", "uaa", "routing.router_groups", "network", "doppler", "clients", "dashboard"},
+	}))
+	refreshToken := testhelpers.NewTestSignedJWT(key, keyID, claims(map[string]interface{}{
+		"jti":       randomHex(16) + "-r",
+		"scope":     scopes,
+		"revocable": true,
+		"exp":       now + 7*24*3600,
+		"aud":       []string{"cloud_controller", "scim", "password", "openid", "uaa", "routing.router_groups", "network", "doppler", "clients", "dashboard"},
+	}))
+	idToken := testhelpers.NewTestSignedJWT(key, keyID, claims(map[string]interface{}{
+		"aud":                 []string{"dashboard"},
+		"nonce":               randomHex(24),
+		"amr":                 []string{"ext", "mfa"},
+		"acr":                 map[string]interface{}{"values": []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"}},
+		"given_name":          "Firstname",
+		"family_name":         "Lastname",
+		"phone_number":        nil,
+		"previous_logon_time": now - 86400,
+	}))
+	token := (&oauth2.Token{
+		AccessToken:  accessToken,
+		TokenType:    "bearer",
+		RefreshToken: refreshToken,
+		Expiry:       time.Now().Add(10 * time.Minute),
+	}).WithExtra(map[string]interface{}{"id_token": idToken})
+	identity := helpers.UserIdentity{UserID: userID, UserName: userName, Email: userName, Origin: "cloud.gov"}
+	return *token, identity
 }
@@ -1,10 +1,15 @@
 package helpers
 
 import (
+	"bytes"
 	"fmt"
+	"html"
 	"html/template"
 	"io"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 )
 
 const (
@@ -12,6 +17,11 @@ const (
 	InviteEmailTemplate = "INVITE_EMAIL_TEMPLATE"
 	// IndexTemplate is the template key for the index.html.
 	IndexTemplate = "INDEX_HTML_TEMPLATE"
+	// LoginErrorTemplate is the template key for the page shown when logging
+	// in fails.
+	LoginErrorTemplate = "LOGIN_ERROR_TEMPLATE"
+	// InviteEmailSubject is the subject line of the invite email.
+	InviteEmailSubject = "Invitation to join cloud.gov"
 )
 
 // findTemplates will try to construct to final path of where to find templates
@@ -21,6 +31,8 @@ func findTemplates(basePath string) map[string][]string {
 		IndexTemplate: {filepath.Join(basePath, "static", "index.html")},
 		InviteEmailTemplate: {filepath.Join(basePath,
 			"templates", "mail", "invite.tmpl")},
+		LoginErrorTemplate: {filepath.Join(basePath,
+			"templates", "web", "login_error.tmpl")},
 	}
 }
 
@@ -67,8 +79,9 @@ func (t *Templates) GetInviteEmail(rw io.Writer, url string) error {
 	return tpl.Execute(rw, inviteEmail{url})
 }
 
-// GetIndex gets the filled in index.html
-func (t *Templates) GetIndex(rw io.Writer, csrfToken, gaTrackingID, newRelicID,
+// GetIndex gets the filled in index.html. The nonce allows its inline scripts
+// under the Content-Security-Policy.
+func (t *Templates) GetIndex(rw io.Writer, csrfToken, nonce, gaTrackingID, newRelicID,
 	newRelicBrowserLicenseKey string) error {
 	tpl, err := t.getTemplate(IndexTemplate)
 	if err != nil {
@@ -76,8 +89,122 @@ func (t *Templates) GetIndex(rw io.Writer, csrfToken, gaTrackingID, newRelicID,
 	}
 	return tpl.Execute(rw, map[string]interface{}{
 		"csrfToken":                     csrfToken,
+		"nonce":                         nonce,
 		"GA_TRACKING_ID":                gaTrackingID,
 		"NEW_RELIC_ID":                  newRelicID,
 		"NEW_RELIC_BROWSER_LICENSE_KEY": newRelicBrowserLicenseKey,
 	})
 }
+
+// LoginError provides struct for the templates/web/login_error.tmpl
+type LoginError struct {
+	Title   string
+	Message string
+	// Reason is the error code, if any, to help support find out what
+	// happened.
+	Reason   string
+	RetryURL string
+}
+
+// GetLoginError gets the filled in login error page.
+func (t *Templates) GetLoginError(rw io.Writer, loginError LoginError) error {
+	tpl, err := t.getTemplate(LoginErrorTemplate)
+	if err != nil {
+		return err
+	}
+	return tpl.Execute(rw, loginError)
+}
+
+// mailTemplate describes a mail template that can be previewed by operators.
+type mailTemplate struct {
+	key     string
+	subject string
+	// sample is the data used to fill in the template when previewing it.
+	sample interface{}
+}
+
+// mailTemplates is the registry of all the mail templates, keyed by the short
+// name used in the preview routes.
+var mailTemplates = map[string]mailTemplate{
+	"invite": {
+		key:     InviteEmailTemplate,
+		subject: InviteEmailSubject,
+		sample:  inviteEmail{"https://login.example.com/invitations/accept?code=sample-code"},
+	},
+}
+
+// MailTemplateNames returns the sorted names of all the mail templates that
+// can be previewed.
+func MailTemplateNames() []string {
+	names := make([]string, 0, len(mailTemplates))
+	for name := range mailTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MailPreview is a mail template rendered with sample data.
+type MailPreview struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	HTML    string `json:"html"`
+	Text    string `json:"text"`
+}
+
+// ErrUnknownMailTemplate is returned when previewing a mail template that does
+// not exist.
+type ErrUnknownMailTemplate struct {
+	Name string
+}
+
+// Error returns an error string
+func (err *ErrUnknownMailTemplate) Error() string {
+	return fmt.Sprintf("unknown mail template: %s", err.Name)
+}
+
+// GetMailPreview renders the named mail template with its sample data.
+func (t *Templates) GetMailPreview(name string) (*MailPreview, error) {
+	mt, ok := mailTemplates[name]
+	if !ok {
+		return nil, &ErrUnknownMailTemplate{Name: name}
+	}
+	tpl, err := t.getTemplate(mt.key)
+	if err != nil {
+		return nil, err
+	}
+	body := new(bytes.Buffer)
+	if err := tpl.Execute(body, mt.sample); err != nil {
+		return nil, err
+	}
+	return &MailPreview{
+		Name:    name,
+		Subject: mt.subject,
+		HTML:    body.String(),
+		Text:    htmlToText(body.String()),
+	}, nil
+}
+
+var (
+	htmlHiddenBlocks = regexp.MustCompile(`(?is)<head[^>]*>.*?</head>|<style[^>]*>.*?</style>|<script[^>]*>.*?</script>`)
+	htmlLinks        = regexp.MustCompile(`(?is)<a\s[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+	htmlBlockTags    = regexp.MustCompile(`(?is)</?(p|br|div|table|tr|td|th|h[1-6]|ul|ol|li|center)(\s[^>]*)?/?>`)
+	htmlTags         = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLines       = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// htmlToText approximates what a plain text mail client would show for the
+// given HTML. Links are kept by appending their target to the link text.
+func htmlToText(s string) string {
+	s = htmlHiddenBlocks.ReplaceAllString(s, "")
+	s = htmlLinks.ReplaceAllString(s, "$2 ($1)")
+	s = htmlBlockTags.ReplaceAllString(s, "\n")
+	s = htmlTags.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	s = blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(s)
+}
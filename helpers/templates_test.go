@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/18F/cg-dashboard/helpers"
@@ -58,7 +59,7 @@ func TestGetIndex(t *testing.T) {
 		t.Errorf("Expected to find the templates. %s", err.Error())
 	}
 	body := new(bytes.Buffer)
-	err = templates.GetIndex(body, "testCSRFToken", "test-gaTrackingID",
+	err = templates.GetIndex(body, "testCSRFToken", "test-nonce", "test-gaTrackingID",
 		"test-newRelicID", "test-newRelicBrowserLicenseKey")
 	if err != nil {
 		t.Errorf("Expected no error getting the index html. %s", err.Error())
@@ -81,3 +82,46 @@ func TestGetIndex(t *testing.T) {
 			"helpers", "testdata", "index.html.returned"))
 	}
 }
+
+func TestGetMailPreview(t *testing.T) {
+	templates, err := helpers.InitTemplates(os.Getenv(helpers.BasePathEnvVar))
+	if err != nil {
+		t.Errorf("Expected to find the templates. %s", err.Error())
+	}
+	for _, name := range helpers.MailTemplateNames() {
+		preview, err := templates.GetMailPreview(name)
+		if err != nil {
+			t.Errorf("Expected no error previewing mail template %s. %s", name, err.Error())
+			continue
+		}
+		if preview.Subject == "" || preview.HTML == "" || preview.Text == "" {
+			t.Errorf("Expected a complete preview for mail template %s. Found %+v", name, preview)
+		}
+	}
+	if _, err = templates.GetMailPreview("blah"); err == nil {
+		t.Error("Expected an error previewing an unknown mail template")
+	}
+}
+
+func TestGetLoginError(t *testing.T) {
+	templates, err := helpers.InitTemplates(os.Getenv(helpers.BasePathEnvVar))
+	if err != nil {
+		t.Fatalf("Expected to find the templates. %s", err.Error())
+	}
+	body := new(bytes.Buffer)
+	err = templates.GetLoginError(body, helpers.LoginError{
+		Title:    "Login failed",
+		Message:  "Something went wrong.",
+		Reason:   "<script>alert(1)</script>",
+		RetryURL: "/handshake",
+	})
+	if err != nil {
+		t.Errorf("Expected no error getting the login error page. %s", err.Error())
+	}
+	if !strings.Contains(body.String(), `href="/handshake"`) {
+		t.Error("Expected the login error page to link to the login.")
+	}
+	if strings.Contains(body.String(), "<script>") {
+		t.Error("Expected the reason to be escaped.")
+	}
+}
@@ -1,6 +1,7 @@
 package docker
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -87,6 +88,82 @@ func CreateTestRedis() (string, func(), func(), func()) {
 		func() { pool.Client.UnpauseContainer(resource.Container.ID) }
 }
 
+// CreateTestRedisSentinel creates an actual redis master and a sentinel
+// monitoring it as "mymaster" with docker. Both require the given password.
+// Returns the address of the sentinel and a function to remove both.
+// Useful for unit tests.
+func CreateTestRedisSentinel(password string) (string, func()) {
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		log.Fatalf("Could not connect to docker: %s", err)
+	}
+
+	master, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "redis",
+		Tag:        "6.2",
+		Cmd:        []string{"redis-server", "--requirepass", password},
+	})
+	if err != nil {
+		log.Fatalf("Could not start resource: %s", err)
+	}
+	// The sentinel reports the address it monitors, which must be reachable
+	// from the tests.
+	masterHost := master.Container.NetworkSettings.IPAddress
+	if internalHost, connected := connectToDockerNetwork(pool, master, "test-redis-master"); connected {
+		masterHost = internalHost
+	}
+
+	config := fmt.Sprintf("sentinel resolve-hostnames yes\\n"+
+		"sentinel monitor mymaster %s 6379 1\\n"+
+		"sentinel auth-pass mymaster %s\\n"+
+		"requirepass %s\\n", masterHost, password, password)
+	sentinel, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository:   "redis",
+		Tag:          "6.2",
+		ExposedPorts: []string{"26379/tcp"},
+		// Sentinels rewrite their configuration, so it is written in the
+		// container.
+		Cmd: []string{"sh", "-c", fmt.Sprintf("printf '%s' > /tmp/sentinel.conf && redis-server /tmp/sentinel.conf --sentinel", config)},
+	})
+	if err != nil {
+		pool.Purge(master)
+		log.Fatalf("Could not start resource: %s", err)
+	}
+	cleanUp := func() {
+		pool.Purge(sentinel)
+		pool.Purge(master)
+	}
+
+	// Get the hostname of the Docker Host.
+	u, _ := url.Parse(pool.Client.Endpoint())
+	host := u.Hostname()
+	port := sentinel.GetPort("26379/tcp")
+	// refer to connectToDockerNetwork
+	internalHost, connected := connectToDockerNetwork(pool, sentinel, "test-redis-sentinel")
+	if connected {
+		host = internalHost
+		port = "26379"
+	}
+
+	hostnameAndPort := host + ":" + port
+	if err = pool.Retry(func() error {
+		c, dialErr := redis.Dial("tcp", hostnameAndPort)
+		if dialErr != nil {
+			return dialErr
+		}
+		defer c.Close()
+		if _, authErr := c.Do("AUTH", password); authErr != nil {
+			return authErr
+		}
+		_, masterErr := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", "mymaster"))
+		return masterErr
+	}); err != nil {
+		cleanUp()
+		log.Fatalf("Could not connect to docker: %s", err)
+	}
+	return hostnameAndPort, cleanUp
+}
+
 // CreateTestMailCatcher creates a actual redis instance with docker.
 // Useful for unit tests.
 func CreateTestMailCatcher() (string, string, string, func()) {
@@ -2,10 +2,17 @@ package testhelpers
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -83,12 +90,112 @@ func NewTestRequest(method, path string, body []byte) (*httptest.ResponseRecorde
 
 // InvalidTokenData is a dataset which represents an invalid token. Useful for unit tests.
 var InvalidTokenData = map[string]interface{}{
-	"token": oauth2.Token{Expiry: (time.Now()).Add(-1 * time.Minute), AccessToken: "invalidsampletoken"},
+	"token":         oauth2.Token{Expiry: (time.Now()).Add(-1 * time.Minute), AccessToken: "invalidsampletoken"},
+	"issued_at":     time.Now().Unix(),
+	"last_activity": time.Now().Unix(),
 }
 
-// ValidTokenData is a dataset which represents a valid token. Useful for unit tests.
+// ValidTokenData is a dataset which represents a valid token in a session that
+// just logged in. Useful for unit tests.
 var ValidTokenData = map[string]interface{}{
-	"token": oauth2.Token{Expiry: time.Time{}, AccessToken: "sampletoken"},
+	"token":         oauth2.Token{Expiry: time.Time{}, AccessToken: "sampletoken"},
+	"issued_at":     time.Now().Unix(),
+	"last_activity": time.Now().Unix(),
+}
+
+// NewTestJWT creates an unsigned JWT carrying the given claims. Useful for unit
+// tests that need to decode the access token.
+func NewTestJWT(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+// NewTestSignedJWT creates a JWT carrying the given claims, signed with the RSA
+// key like UAA does. Useful for unit tests that need to verify ID tokens.
+func NewTestSignedJWT(key *rsa.PrivateKey, keyID string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// NewTestTokenKeys returns what UAA serves at /token_keys for the RSA key.
+func NewTestTokenKeys(key *rsa.PrivateKey, keyID string) string {
+	keys, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}},
+	})
+	return string(keys)
+}
+
+// NewTestOpenIDConfiguration returns what UAA serves at
+// /.well-known/openid-configuration.
+func NewTestOpenIDConfiguration(issuer, keysURL string) string {
+	config, _ := json.Marshal(map[string]interface{}{
+		"issuer":                                issuer,
+		"jwks_uri":                              keysURL,
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+	return string(config)
+}
+
+// CreateTestUAAServer creates a fake UAA for the login flow. Its token
+// endpoint issues a token along with an ID token for the "ID" client of
+// GetMockCompleteEnvVars, carrying the given claims and signed with the key.
+func CreateTestUAAServer(key *rsa.PrivateKey, idTokenClaims map[string]interface{}) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprint(w, NewTestOpenIDConfiguration(server.URL+"/oauth/token", server.URL+"/token_keys"))
+		case "/token_keys":
+			fmt.Fprint(w, NewTestTokenKeys(key, "test-key"))
+		case "/oauth/token":
+			claims := map[string]interface{}{
+				"iss": server.URL + "/oauth/token",
+				"aud": []string{"ID"},
+				"exp": time.Now().Add(time.Hour).Unix(),
+			}
+			for k, v := range idTokenClaims {
+				claims[k] = v
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  "sampletoken",
+				"token_type":    "bearer",
+				"refresh_token": "samplerefresh",
+				"expires_in":    3600,
+				"id_token":      NewTestSignedJWT(key, "test-key", claims),
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+// AdminTokenData is a dataset which represents a valid token for a platform
+// operator. Useful for unit tests.
+var AdminTokenData = map[string]interface{}{
+	"token": oauth2.Token{Expiry: time.Time{}, AccessToken: NewTestJWT(map[string]interface{}{
+		"user_id":   "admin-user-guid",
+		"user_name": "admin",
+		"email":     "admin@example.com",
+		"scope":     []string{"openid", "cloud_controller.admin"},
+	})},
+	"issued_at":     time.Now().Unix(),
+	"last_activity": time.Now().Unix(),
 }
 
 // EchoResponseHandler is a normal handler for responses received from the proxy requests.
@@ -176,6 +283,36 @@ func NewJSONResponseContentTester(expected string) ResponseContentTester {
 	}
 }
 
+type jsonErrorContentTester struct {
+	Expected string
+}
+
+func (ject *jsonErrorContentTester) Check(t assert.TestingT, resp string) bool {
+	var envelope map[string]interface{}
+	if !assert.NoError(t, json.Unmarshal([]byte(resp), &envelope)) {
+		return false
+	}
+	if id, _ := envelope["request_id"].(string); !assert.NotEmpty(t, id, "request_id") {
+		return false
+	}
+	delete(envelope, "request_id")
+	actual, _ := json.Marshal(envelope)
+	return assert.JSONEq(t, ject.Expected, string(actual))
+}
+
+func (ject *jsonErrorContentTester) Display() string {
+	return ject.Expected
+}
+
+// NewJSONErrorContentTester creates a content matcher for the JSON error
+// envelope of the controllers. The request ID differs for every request, so
+// it must be present but is not compared.
+func NewJSONErrorContentTester(expected string) ResponseContentTester {
+	return &jsonErrorContentTester{
+		Expected: expected,
+	}
+}
+
 type stringContentTester struct {
 	Expected string
 }
@@ -252,6 +389,7 @@ func GetMockCompleteEnvVars() map[string]string {
 		helpers.SMTPHostEnvVar:      "localhost",
 		helpers.SecureCookiesEnvVar: "1",
 		helpers.TICSecretEnvVar:     "tic",
+		helpers.MetricsTokenEnvVar:  "metricstoken",
 	}
 }
 
@@ -363,6 +501,10 @@ func PrepareExternalServerCall(t *testing.T, c *controllers.SecureContext, testS
 		request.RemoteAddr = httptest.DefaultRemoteAddr + ":81"
 		request.URL.Scheme = "http"
 		request.URL.Host = request.Host
+		if test.RequestBody != nil {
+			// Like the frontend does.
+			request.Header.Set("Content-Type", "application/json")
+		}
 		for header, value := range test.RequestHeaders {
 			request.Header.Set(header, value)
 		}
@@ -0,0 +1,259 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// refreshResultTTL is how long the result of a refresh is kept. Requests
+	// that loaded the session before the refreshed token was saved reuse it
+	// instead of refreshing again with a refresh token that may no longer be
+	// valid.
+	refreshResultTTL = time.Minute
+	// refreshLockTTL is how long an instance can hold the lock on a refresh
+	// before others give up waiting and refresh themselves.
+	refreshLockTTL = 10 * time.Second
+	// refreshTimeout is how long a refresh can take. It is shared by all the
+	// requests waiting for it, so it isn't cancelled with any one of them, and
+	// doesn't outlive the lock of the instance making it.
+	refreshTimeout = refreshLockTTL
+	// refreshPollInterval is how often instances waiting for a refresh made by
+	// another instance check for its result.
+	refreshPollInterval = 50 * time.Millisecond
+	// redisTokenRefreshKeyPrefix is the prefix of the keys holding the locks
+	// and results of the token refreshes in redis.
+	redisTokenRefreshKeyPrefix = "token_refresh_"
+)
+
+// TokenRefresher makes sure that the token of a given session is refreshed
+// only once, even when several requests for that session need it at the same
+// time. Refreshes are keyed by refresh token, which is unique to a session and
+// available with every session backend.
+type TokenRefresher interface {
+	// Refresh returns the refreshed token, calling fn only if no refresh for
+	// the refresh token is in flight or recently completed. ctx only cancels
+	// the wait of the caller; fn is called with a context of its own.
+	Refresh(ctx context.Context, refreshToken string, fn func(context.Context) (*oauth2.Token, error)) (*oauth2.Token, error)
+}
+
+// refreshCall is an in flight or recently completed token refresh.
+type refreshCall struct {
+	done  chan struct{}
+	token *oauth2.Token
+	err   error
+}
+
+// memoryTokenRefresher is a TokenRefresher for a single instance, used when
+// the session backend is not redis.
+type memoryTokenRefresher struct {
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+}
+
+// NewMemoryTokenRefresher creates a TokenRefresher keeping the refreshes in
+// memory.
+func NewMemoryTokenRefresher() TokenRefresher {
+	return &memoryTokenRefresher{calls: make(map[string]*refreshCall)}
+}
+
+func (r *memoryTokenRefresher) Refresh(ctx context.Context, refreshToken string, fn func(context.Context) (*oauth2.Token, error)) (*oauth2.Token, error) {
+	r.mu.Lock()
+	call, ok := r.calls[refreshToken]
+	if !ok {
+		call = &refreshCall{done: make(chan struct{})}
+		r.calls[refreshToken] = call
+		go r.run(refreshToken, call, fn)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// run makes the refresh and shares its result with the requests waiting for
+// it, even if fn panics.
+func (r *memoryTokenRefresher) run(refreshToken string, call *refreshCall, fn func(context.Context) (*oauth2.Token, error)) {
+	defer func() {
+		if p := recover(); p != nil {
+			Log.Error("token refresh panicked", Fields{"panic": fmt.Sprint(p)})
+			call.token, call.err = nil, errors.New("token refresh failed")
+		}
+		close(call.done)
+
+		ttl := refreshResultTTL
+		if call.err != nil {
+			// Let the next request try again.
+			ttl = 0
+		}
+		time.AfterFunc(ttl, func() {
+			r.mu.Lock()
+			delete(r.calls, refreshToken)
+			r.mu.Unlock()
+		})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+	call.token, call.err = fn(ctx)
+}
+
+// redisUnlockScript deletes the lock only if it is still held by the caller.
+var redisUnlockScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisTokenRefresher is a TokenRefresher shared by all the instances, used
+// with the redis session backend. The instance refreshing a token holds a
+// lock (SET NX PX) and shares the refreshed token with the others for
+// refreshResultTTL, as the sessions themselves already are.
+type redisTokenRefresher struct {
+	pool *redis.Pool
+	// encryption encrypts the shared tokens like the session values. Nil when
+	// session encryption is disabled, in which case the tokens are shared as
+	// they are stored in the sessions.
+	encryption *EncryptedStore
+	// local makes the requests of this instance wait for each other rather
+	// than all polling redis.
+	local TokenRefresher
+}
+
+func newRedisTokenRefresher(pool *redis.Pool) *redisTokenRefresher {
+	return &redisTokenRefresher{pool: pool, local: NewMemoryTokenRefresher()}
+}
+
+func (r *redisTokenRefresher) Refresh(ctx context.Context, refreshToken string, fn func(context.Context) (*oauth2.Token, error)) (*oauth2.Token, error) {
+	return r.local.Refresh(ctx, refreshToken, func(ctx context.Context) (*oauth2.Token, error) {
+		// The refresh token is not written to redis as is.
+		sum := sha256.Sum256([]byte(refreshToken))
+		key := redisTokenRefreshKeyPrefix + hex.EncodeToString(sum[:])
+		token, err := r.refresh(ctx, key, fn)
+		if err == errRefreshUnavailable {
+			// Refresh anyway when redis can't be reached.
+			return fn(ctx)
+		}
+		return token, err
+	})
+}
+
+// errRefreshUnavailable is returned when the lock or the result of a refresh
+// can't be read from redis.
+var errRefreshUnavailable = errors.New("token refresh lock unavailable")
+
+func (r *redisTokenRefresher) refresh(ctx context.Context, key string, fn func(context.Context) (*oauth2.Token, error)) (*oauth2.Token, error) {
+	lockKey, resultKey := key+"_lock", key+"_result"
+	owner, err := GenerateRandomString(16)
+	if err != nil {
+		return nil, errRefreshUnavailable
+	}
+	c := r.pool.Get()
+	defer c.Close()
+	deadline := time.Now().Add(refreshLockTTL)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		if token, found := r.result(c, resultKey); found {
+			return token, nil
+		}
+		locked, err := redis.String(c.Do("SET", lockKey, owner, "NX", "PX", int64(refreshLockTTL/time.Millisecond)))
+		if err == redis.ErrNil {
+			// Another instance is refreshing the token.
+			time.Sleep(refreshPollInterval)
+			continue
+		}
+		if err != nil || locked != "OK" {
+			return nil, errRefreshUnavailable
+		}
+		defer redisUnlockScript.Do(c, lockKey, owner)
+		// The result may have been saved just before the lock was released.
+		if token, found := r.result(c, resultKey); found {
+			return token, nil
+		}
+		token, err := fn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.share(c, resultKey, token); err != nil {
+			Log.Error("unable to share refreshed token", Fields{"error": err})
+		}
+		return token, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// The instance holding the lock is taking too long.
+	return nil, errRefreshUnavailable
+}
+
+// share saves the refreshed token for the other instances, encrypted if the
+// sessions are.
+func (r *redisTokenRefresher) share(c redis.Conn, resultKey string, token *oauth2.Token) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	if r.encryption != nil {
+		// The result can't be moved to another key.
+		if b, err = r.encryption.seal(b, resultKey); err != nil {
+			return err
+		}
+	}
+	_, err = c.Do("SET", resultKey, b, "PX", int64(refreshResultTTL/time.Millisecond))
+	return err
+}
+
+// result returns the token refreshed by another instance, if any.
+func (r *redisTokenRefresher) result(c redis.Conn, resultKey string) (*oauth2.Token, bool) {
+	b, err := redis.Bytes(c.Do("GET", resultKey))
+	if err != nil {
+		return nil, false
+	}
+	if r.encryption != nil {
+		var binding string
+		if b, binding, err = r.encryption.open(b); err != nil || binding != resultKey {
+			return nil, false
+		}
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(b, &token); err != nil {
+		return nil, false
+	}
+	return &token, true
+}
+
+// refreshToken gets a new access token from UAA using the refresh token. The
+// wait for the refresh is cancelled with ctx, and the call to UAA is part of
+// the trace of the span, if any.
+func refreshToken(ctx context.Context, settings *Settings, token oauth2.Token, span *Span) (*oauth2.Token, error) {
+	if token.RefreshToken == "" {
+		return nil, errors.New("token expired and no refresh token")
+	}
+	client := tracedClient(settings.httpClient(), span)
+	refresh := func(ctx context.Context) (*oauth2.Token, error) {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+		newToken, err := settings.OAuthConfig.TokenSource(ctx, &token).Token()
+		if err != nil {
+			Metrics.TokenRefreshes.WithLabelValues("failure").Inc()
+		} else {
+			Metrics.TokenRefreshes.WithLabelValues("success").Inc()
+		}
+		return newToken, err
+	}
+	if settings.TokenRefresher == nil {
+		return refresh(ctx)
+	}
+	return settings.TokenRefresher.Refresh(ctx, token.RefreshToken, refresh)
+}
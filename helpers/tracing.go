@@ -0,0 +1,509 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader carries the trace context between services.
+// https://www.w3.org/TR/trace-context/
+const TraceparentHeader = "traceparent"
+
+const (
+	// traceBatchSize is how many spans are exported at once at most.
+	traceBatchSize = 512
+	// traceQueueSize is how many spans can wait to be exported. Spans are
+	// dropped beyond that, rather than slowing down requests.
+	traceQueueSize = 2048
+	// traceFlushInterval is how long spans wait before being exported.
+	traceFlushInterval = 5 * time.Second
+)
+
+// Span kinds, as defined by OpenTelemetry.
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+)
+
+// Span is an operation within a trace, such as serving a request or calling
+// an upstream.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	Attributes   Fields
+	Error        string
+	sampled      bool
+	tracer       *Tracer
+}
+
+// SetAttribute adds an attribute to the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.Error = msg
+}
+
+// Finish ends the span and queues it for export.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+	if s.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// Traceparent returns the traceparent header value propagating the span.
+func (s *Span) Traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + s.TraceID + "-" + s.SpanID + "-" + flags
+}
+
+// Inject sets the traceparent header so that the upstream joins the trace.
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	header.Set(TraceparentHeader, s.Traceparent())
+}
+
+// SpanExporter sends finished spans to a tracing backend.
+type SpanExporter interface {
+	Export(spans []*Span) error
+}
+
+// TracerOptions are how a Tracer samples the traces.
+type TracerOptions struct {
+	// SampleRatio is the share, between 0 and 1, of the new traces that are
+	// sampled.
+	SampleRatio float64
+	// TrustParent makes the requests with a traceparent header continue the
+	// trace of the caller, following its sampling decision. Otherwise they
+	// start a new trace, so that callers such as browsers can't choose the
+	// trace or force it to be sampled.
+	TrustParent bool
+}
+
+// Tracer creates spans and exports them in the background. A nil Tracer
+// creates no spans, so tracing can be left disabled.
+type Tracer struct {
+	exporter SpanExporter
+	options  TracerOptions
+	queue    chan *Span
+	done     chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewTracer creates a tracer exporting spans with the exporter.
+func NewTracer(exporter SpanExporter, options TracerOptions) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		options:  options,
+		queue:    make(chan *Span, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// StartSpan starts a span serving the request. If the tracer trusts the
+// callers, it continues the trace of the traceparent header of the request if
+// it has a valid one. Otherwise the span starts a new trace, sampled according
+// to the sample ratio.
+func (t *Tracer) StartSpan(req *http.Request, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := t.newSpan(name, SpanKindServer)
+	if t.options.TrustParent {
+		if traceID, parentID, sampled, ok := parseTraceparent(req.Header.Get(TraceparentHeader)); ok {
+			span.TraceID = traceID
+			span.ParentSpanID = parentID
+			span.sampled = sampled
+			return span
+		}
+	}
+	span.sampled = sampleTrace(span.TraceID, t.options.SampleRatio)
+	return span
+}
+
+// sampleTrace decides whether a new trace is sampled from its ID, as the
+// TraceIDRatioBased sampler of OpenTelemetry does, so that the decision is
+// the same wherever it is made.
+func sampleTrace(traceID string, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	b, err := hex.DecodeString(traceID)
+	if err != nil || len(b) != 16 {
+		return false
+	}
+	return binary.BigEndian.Uint64(b[8:])>>1 < uint64(ratio*(1<<63))
+}
+
+// StartChildSpan starts a span within the span of the request, if it has one.
+func (t *Tracer) StartChildSpan(req *http.Request, name string, kind int) *Span {
+	parent := RequestSpan(req)
+	if t == nil || parent == nil {
+		return nil
+	}
+	span := t.newSpan(name, kind)
+	span.TraceID = parent.TraceID
+	span.ParentSpanID = parent.SpanID
+	span.sampled = parent.sampled
+	return span
+}
+
+func (t *Tracer) newSpan(name string, kind int) *Span {
+	return &Span{
+		TraceID:    newTraceID(16),
+		SpanID:     newTraceID(8),
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(Fields),
+		sampled:    true,
+		tracer:     t,
+	}
+}
+
+// Close exports the spans still queued and stops the tracer.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mu.Unlock()
+	<-t.done
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		// Don't slow down requests because the tracing backend is.
+	}
+}
+
+// run batches the queued spans and exports them.
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			Log.Error("unable to export spans", Fields{"error": err, "spans": len(batch)})
+		}
+		batch = make([]*Span, 0, traceBatchSize)
+	}
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+type spanKey struct{}
+
+// WithSpan returns a copy of the request carrying the span.
+func WithSpan(req *http.Request, span *Span) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), spanKey{}, span))
+}
+
+// RequestSpan returns the span of the request, or nil if it has none.
+func RequestSpan(req *http.Request) *Span {
+	span, _ := req.Context().Value(spanKey{}).(*Span)
+	return span
+}
+
+// tracingTransport adds the traceparent header of a span to the requests.
+type tracingTransport struct {
+	span *Span
+	base http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	t.span.Inject(r.Header)
+	return t.base.RoundTrip(r)
+}
+
+// tracedClient returns a copy of the client propagating the span.
+func tracedClient(client *http.Client, span *Span) *http.Client {
+	if span == nil {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	traced := *client
+	traced.Transport = &tracingTransport{span: span, base: base}
+	return &traced
+}
+
+// parseTraceparent returns the trace ID, parent span ID and sampled flag of a
+// traceparent header.
+func parseTraceparent(value string) (traceID, parentID string, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", false, false
+	}
+	traceID, parentID = parts[1], parts[2]
+	if !validTraceID(traceID, 32) || !validTraceID(parentID, 16) || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return "", "", false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// validTraceID checks that the ID is lowercase hex of the given length and not
+// all zeros.
+func validTraceID(id string, length int) bool {
+	if len(id) != length || strings.Trim(id, "0") == "" {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceID(n int) string {
+	b, err := GenerateRandomBytes(n)
+	if err != nil {
+		return strings.Repeat("0", n-1) + "1"
+	}
+	return hex.EncodeToString(b)
+}
+
+// StdoutExporter logs the spans, for local testing.
+type StdoutExporter struct{}
+
+// Export logs each span.
+func (StdoutExporter) Export(spans []*Span) error {
+	for _, span := range spans {
+		fields := Fields{
+			"trace_id":    span.TraceID,
+			"span_id":     span.SpanID,
+			"span_name":   span.Name,
+			"duration_ms": span.End.Sub(span.Start).Seconds() * 1000,
+			"attributes":  span.Attributes,
+		}
+		if span.ParentSpanID != "" {
+			fields["parent_span_id"] = span.ParentSpanID
+		}
+		if span.Error != "" {
+			fields["error"] = span.Error
+		}
+		Log.Info("span", fields)
+	}
+	return nil
+}
+
+// OTLPExporter sends the spans to an OpenTelemetry collector with OTLP over
+// HTTP, in JSON.
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type OTLPExporter struct {
+	URL         string
+	Headers     http.Header
+	ServiceName string
+	Client      *http.Client
+}
+
+// NewOTLPExporter creates an exporter for the collector at endpoint. headers
+// are comma separated key=value pairs sent with every export, such as
+// credentials.
+func NewOTLPExporter(endpoint, headers, serviceName string) (*OTLPExporter, error) {
+	if endpoint == "" {
+		return nil, errors.New("no OTLP endpoint set")
+	}
+	e := &OTLPExporter{
+		URL:         strings.TrimRight(endpoint, "/") + "/v1/traces",
+		Headers:     make(http.Header),
+		ServiceName: serviceName,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, pair := range strings.Split(headers, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid OTLP header: %s", pair)
+		}
+		e.Headers.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	return e, nil
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// Export sends the spans to the collector.
+func (e *OTLPExporter) Export(spans []*Span) error {
+	exported := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.Error != "" {
+			// STATUS_CODE_ERROR
+			s.Status.Code = 2
+			s.Status.Message = span.Error
+		}
+		exported = append(exported, s)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(Fields{"service.name": e.ServiceName}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/18F/cg-dashboard"},
+				"spans": exported,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range e.Headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("cannot export spans: %s", resp.Status)
+	}
+	return nil
+}
+
+// otlpAttributes converts the attributes to OTLP key values, sorted by key.
+func otlpAttributes(fields Fields) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(fields))
+	for _, key := range sortedFieldKeys(fields) {
+		var value map[string]interface{}
+		switch v := fields[key].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			// 64 bit integers are strings in OTLP JSON.
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		attributes = append(attributes, otlpAttribute{Key: key, Value: value})
+	}
+	return attributes
+}
+
+func sortedFieldKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,165 @@
+package helpers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/18F/cg-dashboard/helpers"
+)
+
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []*helpers.Span
+}
+
+func (e *recordingExporter) Export(spans []*helpers.Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	exporter := &recordingExporter{}
+	tracer := helpers.NewTracer(exporter, helpers.TracerOptions{SampleRatio: 1, TrustParent: true})
+
+	req, _ := http.NewRequest("GET", "/v2/info", nil)
+	req.Header.Set(helpers.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span := tracer.StartSpan(req, "GET /v2/:*")
+	req = helpers.WithSpan(req, span)
+	child := tracer.StartChildSpan(req, "GET cf_api", helpers.SpanKindClient)
+	header := make(http.Header)
+	child.Inject(header)
+	child.SetError("502 Bad Gateway")
+	child.Finish()
+	span.Finish()
+
+	// Unsampled traces are not exported.
+	unsampled, _ := http.NewRequest("GET", "/v2/info", nil)
+	unsampled.Header.Set(helpers.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	tracer.StartSpan(unsampled, "GET /v2/:*").Finish()
+
+	tracer.Close()
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 spans to be exported. Found %d", len(exporter.spans))
+	}
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected the span to continue the trace. Found %+v", span)
+	}
+	if child.TraceID != span.TraceID || child.ParentSpanID != span.SpanID {
+		t.Errorf("Expected the child span to be within the span. Found %+v", child)
+	}
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + child.SpanID + "-01"
+	if header.Get(helpers.TraceparentHeader) != expected {
+		t.Errorf("Expected traceparent %s. Found %s", expected, header.Get(helpers.TraceparentHeader))
+	}
+
+	// A nil tracer, when tracing is disabled, does nothing.
+	var disabled *helpers.Tracer
+	if s := disabled.StartSpan(req, "GET"); s != nil {
+		t.Error("Expected no span when tracing is disabled")
+	}
+	disabled.StartChildSpan(req, "GET", helpers.SpanKindClient).Finish()
+	disabled.Close()
+}
+
+func TestTracerSampling(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/v2/info", nil)
+	req.Header.Set(helpers.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	// Untrusted callers can't choose the trace nor force it to be sampled.
+	exporter := &recordingExporter{}
+	tracer := helpers.NewTracer(exporter, helpers.TracerOptions{SampleRatio: 0})
+	span := tracer.StartSpan(req, "GET /v2/:*")
+	span.Finish()
+	tracer.Close()
+	if span.TraceID == "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "" {
+		t.Errorf("Expected the span to start a new trace. Found %+v", span)
+	}
+	if len(exporter.spans) != 0 {
+		t.Errorf("Expected the new trace not to be sampled. Found %d spans", len(exporter.spans))
+	}
+
+	// About the given share of the new traces are sampled.
+	exporter = &recordingExporter{}
+	tracer = helpers.NewTracer(exporter, helpers.TracerOptions{SampleRatio: 0.5})
+	for i := 0; i < 1000; i++ {
+		tracer.StartSpan(req, "GET /v2/:*").Finish()
+	}
+	tracer.Close()
+	if len(exporter.spans) < 400 || len(exporter.spans) > 600 {
+		t.Errorf("Expected about half of the traces to be sampled. Found %d", len(exporter.spans))
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Kind         int    `json:"kind"`
+					Attributes   []struct {
+						Key   string                 `json:"key"`
+						Value map[string]interface{} `json:"value"`
+					} `json:"attributes"`
+					Status struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	var authorization string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		authorization = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer collector.Close()
+
+	exporter, err := helpers.NewOTLPExporter(collector.URL+"/", "Authorization=Bearer secret", "dashboard")
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err)
+	}
+	tracer := helpers.NewTracer(exporter, helpers.TracerOptions{SampleRatio: 1})
+	req, _ := http.NewRequest("GET", "/uaa/userinfo", nil)
+	span := tracer.StartSpan(req, "GET /uaa/userinfo")
+	span.SetAttribute("http.status_code", 500)
+	span.SetError("Internal Server Error")
+	span.Finish()
+	tracer.Close()
+
+	if authorization != "Bearer secret" {
+		t.Errorf("Expected the configured headers to be sent. Found %q", authorization)
+	}
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("Expected one span to be exported. Found %+v", body)
+	}
+	exported := body.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if exported.TraceID != span.TraceID || exported.Name != "GET /uaa/userinfo" || exported.Kind != helpers.SpanKindServer {
+		t.Errorf("Unexpected exported span %+v", exported)
+	}
+	if exported.Status.Code != 2 {
+		t.Errorf("Expected the span to have the error status. Found %d", exported.Status.Code)
+	}
+	if len(exported.Attributes) != 1 || exported.Attributes[0].Key != "http.status_code" || exported.Attributes[0].Value["intValue"] != "500" {
+		t.Errorf("Unexpected exported attributes %+v", exported.Attributes)
+	}
+
+	if _, err := helpers.NewOTLPExporter("", "", "dashboard"); err == nil {
+		t.Error("Expected an error without an endpoint")
+	}
+	if _, err := helpers.NewOTLPExporter(collector.URL, "invalid", "dashboard"); err == nil {
+		t.Error("Expected an error with invalid headers")
+	}
+}
@@ -1,12 +1,22 @@
 package mailer
 
 import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"time"
 
 	"github.com/18F/cg-dashboard/helpers"
 	"github.com/jordan-wright/email"
 )
 
+// smtpTimeout is how long sending an e-mail can take, from connecting to the
+// relay to the end of the conversation. Shorter than the route timeouts, so
+// that a relay that stops answering fails the request rather than holding it.
+var smtpTimeout = 15 * time.Second
+
 // Mailer is a interface that any mailer should implement.
 type Mailer interface {
 	SendEmail(emailAddress string, subject string, body []byte) error
@@ -37,5 +47,58 @@ func (s *smtpMailer) SendEmail(emailAddress, subject string, body []byte) error
 	e.To = []string{" <" + emailAddress + ">"}
 	e.HTML = body
 	e.Subject = subject
-	return e.Send(s.smtpHost+":"+s.smtpPort, smtp.PlainAuth("", s.smtpUser, s.smtpPass, s.smtpHost))
+	to, err := mail.ParseAddress(e.To[0])
+	if err != nil {
+		return err
+	}
+	raw, err := e.Bytes()
+	if err != nil {
+		return err
+	}
+	return s.send(to.Address, raw)
+}
+
+// send sends the message as smtp.SendMail does, within smtpTimeout.
+func (s *smtpMailer) send(to string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.smtpHost, s.smtpPort), smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, s.smtpHost)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: s.smtpHost}); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return errors.New("smtp: server doesn't support AUTH")
+	}
+	if err := c.Auth(smtp.PlainAuth("", s.smtpUser, s.smtpPass, s.smtpHost)); err != nil {
+		return err
+	}
+	if err := c.Mail(s.smtpFrom); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
 }
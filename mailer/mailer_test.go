@@ -2,9 +2,11 @@ package mailer
 
 import (
 	"bytes"
+	"net"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/18F/cg-dashboard/helpers"
 	. "github.com/18F/cg-dashboard/helpers/testhelpers/docker"
@@ -69,3 +71,33 @@ func TestInitSMTPMailer(t *testing.T) {
 		t.Errorf("Expected nil error, found %s", err.Error())
 	}
 }
+
+func TestSendEmailTimeout(t *testing.T) {
+	// A relay that accepts connections but never answers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	defer func(timeout time.Duration) { smtpTimeout = timeout }(smtpTimeout)
+	smtpTimeout = 100 * time.Millisecond
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	mailer, _ := InitSMTPMailer(helpers.Settings{SMTPHost: host, SMTPPort: port, SMTPFrom: "test@dashboard.com"})
+	start := time.Now()
+	if err := mailer.SendEmail("test@receiver.com", "sample subject", []byte("test html here")); err == nil {
+		t.Error("Expected the relay not answering to be an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected sending to give up after the SMTP timeout. Took %s", elapsed)
+	}
+}
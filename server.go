@@ -1,9 +1,16 @@
 package main
 
 import (
+	stdcontext "context"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/gorilla/context"
@@ -15,27 +22,72 @@ import (
 	"github.com/18F/cg-dashboard/helpers"
 )
 
-const (
-	defaultPort           = "9999"
-	cfUserProvidedService = "dashboard-ups"
-)
+const cfUserProvidedService = "dashboard-ups"
 
 func main() {
-	// Start the server up.
-	var port string
-	if port = os.Getenv("PORT"); len(port) == 0 {
-		port = defaultPort
-	}
-	fmt.Println("using port: " + port)
+	port := flag.String("port", "", "the port to listen on, instead of PORT")
+	checkConfig := flag.Bool("check-config", false, "validate the configuration, print it with the secrets redacted and exit")
+	flag.Parse()
 
 	// Try to load the user-provided-service
 	// for backup of certain environment variables.
 	cfEnv, err := cfenv.Current()
 	if err != nil || cfEnv == nil {
-		fmt.Println("Warning: No Cloud Foundry Environment found")
+		helpers.Log.Warn("no Cloud Foundry environment found")
+	}
+	// Look for env vars first in a user provided service (if available), and if not found,
+	// fallback to the environment. The port flag comes first.
+	envVars := helpers.NewEnvVarsFromPath(
+		func(key string) (string, bool) {
+			return *port, key == helpers.PortEnvVar && *port != ""
+		},
+		helpers.NewEnvLookupFromCFAppNamedService(cfEnv, cfUserProvidedService),
+		os.LookupEnv,
+	)
+
+	if *checkConfig {
+		os.Exit(runCheckConfig(os.Stdout, envVars, cfEnv))
+	}
+	startApp(envVars, cfEnv)
+}
+
+// runCheckConfig validates the configuration without starting the app. It
+// prints every problem, or the effective configuration, and returns the exit
+// code.
+func runCheckConfig(w io.Writer, envVars *helpers.EnvVars, env *cfenv.App) int {
+	config, err := helpers.LoadConfig(envVars, env)
+	if err != nil {
+		fmt.Fprintln(w, "invalid configuration:")
+		for _, problem := range configProblems(err) {
+			fmt.Fprintln(w, "  - "+problem)
+		}
+		return 1
+	}
+	summary := config.Summary()
+	keys := make([]string, 0, len(summary))
+	for key := range summary {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s=%v\n", key, summary[key])
 	}
+	fmt.Fprintln(w, "configuration is valid")
+	return 0
+}
 
-	startApp(port, cfEnv)
+// configProblems lists the problems of an invalid configuration, or the
+// error itself if it isn't one.
+func configProblems(err error) []string {
+	configErr, ok := err.(*helpers.ConfigError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	problems := make([]string, len(configErr.Problems))
+	for i, problem := range configErr.Problems {
+		problems[i] = problem.Error()
+	}
+	return problems
 }
 
 func startMonitoring(license string) {
@@ -45,41 +97,94 @@ func startMonitoring(license string) {
 	agent.NewrelicLicense = license
 	agent.NewrelicName = "Cloudgov Deck"
 	if err := agent.Run(); err != nil {
-		fmt.Println(err.Error())
+		helpers.Log.Error("unable to start monitoring", helpers.Fields{"error": err})
 	}
 }
 
-func startApp(port string, env *cfenv.App) {
-	// Look for env vars first in a user provided service (if available), and if not found,
-	// fallback to the environment.
-	envVars := helpers.NewEnvVarsFromPath(
-		helpers.NewEnvLookupFromCFAppNamedService(env, cfUserProvidedService),
-		os.LookupEnv,
-	)
-
+func startApp(envVars *helpers.EnvVars, env *cfenv.App) {
 	app, settings, err := controllers.InitApp(envVars, env)
 	if err != nil {
 		// Print the error.
-		fmt.Println(err.Error())
+		helpers.Log.Error("unable to start the app", helpers.Fields{"problems": configProblems(err)})
 		// Terminate the program with a non-zero value number.
 		// Need this for testing purposes.
 		os.Exit(1)
 	}
+	helpers.Log.Info("configuration", settings.Config.Summary())
+	helpers.Log.Info("using port: " + settings.Config.Port)
 	if settings.PProfEnabled {
 		pprof.InitPProfRouter(app)
 	}
 
-	nrLicense := envVars.String(helpers.NewRelicLicenseEnvVar, "")
-	if nrLicense != "" {
-		fmt.Println("starting monitoring...")
-		startMonitoring(nrLicense)
+	if settings.Config.NewRelicLicense != "" {
+		helpers.Log.Info("starting monitoring...")
+		startMonitoring(settings.Config.NewRelicLicense)
 	}
 
-	fmt.Println("starting app now...")
+	helpers.Log.Info("starting app now...")
+
+	// Requests time out as configured for their route group.
+	protect := csrf.Protect([]byte(settings.Config.SessionKey), csrf.Secure(settings.SecureCookies))
+	server := newServer(":"+settings.Config.Port, csrfExempt(protect(context.ClearHandler(app)), helpers.CSPReportPath), settings)
 
-	// TODO add better timeout message. By default it will just say "Timeout"
-	protect := csrf.Protect([]byte(envVars.MustString(helpers.SessionKeyEnvVar)), csrf.Secure(settings.SecureCookies))
-	http.ListenAndServe(":"+port, protect(
-		http.TimeoutHandler(context.ClearHandler(app), helpers.TimeoutConstant, ""),
-	))
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		helpers.Log.Info("shutting down", helpers.Fields{"signal": sig.String(), "timeout": settings.ShutdownTimeout.String(), "drain_delay": settings.ShutdownDrainDelay.String()})
+		shutdown(server, settings)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		helpers.Log.Error("unable to serve", helpers.Fields{"error": err})
+		os.Exit(1)
+	}
+	<-stopped
+	helpers.Log.Info("stopped")
+}
+
+// newServer creates the HTTP server with the configured timeouts and limits.
+func newServer(addr string, handler http.Handler, settings *helpers.Settings) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadTimeout:       settings.ServerReadTimeout,
+		ReadHeaderTimeout: settings.ServerReadHeaderTimeout,
+		WriteTimeout:      settings.ServerWriteTimeout,
+		IdleTimeout:       settings.ServerIdleTimeout,
+		MaxHeaderBytes:    settings.ServerMaxHeaderBytes,
+	}
+}
+
+// csrfExempt lets the POST requests to the paths through without a CSRF
+// token, for the reports browsers send on their own.
+func csrfExempt(handler http.Handler, paths ...string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for _, path := range paths {
+			if req.Method == "POST" && req.URL.Path == path {
+				req = csrf.UnsafeSkipCheck(req)
+				break
+			}
+		}
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// shutdown keeps serving requests for the drain delay, while the router stops
+// sending any, then stops accepting connections and waits for the requests in
+// flight to complete, up to the shutdown timeout, before releasing the
+// resources of the app. Health checks report the app as draining meanwhile.
+func shutdown(server *http.Server, settings *helpers.Settings) {
+	settings.StartDraining()
+	ctx, cancel := stdcontext.WithTimeout(stdcontext.Background(), settings.ShutdownTimeout)
+	defer cancel()
+	time.Sleep(settings.ShutdownDrainDelay)
+	if err := server.Shutdown(ctx); err != nil {
+		helpers.Log.Error("requests still in flight were dropped", helpers.Fields{"error": err})
+	}
+	if err := settings.Close(); err != nil {
+		helpers.Log.Error("unable to close the session store", helpers.Fields{"error": err})
+	}
 }
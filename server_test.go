@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/18F/cg-dashboard/helpers"
+	"github.com/18F/cg-dashboard/helpers/testhelpers"
+)
+
+func TestShutdown(t *testing.T) {
+	settings := &helpers.Settings{ShutdownTimeout: 2 * time.Second, ShutdownDrainDelay: 300 * time.Millisecond}
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Write([]byte("done"))
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(listener.Addr().String(), handler, settings)
+	go server.Serve(listener)
+	url := "http://" + listener.Addr().String()
+	// Don't reuse connections, so that every request needs the server to
+	// accept a new one.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	slow := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(url + "/slow")
+		if err == nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "done" {
+				t.Errorf("Expected the request in flight to complete. Found %q", body)
+			}
+		}
+		slow <- err
+	}()
+	<-started
+
+	start := time.Now()
+	stopped := make(chan struct{})
+	go func() {
+		shutdown(server, settings)
+		close(stopped)
+	}()
+
+	// Requests are still served during the drain delay.
+	time.Sleep(100 * time.Millisecond)
+	if !settings.Draining() {
+		t.Error("Expected the app to report it is draining")
+	}
+	resp, err := client.Get(url + "/fast")
+	if err != nil {
+		t.Errorf("Expected requests to be served during the drain delay. Found %s", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	<-stopped
+	if elapsed := time.Since(start); elapsed < settings.ShutdownDrainDelay {
+		t.Errorf("Expected the shutdown to wait for the drain delay. Took %s", elapsed)
+	}
+	if err := <-slow; err != nil {
+		t.Errorf("Expected the request in flight to complete. Found %s", err)
+	}
+	// New connections are refused once shut down.
+	if _, err := client.Get(url + "/fast"); err == nil {
+		t.Error("Expected the server to be stopped")
+	}
+}
+
+func TestRunCheckConfig(t *testing.T) {
+	envVars := testhelpers.GetMockCompleteEnvVars()
+	var out bytes.Buffer
+	if code := runCheckConfig(&out, helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), nil); code != 0 {
+		t.Fatalf("Expected a valid configuration. Found %d: %s", code, out.String())
+	}
+	if !strings.Contains(out.String(), "CONSOLE_CLIENT_ID=ID\n") || !strings.Contains(out.String(), "SESSION_KEY=[REDACTED]\n") ||
+		!strings.HasSuffix(out.String(), "configuration is valid\n") {
+		t.Errorf("Expected the effective configuration, with the secrets redacted. Found %s", out.String())
+	}
+	if strings.Contains(out.String(), "lalala") {
+		t.Errorf("Expected the session key not to be printed. Found %s", out.String())
+	}
+
+	delete(envVars, helpers.ClientIDEnvVar)
+	envVars[helpers.SessionBackendEnvVar] = "redis"
+	out.Reset()
+	if code := runCheckConfig(&out, helpers.NewEnvVarsFromPath(testhelpers.NewEnvLookupFromMap(envVars)), nil); code != 1 {
+		t.Fatalf("Expected an invalid configuration. Found %d: %s", code, out.String())
+	}
+	expected := "invalid configuration:\n" +
+		"  - missing env variable: CONSOLE_CLIENT_ID\n" +
+		"  - SESSION_BACKEND=redis requires REDIS_URI or a bound service tagged redis\n"
+	if out.String() != expected {
+		t.Errorf("Expected every problem. Found %s", out.String())
+	}
+}
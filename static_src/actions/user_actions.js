@@ -224,7 +224,7 @@ const userActions = {
       email
     });
 
-    return uaaApi.inviteUaaUser(email)
+    return uaaApi.inviteUaaUser(email, OrgStore.currentOrgGuid)
       .then(invite => userActions.receivedInviteStatus(invite, email))
       .catch(err => userActions.userInviteCreateError(err, `There was a problem
         inviting ${email}`));
@@ -47,7 +47,7 @@ export default class ErrorMessage extends React.Component {
   }
 
   knownMessage(message) {
-    return `The system returned an error, ${message}. Please
+    return `The system returned an error, ${message.replace(/\.$/, '')}. Please
       try again`;
   }
 
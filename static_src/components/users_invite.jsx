@@ -65,7 +65,7 @@ export default class UsersInvite extends React.Component {
     const message = error.contextualMessage;
 
     if (error.message) {
-      return `${message}: ${error.message}.`;
+      return `${message}: ${error.message.replace(/\.$/, '')}.`;
     }
 
     return message;
@@ -142,8 +142,11 @@ export function checkAuth(...args) {
         style: 'inline'
       });
 
-      // Redirect the user to the cloud.gov login page
-      return Promise.reject(windowUtil.redirect('/handshake'));
+      // Redirect the user to the cloud.gov login page, coming back to this
+      // page once logged in.
+      const { hash } = window.location;
+      const returnTo = hash ? `?next=${encodeURIComponent(`/${hash}`)}` : '';
+      return Promise.reject(windowUtil.redirect(`/handshake${returnTo}`));
     })
     .then(() => {
       userActions.fetchCurrentUser({ orgGuid, spaceGuid });
@@ -62,6 +62,21 @@ describe('<UsersInvite />', function () {
     });
   });
 
+  describe('when the invite failed', () => {
+    it('shows the error after the context, ending with a single period', () => {
+      const errorProps = Object.assign({}, props, {
+        error: {
+          contextualMessage: 'There was a problem inviting user@example.com',
+          message: 'too many requests. try again in 60 seconds.'
+        }
+      });
+      wrapper = shallow(<UsersInvite { ...errorProps } />);
+
+      expect(wrapper.instance().errorMessage).toBe('There was a problem ' +
+        'inviting user@example.com: too many requests. try again in 60 seconds.');
+    });
+  });
+
   describe('when user does not have ability to invite other users', () => {
     it('does not render <Form /> component', () => {
       const noAccessProps = Object.assign({}, props, { currentUserAccess: false });
@@ -156,5 +156,29 @@ describe('routes', function () {
         expect(userActions.fetchCurrentUser).not.toHaveBeenCalled();
       });
     });
+
+    describe('given unauthorized response on a page', function () {
+      let next;
+
+      beforeEach(function (done) {
+        window.location.hash = '/org/org-guid';
+        next = sandbox.spy(done);
+        sandbox.stub(routerActions, 'navigate');
+        sandbox.stub(windowUtil, 'redirect');
+        loginActions.fetchStatus.returns(Promise.resolve({ status: 'unauthorized' }));
+
+        checkAuth(next);
+      });
+
+      afterEach(function () {
+        window.location.hash = '';
+      });
+
+      it('redirects to /handshake coming back to the page', function () {
+        expect(windowUtil.redirect).toHaveBeenCalledWith(
+          '/handshake?next=%2F%23%2Forg%2Forg-guid'
+        );
+      });
+    });
   });
 });
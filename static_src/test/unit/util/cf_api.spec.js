@@ -587,6 +587,35 @@ describe('cfApi', function() {
         expect(result).toBe(err);
       });
     });
+
+    describe('given an error of the dashboard', function () {
+      let result;
+
+      beforeEach(function (done) {
+        http.get.returns(Promise.reject({
+          response: {
+            status: 504,
+            data: {
+              status: 'failure',
+              code: 'timeout',
+              message: 'the request timed out. try again.'
+            }
+          }
+        }));
+
+        cfApi.getAuthStatus()
+          .then(done.fail)
+          .catch(_result => {
+            result = _result;
+            done();
+          });
+      });
+
+      it('rejects with the message and code of the error', () => {
+        expect(result.message).toBe('the request timed out. try again.');
+        expect(result.code).toBe('timeout');
+      });
+    });
   });
 
   describe('fetchOrg()', () => {
@@ -58,10 +58,11 @@ describe('uaaApi', function() {
   describe('inviteUaaUser()', function () {
     it('should make invite uaa request and receive proper payload', function (done) {
       const email = 'email@domain.com';
-      const expectedPayload = { email: 'email@domain.com' };
+      const orgGuid = 'org-guid';
+      const expectedPayload = { email: 'email@domain.com', orgGuid: 'org-guid' };
       const spy = sandbox.stub(http, 'post');
       spy.returns(createPromise({response: 'success'}));
-      uaaApi.inviteUaaUser(email).then(() => {
+      uaaApi.inviteUaaUser(email, orgGuid).then(() => {
         const args = spy.getCall(0).args;
         expect(spy).toHaveBeenCalledOnce();
         expect(args[0]).toMatch('/uaa/invite/users');
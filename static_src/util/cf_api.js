@@ -29,6 +29,21 @@ function CfApiV2Error(response) {
 CfApiV2Error.prototype = Object.create(Error.prototype);
 CfApiV2Error.prototype.constructor = Error;
 
+// An error of the dashboard itself, such as a request it doesn't proxy or one
+// that timed out.
+function DashboardError(response) {
+  const { code, message } = response.data;
+
+  this.code = code;
+  this.description = message;
+  this.response = response;
+
+  this.message = message;
+}
+
+DashboardError.prototype = Object.create(Error.prototype);
+DashboardError.prototype.constructor = Error;
+
 
 // TODO handleError should probably return a (rejected) Promise
 function handleError(err, errHandler = errorActions.errorFetch) {
@@ -65,6 +80,10 @@ function parseError(resultOrError) {
         error.response = response;
         return error;
       }
+
+      if (response.data.status === 'failure' && response.data.message) {
+        return new DashboardError(response);
+      }
     }
 
     // If data is not an object, we're not sure what to do with it.
@@ -14,9 +14,10 @@ export default {
       .then(res => res.data);
   },
 
-  inviteUaaUser(email) {
+  inviteUaaUser(email, orgGuid) {
     const params = {};
     params.email = email;
+    params.orgGuid = orgGuid;
     return http.post(`${URL}/invite/users`, params)
       .then(res => res.data)
       .catch(err => Promise.reject(err.response.data));